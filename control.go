@@ -0,0 +1,265 @@
+package main
+
+import (
+  "bufio"
+  "errors"
+  "fmt"
+  "log/slog"
+  "net"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "time"
+)
+
+const (
+  // controlDialTimeout 是连接另一个实例控制套接字的超时
+  controlDialTimeout = 2 * time.Second
+  // controlReplyTimeout 是等待对方处理请求 (重新发送文件、断开编辑器并释放锁) 的超时
+  controlReplyTimeout = 10 * time.Second
+)
+
+// 控制命令，每个请求占一行，应答为 "ok" 或 "error <原因>"
+const (
+  controlReactivate = "reactivate" // 在编辑器中重新激活文件
+  controlTakeover   = "takeover"   // 释放文件，由请求方接管
+  controlClose      = "close"      // 断开编辑器并退出
+)
+
+// controlRequest 是一个等待主循环处理的控制请求。
+type controlRequest struct {
+  Command string
+  reply   chan error
+  sent    chan struct{}
+}
+
+// Reply 把处理结果返回给请求方，并等到应答写出后才返回，
+// 这样处理接管或关闭请求的实例可以在 Reply 之后立即退出。
+func (r controlRequest) Reply(err error) {
+  r.reply <- err
+  <-r.sent
+}
+
+// ControlServer 在本地套接字上接收其他 gomate 实例发来的控制请求。
+// 套接字位于只有当前用户可访问的目录中，因此只有同一用户的实例能够控制这个会话。
+type ControlServer struct {
+  ln       net.Listener
+  path     string
+  requests chan controlRequest
+}
+
+// controlDir 返回存放控制套接字的目录：第一个可用的用户私有锁目录下的 control 子目录。
+// 两级目录都必须属于当前用户且权限为 0700，否则其他用户可以替换或连接其中的套接字。
+func controlDir() (string, error) {
+  var lastErr error = errors.New("no private lock directory")
+  for _, dir := range defaultLockDirs() {
+    if dir.Shared {
+      continue
+    }
+    ctl := filepath.Join(dir.Path, "control")
+    if err := ensurePrivateDir(dir.Path); err != nil {
+      slog.Debug("control directory unusable", "dir", ctl, "error", err)
+      lastErr = err
+      continue
+    }
+    if err := ensurePrivateDir(ctl); err != nil {
+      slog.Debug("control directory unusable", "dir", ctl, "error", err)
+      lastErr = err
+      continue
+    }
+    return ctl, nil
+  }
+  return "", fmt.Errorf("failed to find a usable control directory: %w", lastErr)
+}
+
+// startControlServer 为 lockID 对应的会话创建控制套接字。
+func startControlServer(lockID string) (*ControlServer, error) {
+  dir, err := controlDir()
+  if err != nil {
+    return nil, err
+  }
+  removeStaleControlSockets(dir)
+
+  // 套接字路径长度有限 (macOS 上为 104 字节)，文件名只取锁 ID 的前缀；
+  // 加上 PID 以免接管方与尚未退出的旧实例争用同一个路径
+  if len(lockID) > lockIDWidth {
+    lockID = lockID[:lockIDWidth]
+  }
+  path := filepath.Join(dir, fmt.Sprintf("%s-%d.sock", lockID, os.Getpid()))
+  os.Remove(path)
+  ln, err := net.Listen("unix", path)
+  if err != nil {
+    return nil, fmt.Errorf("failed to listen on control socket %s: %w", path, err)
+  }
+  s := &ControlServer{ln: ln, path: path, requests: make(chan controlRequest)}
+  go s.serve()
+  slog.Debug("control socket listening", "path", path)
+  return s, nil
+}
+
+// Path 返回控制套接字路径，记录在锁文件中供其他实例使用。
+func (s *ControlServer) Path() string {
+  return s.path
+}
+
+// Requests 返回待处理请求的 channel，由主循环读取并逐个应答。
+func (s *ControlServer) Requests() <-chan controlRequest {
+  return s.requests
+}
+
+// Close 停止接收请求并删除套接字文件。
+func (s *ControlServer) Close() {
+  if err := s.ln.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+    slog.Warn("failed to close control socket", "error", err)
+  }
+  os.Remove(s.path)
+}
+
+func (s *ControlServer) serve() {
+  for {
+    c, err := s.ln.Accept()
+    if err != nil {
+      if !errors.Is(err, net.ErrClosed) {
+        slog.Warn("control socket accept failed", "error", err)
+      }
+      return
+    }
+    go s.handle(c)
+  }
+}
+
+// handle 读取一条请求，交给主循环处理，然后写回结果。
+func (s *ControlServer) handle(c net.Conn) {
+  defer c.Close()
+  c.SetDeadline(time.Now().Add(controlReplyTimeout))
+
+  line, err := bufio.NewReader(c).ReadString('\n')
+  if err != nil {
+    slog.Debug("control request read failed", "error", err)
+    return
+  }
+  command := strings.TrimSpace(line)
+  slog.Debug("control request received", "command", command)
+
+  switch command {
+  case controlReactivate, controlTakeover, controlClose:
+  default:
+    fmt.Fprintf(c, "error unknown command %q\n", command)
+    return
+  }
+
+  req := controlRequest{Command: command, reply: make(chan error, 1), sent: make(chan struct{})}
+  select {
+  case s.requests <- req:
+  case <-time.After(controlReplyTimeout):
+    fmt.Fprintln(c, "error session is busy")
+    return
+  }
+  defer close(req.sent)
+  if err := <-req.reply; err != nil {
+    fmt.Fprintf(c, "error %v\n", err)
+    return
+  }
+  fmt.Fprintln(c, "ok")
+}
+
+// sendControl 向控制套接字 path 发送一个命令并等待应答。
+func sendControl(path string, command string) error {
+  if path == "" {
+    return errors.New("instance has no control socket")
+  }
+  if err := checkControlSocket(path); err != nil {
+    return err
+  }
+  c, err := net.DialTimeout("unix", path, controlDialTimeout)
+  if err != nil {
+    return fmt.Errorf("failed to reach instance: %w", err)
+  }
+  defer c.Close()
+  c.SetDeadline(time.Now().Add(controlDialTimeout + controlReplyTimeout))
+
+  if _, err := fmt.Fprintf(c, "%s\n", command); err != nil {
+    return fmt.Errorf("failed to send %s request: %w", command, err)
+  }
+  reply, err := bufio.NewReader(c).ReadString('\n')
+  if err != nil {
+    return fmt.Errorf("no reply to %s request: %w", command, err)
+  }
+  reply = strings.TrimSpace(reply)
+  if reply != "ok" {
+    return fmt.Errorf("%s request rejected: %s", command, strings.TrimPrefix(reply, "error "))
+  }
+  return nil
+}
+
+// checkControlSocket 确认 path 是当前用户的私有控制目录中、属于当前用户的套接字。
+// 共享锁目录中的锁文件所有用户都可以改写，其中的 control 字段不可信，不能直接连接它指向的路径。
+func checkControlSocket(path string) error {
+  dir := filepath.Dir(filepath.Clean(path))
+  trusted := false
+  for _, candidate := range defaultLockDirs() {
+    if !candidate.Shared && filepath.Join(candidate.Path, "control") == dir {
+      trusted = true
+      break
+    }
+  }
+  if !trusted {
+    return fmt.Errorf("control socket %s is outside the private control directory", path)
+  }
+  if err := ensurePrivateDir(dir); err != nil {
+    return fmt.Errorf("untrusted control directory: %w", err)
+  }
+  st, err := os.Lstat(path)
+  if err != nil {
+    return fmt.Errorf("failed to reach instance: %w", err)
+  }
+  if !controlSocketOwned(st) {
+    return fmt.Errorf("%s is not a control socket of the current user", path)
+  }
+  return nil
+}
+
+// removeStaleControlSockets 删除崩溃的实例留下的套接字文件 (文件名中的 PID 已不存在)。
+func removeStaleControlSockets(dir string) {
+  entries, err := os.ReadDir(dir)
+  if err != nil {
+    return
+  }
+  for _, entry := range entries {
+    name := strings.TrimSuffix(entry.Name(), ".sock")
+    i := strings.LastIndex(name, "-")
+    if i < 0 || name == entry.Name() {
+      continue
+    }
+    if pid, err := strconv.Atoi(name[i+1:]); err == nil && !processAlive(pid) {
+      slog.Debug("removing stale control socket", "path", entry.Name())
+      os.Remove(filepath.Join(dir, entry.Name()))
+    }
+  }
+}
+
+// closeRunningInstance 实现 --close：请求正在编辑 filePath 的实例断开编辑器并退出，返回进程退出码。
+func closeRunningInstance(filePath string, loc lockLocation) int {
+  id, err := fileIdentity(filePath)
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "gomate: %v\n", err)
+    return 1
+  }
+
+  owner, err := readLockOwner(loc.LockPath(id))
+  if err != nil || owner.Status() != OwnerAlive {
+    fmt.Fprintf(os.Stderr, "gomate: %s is not open\n", filePath)
+    return 0
+  }
+  if !owner.Local() {
+    fmt.Fprintf(os.Stderr, "gomate: %s is opened by %s on another host\n", filePath, owner)
+    return 1
+  }
+  if err := sendControl(owner.Control, controlClose); err != nil {
+    fmt.Fprintf(os.Stderr, "gomate: failed to close %s opened by %s: %v\n", filePath, owner, err)
+    return 1
+  }
+  fmt.Fprintf(os.Stderr, "gomate: closed %s opened by %s\n", filePath, owner)
+  return 0
+}
@@ -0,0 +1,73 @@
+//go:build unix
+
+package main
+
+import (
+  "net"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+func TestSendControlOnlyDialsPrivateSockets(t *testing.T) {
+  runtimeDir := filepath.Join(t.TempDir(), "run")
+  if err := os.Mkdir(runtimeDir, 0700); err != nil {
+    t.Fatal(err)
+  }
+  t.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+
+  server, err := startControlServer("0123456789abcdef")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer server.Close()
+  done := make(chan struct{})
+  defer close(done)
+  go func() {
+    for {
+      select {
+      case req := <-server.Requests():
+        req.Reply(nil)
+      case <-done:
+        return
+      }
+    }
+  }()
+  if err := sendControl(server.Path(), controlReactivate); err != nil {
+    t.Fatalf("sendControl(own socket) = %v", err)
+  }
+
+  // 共享锁目录中的锁文件可以被其他用户改写，control 字段可能指向任意套接字
+  foreign := filepath.Join(t.TempDir(), "foreign.sock")
+  ln, err := net.Listen("unix", foreign)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer ln.Close()
+  dialed := make(chan struct{}, 1)
+  go func() {
+    if c, err := ln.Accept(); err == nil {
+      dialed <- struct{}{}
+      c.Close()
+    }
+  }()
+  controlDir := filepath.Dir(server.Path())
+  fake := filepath.Join(controlDir, "fake.sock")
+  if err := os.WriteFile(fake, nil, 0600); err != nil {
+    t.Fatal(err)
+  }
+  for _, path := range []string{
+    foreign,
+    controlDir + "/../stray.sock",
+    fake,
+  } {
+    if err := sendControl(path, controlTakeover); err == nil {
+      t.Errorf("sendControl(%s) succeeded", path)
+    }
+  }
+  select {
+  case <-dialed:
+    t.Error("sendControl connected to a socket outside the private control directory")
+  default:
+  }
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "io"
+  "log/slog"
+  "os"
+  "os/exec"
+  "os/signal"
+  "sync"
+)
+
+// detachEnv 标记由 runDetached 启动的后台进程，避免它再次进入后台
+const detachEnv = "GOMATE_DETACHED"
+
+// detachReadyMarker 由后台进程写到标准错误，表示文件已经在编辑器中打开，前台进程可以退出
+var detachReadyMarker = []byte("\x00gomate-detached\n")
+
+// isDetachedChild 报告当前进程是否是 runDetached 启动的后台进程。
+func isDetachedChild() bool {
+  return os.Getenv(detachEnv) != ""
+}
+
+// runDetached 在新的会话 (Windows 上为隐藏窗口) 中重新启动 gomate，并转发它的输出，
+// 直到它与编辑器握手并打开文件后脱离终端。这期间的错误和确认提示仍然显示在终端上。
+// 返回前台进程的退出码：后台进程就绪时为 0，否则为后台进程的退出码。
+func runDetached() int {
+  exe, err := os.Executable()
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "gomate: cannot detach: %v\n", err)
+    return 1
+  }
+  stdoutR, stdoutW, err := os.Pipe()
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "gomate: cannot detach: %v\n", err)
+    return 1
+  }
+  stderrR, stderrW, err := os.Pipe()
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "gomate: cannot detach: %v\n", err)
+    return 1
+  }
+
+  cmd := exec.Command(exe, os.Args[1:]...)
+  cmd.Env = append(os.Environ(), detachEnv+"=1")
+  // 标准输入用于 -force 时的确认提示
+  cmd.Stdin = os.Stdin
+  cmd.Stdout = stdoutW
+  cmd.Stderr = stderrW
+  cmd.SysProcAttr = detachSysProcAttr()
+  if err := cmd.Start(); err != nil {
+    fmt.Fprintf(os.Stderr, "gomate: cannot detach: %v\n", err)
+    return 1
+  }
+  stdoutW.Close()
+  stderrW.Close()
+  slog.Debug("started background process", "pid", cmd.Process.Pid)
+
+  // 后台进程在新的会话中收不到终端的中断信号，由前台进程转发
+  signals := make(chan os.Signal, 1)
+  signal.Notify(signals, shutdownSignals...)
+  go func() {
+    for sig := range signals {
+      // Windows 不支持向其他进程发送信号
+      if err := cmd.Process.Signal(sig); err != nil {
+        cmd.Process.Kill()
+      }
+    }
+  }()
+
+  var wg sync.WaitGroup
+  wg.Add(1)
+  go func() {
+    defer wg.Done()
+    io.Copy(os.Stdout, stdoutR)
+  }()
+  stderr := &readyWriter{out: os.Stderr}
+  io.Copy(stderr, stderrR)
+  stderr.Flush()
+  wg.Wait()
+
+  if stderr.ready {
+    // 后台进程已经打开文件并关闭了输出，不等待它结束
+    cmd.Process.Release()
+    return 0
+  }
+  err = cmd.Wait()
+  if exitErr, ok := err.(*exec.ExitError); ok {
+    return exitErr.ExitCode()
+  }
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "gomate: background process failed: %v\n", err)
+    return 1
+  }
+  return 0
+}
+
+// readyWriter 转发后台进程的标准错误，并从中找出 detachReadyMarker。
+type readyWriter struct {
+  out     io.Writer
+  pending []byte // 可能是标记开头的尾部数据，等待后续数据确认
+  ready   bool
+}
+
+func (w *readyWriter) Write(p []byte) (int, error) {
+  if w.ready {
+    return len(p), nil
+  }
+  data := append(w.pending, p...)
+  if i := bytes.Index(data, detachReadyMarker); i >= 0 {
+    w.out.Write(data[:i])
+    w.pending = nil
+    w.ready = true
+    return len(p), nil
+  }
+  // 只保留与标记开头相同的尾部，其余数据 (包括不以换行结尾的确认提示) 立即输出
+  keep := 0
+  for k := len(detachReadyMarker) - 1; k > 0; k-- {
+    if bytes.HasSuffix(data, detachReadyMarker[:k]) {
+      keep = k
+      break
+    }
+  }
+  w.out.Write(data[:len(data)-keep])
+  w.pending = append([]byte(nil), data[len(data)-keep:]...)
+  return len(p), nil
+}
+
+// Flush 输出保留的尾部数据。
+func (w *readyWriter) Flush() {
+  if !w.ready && len(w.pending) > 0 {
+    w.out.Write(w.pending)
+  }
+  w.pending = nil
+}
+
+// detachFromTerminal 在后台进程打开文件后调用：通知前台进程退出，并把标准输入输出重定向到空设备。
+// 之后的提示不再可见，日志只写入日志文件。不是后台进程时什么也不做。
+func detachFromTerminal() {
+  if !isDetachedChild() {
+    return
+  }
+  null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+  if err != nil {
+    slog.Warn("failed to open null device", "path", os.DevNull, "error", err)
+    return
+  }
+  slog.Debug("detached from terminal", "pid", os.Getpid())
+  os.Stderr.Write(detachReadyMarker)
+  detachLogging()
+  if err := redirectStdio(null); err != nil {
+    slog.Warn("failed to redirect standard streams", "error", err)
+  }
+  os.Stdin, os.Stdout, os.Stderr = null, null, null
+}
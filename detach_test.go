@@ -0,0 +1,95 @@
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "net"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestReadyWriter(t *testing.T) {
+  marker := string(detachReadyMarker)
+  tests := []struct {
+    name   string
+    writes []string
+    want   string
+    ready  bool
+  }{
+    {"no marker", []string{"connecting\n", "Take over? [y/N] "}, "connecting\nTake over? [y/N] ", false},
+    {"marker", []string{"opened\n" + marker + "after detaching\n"}, "opened\n", true},
+    {"marker split across writes", []string{"opened\n" + marker[:3], marker[3:], "ignored"}, "opened\n", true},
+    {"marker split byte by byte", strings.Split("x"+marker, ""), "x", true},
+    // 与标记开头相同、但最终不是标记的数据照常输出
+    {"false start", []string{"a" + marker[:4], "b\n"}, "a" + marker[:4] + "b\n", false},
+    {"dangling prefix", []string{"exit\n" + marker[:2]}, "exit\n" + marker[:2], false},
+  }
+  for _, tt := range tests {
+    var out bytes.Buffer
+    w := &readyWriter{out: &out}
+    for _, p := range tt.writes {
+      if n, err := w.Write([]byte(p)); n != len(p) || err != nil {
+        t.Fatalf("%s: Write = %d, %v", tt.name, n, err)
+      }
+    }
+    w.Flush()
+    if out.String() != tt.want || w.ready != tt.ready {
+      t.Errorf("%s: forwarded %q (ready %v), want %q (ready %v)", tt.name, out.String(), w.ready, tt.want, tt.ready)
+    }
+  }
+}
+
+func TestDetachedChildFailsBeforeReady(t *testing.T) {
+  env := gomateEnv(t)
+  file := filepath.Join(t.TempDir(), "notes.txt")
+  // 没有 -w：连接编辑器失败发生在后台进程中，错误和退出码经由前台进程报告
+  code, stderr := runGomate(t, env, "-no-discover", "-h", "127.0.0.1", "-p", fmt.Sprint(unusedPort(t)), file)
+  if code != exitError {
+    t.Errorf("exit %d, want %d", code, exitError)
+  }
+  if !strings.Contains(stderr, "gomate:") || strings.Contains(stderr, string(detachReadyMarker)) {
+    t.Errorf("stderr does not carry the background error:\n%q", stderr)
+  }
+}
+
+func TestDetachAfterOpen(t *testing.T) {
+  env := gomateEnv(t)
+  file := filepath.Join(t.TempDir(), "notes.txt")
+  if err := os.WriteFile(file, []byte("original\n"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  editor := &capsEditor{reply: []byte("saved in the background\n")}
+  addr, done := startCapsEditor(t, editor)
+  host, port, _ := net.SplitHostPort(addr)
+
+  // 文件打开后前台进程立即以 0 退出，后台进程继续处理保存和关闭
+  code, stderr := runGomate(t, env, "-no-discover", "-h", host, "-p", port, file)
+  if code != exitSaved {
+    t.Fatalf("exit %d, want %d; stderr:\n%s", code, exitSaved, stderr)
+  }
+  if strings.Contains(stderr, string(detachReadyMarker)) {
+    t.Errorf("ready marker leaked to the terminal: %q", stderr)
+  }
+  <-done
+  if editor.err != nil {
+    t.Fatal(editor.err)
+  }
+  if got, _ := os.ReadFile(file); string(got) != string(editor.reply) {
+    t.Errorf("file = %q, want the save made after detaching", got)
+  }
+
+  // 等后台进程释放锁并退出，临时目录才能删除
+  locks := envValue(env, "GOMATE_LOCK_DIR")
+  for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+    entries, _ := os.ReadDir(locks)
+    if len(entries) == 0 {
+      break
+    }
+    if time.Now().After(deadline) {
+      t.Fatalf("background process still holds %d lock files", len(entries))
+    }
+  }
+}
@@ -0,0 +1,25 @@
+//go:build unix
+
+package main
+
+import (
+  "os"
+  "syscall"
+
+  "golang.org/x/sys/unix"
+)
+
+// detachSysProcAttr 让后台进程在新的会话中运行，关闭终端时不会收到 SIGHUP。
+func detachSysProcAttr() *syscall.SysProcAttr {
+  return &syscall.SysProcAttr{Setsid: true}
+}
+
+// redirectStdio 把文件描述符 0、1、2 指向 null，同时关闭与前台进程相连的管道。
+func redirectStdio(null *os.File) error {
+  for _, fd := range []int{0, 1, 2} {
+    if err := unix.Dup2(int(null.Fd()), fd); err != nil {
+      return err
+    }
+  }
+  return nil
+}
@@ -0,0 +1,41 @@
+//go:build windows
+
+package main
+
+import (
+  "os"
+  "syscall"
+
+  "golang.org/x/sys/windows"
+)
+
+// createNoWindow 是 CreateProcess 的 CREATE_NO_WINDOW 标志
+const createNoWindow = 0x08000000
+
+// detachSysProcAttr 让后台进程在隐藏的控制台中运行，并且不属于前台的进程组，
+// 关闭命令行窗口或按 Ctrl+C 时不会结束它。
+func detachSysProcAttr() *syscall.SysProcAttr {
+  return &syscall.SysProcAttr{
+    HideWindow:    true,
+    CreationFlags: createNoWindow | syscall.CREATE_NEW_PROCESS_GROUP,
+  }
+}
+
+// redirectStdio 把标准句柄指向 null，并关闭与前台进程相连的管道。
+func redirectStdio(null *os.File) error {
+  handles := []struct {
+    id   uint32
+    file *os.File
+  }{
+    {windows.STD_INPUT_HANDLE, os.Stdin},
+    {windows.STD_OUTPUT_HANDLE, os.Stdout},
+    {windows.STD_ERROR_HANDLE, os.Stderr},
+  }
+  for _, h := range handles {
+    if err := windows.SetStdHandle(h.id, windows.Handle(null.Fd())); err != nil {
+      return err
+    }
+    h.file.Close()
+  }
+  return nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+  "bufio"
+  "crypto/sha256"
+  "errors"
+  "fmt"
+  "io"
+  "log/slog"
+  "net"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "time"
+)
+
+const (
+  // discoverDialTimeout 是探测单个候选地址时的连接超时
+  discoverDialTimeout = time.Second
+  // discoverGreetingTimeout 是等待编辑器握手行的超时
+  discoverGreetingTimeout = 2 * time.Second
+  // discoverCacheMaxAge 之前写入的缓存文件会在下次写入时被清理
+  discoverCacheMaxAge = 7 * 24 * time.Hour
+)
+
+// ErrNoEditorFound 表示所有候选地址都没有可用的 rmate 编辑器。
+var ErrNoEditorFound = errors.New("no editor found")
+
+// editorEndpoint 是一个候选的编辑器地址。
+type editorEndpoint struct {
+  Host string
+  Port int
+}
+
+func (e editorEndpoint) String() string {
+  return net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+}
+
+// sshClientAddress 从 SSH_CONNECTION 或 SSH_CLIENT 中取出发起 SSH 会话的客户端地址。
+// 两者的第一个字段都是客户端 IP。
+func sshClientAddress() string {
+  for _, name := range []string{"SSH_CONNECTION", "SSH_CLIENT"} {
+    if fields := strings.Fields(os.Getenv(name)); len(fields) > 0 {
+      return fields[0]
+    }
+  }
+  return ""
+}
+
+// discoveryCandidates 按探测顺序列出候选地址：缓存的结果、本机回环 (用于 ssh -R 隧道)、SSH 客户端地址。
+func discoveryCandidates(ports []int, cached *editorEndpoint) []editorEndpoint {
+  var list []editorEndpoint
+  seen := make(map[editorEndpoint]bool)
+  add := func(e editorEndpoint) {
+    if !seen[e] {
+      seen[e] = true
+      list = append(list, e)
+    }
+  }
+
+  if cached != nil {
+    add(*cached)
+  }
+  for _, p := range ports {
+    add(editorEndpoint{Host: "localhost", Port: p})
+  }
+  if client := sshClientAddress(); client != "" {
+    for _, p := range ports {
+      add(editorEndpoint{Host: client, Port: p})
+    }
+  }
+  return list
+}
+
+// dialCandidate 连接候选地址。与直接指定地址时一样遵循 --proxy 和代理环境变量，
+// 在只能经由代理访问编辑器的网络中，自动发现也能找到它。
+func dialCandidate(flagProxy string, e editorEndpoint) (net.Conn, error) {
+  proxy, err := resolveProxy(flagProxy, e.Host, e.Port)
+  if err != nil {
+    return nil, err
+  }
+  if proxy != nil {
+    slog.Debug("probing editor endpoint through proxy", "endpoint", e, "proxy", proxy.Redacted())
+    return dialProxy(proxy, e.Host, e.Port)
+  }
+  return net.DialTimeout("tcp", e.String(), discoverDialTimeout)
+}
+
+// probeEditor 经 dial 连接候选地址，并通过读取 rmate 握手行确认对端确实是编辑器。
+// 成功时返回的连接会重放已读取的握手行，调用方可以像新连接一样使用它。
+func probeEditor(e editorEndpoint, dial func(editorEndpoint) (net.Conn, error)) (net.Conn, string, error) {
+  conn, err := dial(e)
+  if err != nil {
+    return nil, "", err
+  }
+
+  if err := conn.SetReadDeadline(time.Now().Add(discoverGreetingTimeout)); err != nil {
+    conn.Close()
+    return nil, "", err
+  }
+  br := bufio.NewReader(conn)
+  greeting, err := readProtocolLine(br)
+  if err != nil {
+    conn.Close()
+    return nil, "", fmt.Errorf("no rmate greeting: %w", err)
+  }
+  if strings.TrimSpace(greeting) == "" {
+    conn.Close()
+    return nil, "", errors.New("empty rmate greeting")
+  }
+  if err := conn.SetReadDeadline(time.Time{}); err != nil {
+    conn.Close()
+    return nil, "", err
+  }
+
+  replay := &bufferedConn{Conn: conn, r: io.MultiReader(strings.NewReader(greeting+"\n"), br)}
+  return replay, strings.TrimSpace(greeting), nil
+}
+
+// discoverEditor 依次探测候选地址，返回第一个通过 rmate 握手验证的连接。
+// 在 SSH 会话中，成功的地址会按会话缓存，下次优先尝试。flagProxy 是 --proxy 参数的值。
+func discoverEditor(ports []int, flagProxy string) (net.Conn, editorEndpoint, error) {
+  dial := func(e editorEndpoint) (net.Conn, error) {
+    return dialCandidate(flagProxy, e)
+  }
+
+  cachePath := discoveryCachePath()
+  cached := readDiscoveryCache(cachePath)
+  if cached != nil {
+    slog.Debug("cached editor endpoint for this SSH session", "endpoint", cached)
+  }
+
+  for _, e := range discoveryCandidates(ports, cached) {
+    slog.Debug("probing editor endpoint", "endpoint", e)
+    conn, greeting, err := probeEditor(e, dial)
+    if err != nil {
+      slog.Debug("editor endpoint rejected", "endpoint", e, "error", err)
+      continue
+    }
+    slog.Debug("discovered editor", "endpoint", e, "greeting", greeting)
+    if cached == nil || *cached != e {
+      writeDiscoveryCache(cachePath, e)
+    }
+    return conn, e, nil
+  }
+
+  if cached != nil {
+    // 缓存的地址已经失效，删除以免下次浪费时间
+    os.Remove(cachePath)
+  }
+  return nil, editorEndpoint{}, ErrNoEditorFound
+}
+
+// discoveryCachePath 返回当前 SSH 会话的缓存文件路径，不在 SSH 会话中时返回空字符串。
+func discoveryCachePath() string {
+  session := os.Getenv("SSH_CONNECTION")
+  if session == "" {
+    session = os.Getenv("SSH_CLIENT")
+  }
+  if session == "" {
+    return ""
+  }
+  dir, err := os.UserCacheDir()
+  if err != nil {
+    return ""
+  }
+  sum := sha256.Sum256([]byte(session))
+  return filepath.Join(dir, "gomate", fmt.Sprintf("endpoint-%x", sum[:8]))
+}
+
+// readDiscoveryCache 读取缓存的编辑器地址，文件不存在或内容无效时返回 nil。
+func readDiscoveryCache(path string) *editorEndpoint {
+  if path == "" {
+    return nil
+  }
+  content, err := os.ReadFile(path)
+  if err != nil {
+    return nil
+  }
+  host, portStr, err := net.SplitHostPort(strings.TrimSpace(string(content)))
+  if err != nil {
+    return nil
+  }
+  port, err := strconv.Atoi(portStr)
+  if err != nil {
+    return nil
+  }
+  return &editorEndpoint{Host: host, Port: port}
+}
+
+// writeDiscoveryCache 写入缓存，并顺带清理过期会话留下的缓存文件。
+func writeDiscoveryCache(path string, e editorEndpoint) {
+  if path == "" {
+    return
+  }
+  dir := filepath.Dir(path)
+  if err := os.MkdirAll(dir, 0700); err != nil {
+    slog.Warn("failed to create cache directory", "dir", dir, "error", err)
+    return
+  }
+  if err := os.WriteFile(path, []byte(e.String()+"\n"), 0600); err != nil {
+    slog.Warn("failed to write endpoint cache", "path", path, "error", err)
+    return
+  }
+
+  entries, err := os.ReadDir(dir)
+  if err != nil {
+    return
+  }
+  for _, entry := range entries {
+    if !strings.HasPrefix(entry.Name(), "endpoint-") {
+      continue
+    }
+    if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > discoverCacheMaxAge {
+      os.Remove(filepath.Join(dir, entry.Name()))
+    }
+  }
+}
+
+// parsePortList 解析逗号分隔的端口列表。
+func parsePortList(s string) ([]int, error) {
+  var ports []int
+  for _, field := range strings.Split(s, ",") {
+    field = strings.TrimSpace(field)
+    if field == "" {
+      continue
+    }
+    p, err := strconv.Atoi(field)
+    if err != nil || p <= 0 || p > 65535 {
+      return nil, fmt.Errorf("invalid port %q", field)
+    }
+    ports = append(ports, p)
+  }
+  return ports, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+  "bufio"
+  "io"
+  "net"
+  "net/http"
+  "strconv"
+  "strings"
+  "sync"
+  "testing"
+)
+
+// testConnectProxy 是一个 HTTP CONNECT 代理，把所有隧道都连到 upstream，并记录请求的目标。
+type testConnectProxy struct {
+  Addr     string
+  upstream string
+
+  mu      sync.Mutex
+  targets []string
+}
+
+func startTestConnectProxy(t *testing.T, upstream string) *testConnectProxy {
+  t.Helper()
+  ln, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() { ln.Close() })
+  p := &testConnectProxy{Addr: ln.Addr().String(), upstream: upstream}
+  go func() {
+    for {
+      c, err := ln.Accept()
+      if err != nil {
+        return
+      }
+      go p.serve(c)
+    }
+  }()
+  return p
+}
+
+func (p *testConnectProxy) serve(c net.Conn) {
+  defer c.Close()
+  br := bufio.NewReader(c)
+  req, err := http.ReadRequest(br)
+  if err != nil || req.Method != http.MethodConnect {
+    return
+  }
+  p.mu.Lock()
+  p.targets = append(p.targets, req.Host)
+  p.mu.Unlock()
+
+  up, err := net.Dial("tcp", p.upstream)
+  if err != nil {
+    io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+    return
+  }
+  defer up.Close()
+  io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+  go io.Copy(up, br)
+  io.Copy(c, up)
+}
+
+func (p *testConnectProxy) Targets() []string {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  return append([]string(nil), p.targets...)
+}
+
+// startGreetingServer 模拟 rmate 编辑器：连接建立后发送握手行。
+func startGreetingServer(t *testing.T, greeting string) string {
+  t.Helper()
+  ln, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() { ln.Close() })
+  go func() {
+    for {
+      c, err := ln.Accept()
+      if err != nil {
+        return
+      }
+      io.WriteString(c, greeting+"\n")
+      go func() {
+        io.Copy(io.Discard, c)
+        c.Close()
+      }()
+    }
+  }()
+  return ln.Addr().String()
+}
+
+// unusedPort 返回一个当前没有监听的本机端口。
+func unusedPort(t *testing.T) int {
+  t.Helper()
+  ln, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  port := ln.Addr().(*net.TCPAddr).Port
+  ln.Close()
+  return port
+}
+
+func TestDiscoverEditorThroughProxy(t *testing.T) {
+  t.Setenv("SSH_CONNECTION", "")
+  t.Setenv("SSH_CLIENT", "")
+  t.Setenv("NO_PROXY", "")
+  t.Setenv("no_proxy", "")
+
+  // 本机的端口上没有编辑器，只有经过代理才能到达
+  editor := startGreetingServer(t, "220 Sublime Text 4 (rmate)")
+  proxy := startTestConnectProxy(t, editor)
+  port := unusedPort(t)
+
+  conn, endpoint, err := discoverEditor([]int{port}, "http://"+proxy.Addr)
+  if err != nil {
+    t.Fatalf("discoverEditor: %v", err)
+  }
+  defer conn.Close()
+
+  want := net.JoinHostPort("localhost", strconv.Itoa(port))
+  if endpoint.String() != want {
+    t.Errorf("endpoint = %s, want %s", endpoint, want)
+  }
+  if got := proxy.Targets(); len(got) != 1 || got[0] != want {
+    t.Errorf("proxy CONNECT targets = %v, want [%s]", got, want)
+  }
+  // 返回的连接重放已经读取的握手行
+  line, err := bufio.NewReader(conn).ReadString('\n')
+  if err != nil || !strings.HasPrefix(line, "220 Sublime Text 4") {
+    t.Errorf("replayed greeting = %q, %v", line, err)
+  }
+}
+
+func TestDiscoverEditorDirect(t *testing.T) {
+  t.Setenv("SSH_CONNECTION", "")
+  t.Setenv("SSH_CLIENT", "")
+  for _, name := range []string{"ALL_PROXY", "all_proxy", "HTTPS_PROXY", "https_proxy"} {
+    t.Setenv(name, "")
+  }
+
+  editor := startGreetingServer(t, "220 Sublime Text 4 (rmate)")
+  _, portStr, _ := net.SplitHostPort(editor)
+  port, _ := strconv.Atoi(portStr)
+
+  conn, endpoint, err := discoverEditor([]int{unusedPort(t), port}, "")
+  if err != nil {
+    t.Fatalf("discoverEditor: %v", err)
+  }
+  conn.Close()
+  if endpoint.Port != port {
+    t.Errorf("endpoint = %s, want port %d", endpoint, port)
+  }
+
+  if _, _, err := discoverEditor([]int{unusedPort(t)}, ""); err != ErrNoEditorFound {
+    t.Errorf("discoverEditor without an editor: err = %v, want %v", err, ErrNoEditorFound)
+  }
+}
+
+func TestDiscoveryCandidates(t *testing.T) {
+  t.Setenv("SSH_CONNECTION", "203.0.113.5 50000 198.51.100.1 22")
+  cached := &editorEndpoint{Host: "203.0.113.5", Port: 60000}
+
+  got := discoveryCandidates([]int{52698, 60000}, cached)
+  want := []string{"203.0.113.5:60000", "localhost:52698", "localhost:60000", "203.0.113.5:52698"}
+  if len(got) != len(want) {
+    t.Fatalf("candidates = %v, want %v", got, want)
+  }
+  for i := range want {
+    if got[i].String() != want[i] {
+      t.Errorf("candidate %d = %s, want %s", i, got[i], want[i])
+    }
+  }
+}
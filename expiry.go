@@ -0,0 +1,107 @@
+package main
+
+import (
+  "fmt"
+  "time"
+)
+
+// expiryWarningLead 是会话到期前发出警告的最长提前量，较短的超时按其一半提前警告
+const expiryWarningLead = time.Minute
+
+// sessionExpiry 实现 --idle-timeout 和 --max-session：到期时会话释放锁并断开编辑器，
+// 到期前先在终端上警告一次。为 nil 时表示两者都未启用。
+type sessionExpiry struct {
+  idle       time.Duration
+  maxSession time.Duration
+  start      time.Time
+  lastActive time.Time
+  warned     time.Time // 已经警告过的到期时间，避免重复警告
+  timer      *time.Timer
+}
+
+// newSessionExpiry 创建会话计时器，idle 和 maxSession 都为 0 时返回 nil。
+func newSessionExpiry(idle, maxSession time.Duration) *sessionExpiry {
+  if idle <= 0 && maxSession <= 0 {
+    return nil
+  }
+  now := time.Now()
+  e := &sessionExpiry{idle: idle, maxSession: maxSession, start: now, lastActive: now}
+  e.timer = time.NewTimer(time.Until(e.nextWake(now)))
+  return e
+}
+
+// C 返回计时器的 channel，未启用时返回 nil (select 中永远不会触发)。
+func (e *sessionExpiry) C() <-chan time.Time {
+  if e == nil {
+    return nil
+  }
+  return e.timer.C
+}
+
+// Touch 记录一次活动 (保存或重新激活)，重新开始计算空闲时间。
+func (e *sessionExpiry) Touch() {
+  if e == nil || e.idle <= 0 {
+    return
+  }
+  now := time.Now()
+  e.lastActive = now
+  e.reset(now)
+}
+
+// Check 在计时器触发时调用。进入警告期时返回 warning，到期时返回 expired，两者都是给用户看的说明。
+func (e *sessionExpiry) Check(now time.Time) (warning string, expired string) {
+  deadline, limit, reason := e.deadline()
+  if !now.Before(deadline) {
+    return "", reason
+  }
+  if !e.warned.Equal(deadline) && !now.Before(deadline.Add(-warningLead(limit))) {
+    e.warned = deadline
+    warning = fmt.Sprintf("%s in %s", reason, deadline.Sub(now).Round(time.Second))
+  }
+  e.reset(now)
+  return warning, ""
+}
+
+// deadline 返回最早的到期时间、对应的时限及其说明。
+func (e *sessionExpiry) deadline() (time.Time, time.Duration, string) {
+  var deadline time.Time
+  var limit time.Duration
+  var reason string
+  if e.idle > 0 {
+    deadline, limit, reason = e.lastActive.Add(e.idle), e.idle, fmt.Sprintf("idle timeout (%s)", e.idle)
+  }
+  if e.maxSession > 0 {
+    if end := e.start.Add(e.maxSession); deadline.IsZero() || end.Before(deadline) {
+      deadline, limit, reason = end, e.maxSession, fmt.Sprintf("maximum session length (%s)", e.maxSession)
+    }
+  }
+  return deadline, limit, reason
+}
+
+// warningLead 返回时限为 limit 时，到期前多久发出警告。
+func warningLead(limit time.Duration) time.Duration {
+  if limit/2 < expiryWarningLead {
+    return limit / 2
+  }
+  return expiryWarningLead
+}
+
+// nextWake 返回下一次需要检查的时间：警告时刻或到期时刻。
+func (e *sessionExpiry) nextWake(now time.Time) time.Time {
+  deadline, limit, _ := e.deadline()
+  if warnAt := deadline.Add(-warningLead(limit)); !e.warned.Equal(deadline) && warnAt.After(now) {
+    return warnAt
+  }
+  return deadline
+}
+
+func (e *sessionExpiry) reset(now time.Time) {
+  if !e.timer.Stop() {
+    // 计时器可能已经触发但 channel 尚未被读取
+    select {
+    case <-e.timer.C:
+    default:
+    }
+  }
+  e.timer.Reset(e.nextWake(now).Sub(now))
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+  "bytes"
+  "compress/gzip"
+  "crypto/sha256"
+  "encoding/hex"
+  "fmt"
+  "io"
+  "log/slog"
+  "os"
+  "regexp"
+  "strings"
+  "sync"
+
+  "github.com/klauspost/compress/zstd"
+)
+
+// gomate 协议扩展。经典的 rmate 协议无法报告失败的保存，也无法压缩大文件。
+// 理解扩展的服务端在握手行中以 "x-gomate-caps: zstd,gzip,ack,sha256" 提供扩展 (目前没有现成的编辑器插件，
+// extension_test.go 中的 capsEditor 是一个实现了全部扩展的参考对端)，
+// 客户端选出双方都支持的扩展，并在每个 open 命令的 x-gomate-caps 头部中告知服务端。
+// 普通的 rmate 编辑器不会提供扩展，此时协议与之前完全相同。
+const (
+  capsHeader     = "x-gomate-caps"
+  encodingHeader = "x-gomate-encoding"
+  ackCommand     = "x-gomate-ack"
+
+  capZstd   = "zstd"
+  capGzip   = "gzip"
+  capAck    = "ack"
+  capSHA256 = "sha256"
+)
+
+// supportedCaps 是客户端支持的扩展，压缩算法按优先顺序排列
+var supportedCaps = []string{capZstd, capGzip, capAck, capSHA256}
+
+// minCompressSize 是压缩 open 内容的最小字节数，更小的内容压缩得不偿失
+const minCompressSize = 4096
+
+var capsOfferRe = regexp.MustCompile(`(?i)\[?\s*` + capsHeader + `:\s*([a-z0-9,\s]*[a-z0-9])\s*\]?`)
+
+// editorWriteMu 保护对编辑器连接的写入：open (重新激活) 和保存确认来自不同的 Goroutine
+var editorWriteMu sync.Mutex
+
+// Capabilities 是与服务端协商得到的扩展，零值表示经典的 rmate 协议。
+type Capabilities struct {
+  Compression string // "zstd"、"gzip" 或空
+  Ack         bool   // 每次保存之后回复 x-gomate-ack，报告保存结果
+  Checksum    bool   // open 和 save 的内容都带有 x-gomate-sha256
+}
+
+// Enabled 报告是否协商出了任何扩展。
+func (c Capabilities) Enabled() bool {
+  return c.Compression != "" || c.Ack || c.Checksum
+}
+
+// String 返回 x-gomate-caps 头部的值。
+func (c Capabilities) String() string {
+  var caps []string
+  if c.Compression != "" {
+    caps = append(caps, c.Compression)
+  }
+  if c.Ack {
+    caps = append(caps, capAck)
+  }
+  if c.Checksum {
+    caps = append(caps, capSHA256)
+  }
+  return strings.Join(caps, ",")
+}
+
+// splitCapsOffer 从握手行中取出服务端提供的扩展，并返回去掉扩展部分的握手行。
+func splitCapsOffer(greeting string) ([]string, string) {
+  m := capsOfferRe.FindStringSubmatchIndex(greeting)
+  if m == nil {
+    return nil, greeting
+  }
+  var offer []string
+  for _, c := range strings.Split(greeting[m[2]:m[3]], ",") {
+    if c = strings.ToLower(strings.TrimSpace(c)); c != "" {
+      offer = append(offer, c)
+    }
+  }
+  rest := strings.TrimSpace(greeting[:m[0]] + greeting[m[1]:])
+  return offer, rest
+}
+
+// negotiateCaps 在服务端提供的扩展中选出客户端也支持的扩展。
+func negotiateCaps(offer []string) Capabilities {
+  offered := make(map[string]bool, len(offer))
+  for _, c := range offer {
+    offered[c] = true
+  }
+  var caps Capabilities
+  for _, c := range supportedCaps {
+    if !offered[c] {
+      continue
+    }
+    switch c {
+    case capZstd, capGzip:
+      if caps.Compression == "" {
+        caps.Compression = c
+      }
+    case capAck:
+      caps.Ack = true
+    case capSHA256:
+      caps.Checksum = true
+    }
+  }
+  return caps
+}
+
+// newCompressor 返回按 encoding 压缩并写入 w 的 Writer，关闭它才会写出最后的数据。
+func newCompressor(encoding string, w io.Writer) (io.WriteCloser, error) {
+  switch encoding {
+  case capGzip:
+    return gzip.NewWriter(w), nil
+  case capZstd:
+    return zstd.NewWriter(w)
+  }
+  return nil, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+// openPayload 是按协商的扩展处理过的 open 内容。
+type openPayload struct {
+  Body     io.Reader
+  Size     int64
+  Checksum string // 压缩前内容的 SHA-256，未协商 sha256 时为空
+  Encoding string // 压缩算法，没有压缩时为空
+  spool    *os.File
+}
+
+// Close 删除存放压缩内容的临时文件。
+func (p *openPayload) Close() {
+  if p.spool != nil {
+    p.spool.Close()
+    os.Remove(p.spool.Name())
+  }
+}
+
+// encodeOpenContent 按协商的扩展处理 open 的 size 字节内容：协商了 sha256 时计算摘要，
+// 不小于 minCompressSize 的内容压缩到临时文件中 (data: 必须是压缩后的大小，发送头部之前就要知道)。
+// 内容都以流的方式处理，不会整个读入内存；只需要摘要时读两遍 content。
+func encodeOpenContent(caps Capabilities, content io.ReadSeeker, size int64) (*openPayload, error) {
+  p := &openPayload{Body: content, Size: size}
+  digest := sha256.New()
+  if caps.Compression == "" || size < minCompressSize {
+    if caps.Checksum {
+      if _, err := io.CopyN(digest, content, size); err != nil {
+        return nil, err
+      }
+      if _, err := content.Seek(0, io.SeekStart); err != nil {
+        return nil, err
+      }
+      p.Checksum = hex.EncodeToString(digest.Sum(nil))
+    }
+    return p, nil
+  }
+
+  spool, err := os.CreateTemp("", "gomate-open-")
+  if err != nil {
+    return nil, err
+  }
+  p.spool = spool
+  zw, err := newCompressor(caps.Compression, spool)
+  if err == nil {
+    if _, err = io.CopyN(zw, io.TeeReader(content, digest), size); err == nil {
+      err = zw.Close()
+    } else {
+      zw.Close()
+    }
+  }
+  var compressed int64
+  if err == nil {
+    compressed, err = spool.Seek(0, io.SeekCurrent)
+  }
+  if err == nil {
+    _, err = spool.Seek(0, io.SeekStart)
+  }
+  if err != nil {
+    p.Close()
+    return nil, err
+  }
+  if caps.Checksum {
+    p.Checksum = hex.EncodeToString(digest.Sum(nil))
+  }
+  p.Body, p.Size, p.Encoding = spool, compressed, caps.Compression
+  return p, nil
+}
+
+// decompressTo 把 src 中按 encoding 压缩的 save 内容解压到 dst，返回解压后的字节数。
+// 解压后超过 limit 字节时返回 ErrSaveTooLarge，很小的压缩数据无法借此展开成巨大的文件。只接受已经协商的压缩算法。
+func decompressTo(dst io.Writer, src io.Reader, caps Capabilities, encoding string, limit int64) (int64, error) {
+  if encoding != caps.Compression {
+    return 0, fmt.Errorf("%w: save uses encoding %q, negotiated %q", ErrProtocol, encoding, caps.Compression)
+  }
+  var r io.Reader
+  switch encoding {
+  case capGzip:
+    gr, err := gzip.NewReader(src)
+    if err != nil {
+      return 0, fmt.Errorf("invalid gzip content: %w", err)
+    }
+    defer gr.Close()
+    r = gr
+  case capZstd:
+    zr, err := zstd.NewReader(src)
+    if err != nil {
+      return 0, fmt.Errorf("invalid zstd content: %w", err)
+    }
+    defer zr.Close()
+    r = zr
+  }
+
+  n, err := io.Copy(dst, io.LimitReader(r, limit+1))
+  if err != nil {
+    return 0, fmt.Errorf("failed to decompress %s content: %w", encoding, err)
+  }
+  if n > limit {
+    return 0, fmt.Errorf("%w (more than %d bytes after decompression)", ErrSaveTooLarge, limit)
+  }
+  slog.Debug("decompressed save", "encoding", encoding, "plain_bytes", n)
+  return n, nil
+}
+
+// sendSaveAck 在协商了 ack 时告诉服务端一次保存的结果，失败时附带错误信息：
+//
+//  x-gomate-ack
+//  token: xxx
+//  status: ok | error
+//  message: ...
+//
+func sendSaveAck(w io.Writer, caps Capabilities, token string, saveErr error) {
+  if !caps.Ack {
+    return
+  }
+  // 令牌和错误信息都经过转写，不会在头部中引入换行
+  status := "ok"
+  var ack bytes.Buffer
+  if saveErr != nil {
+    status = "error"
+  }
+  fmt.Fprintf(&ack, "%s\ntoken: %s\nstatus: %s\n", ackCommand, escapeHeaderValue(token), status)
+  if saveErr != nil {
+    fmt.Fprintf(&ack, "message: %s\n", escapeHeaderValue(saveErr.Error()))
+  }
+  ack.WriteString("\n")
+
+  editorWriteMu.Lock()
+  defer editorWriteMu.Unlock()
+  if _, err := ack.WriteTo(w); err != nil {
+    slog.Warn("failed to send save acknowledgement", "error", err)
+  }
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "compress/gzip"
+  "crypto/sha256"
+  "encoding/hex"
+  "fmt"
+  "io"
+  "net"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "testing"
+
+  "github.com/klauspost/compress/zstd"
+)
+
+// capsEditor 是实现了 gomate 协议扩展的参考对端：在握手行中提供 offer，收到 open 后按协商的扩展解码内容，
+// 再把 reply 作为 save 发回并读取 x-gomate-ack (reply 为 nil 时不保存)。ignoreCaps 为 true 时像不理解扩展头部的编辑器一样发送普通的 save；
+// badChecksum 为 true 时发送错误的 x-gomate-sha256。
+type capsEditor struct {
+  offer       string
+  ignoreCaps  bool
+  badChecksum bool
+  reply       []byte
+
+  // 以下字段在会话结束后由测试读取
+  headers map[string]string // open 命令的头部
+  opened  []byte            // 解码后的 open 内容
+  ack     map[string]string // x-gomate-ack 的头部，没有收到时为 nil
+  err     error
+}
+
+func startCapsEditor(t *testing.T, e *capsEditor) (addr string, done <-chan struct{}) {
+  t.Helper()
+  ln, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() { ln.Close() })
+  finished := make(chan struct{})
+  go func() {
+    defer close(finished)
+    c, err := ln.Accept()
+    if err != nil {
+      e.err = err
+      return
+    }
+    defer c.Close()
+    e.err = e.serve(c)
+  }()
+  return ln.Addr().String(), finished
+}
+
+func (e *capsEditor) serve(c net.Conn) error {
+  greeting := "220 capsEditor 1.0"
+  if e.offer != "" {
+    greeting += " [" + capsHeader + ": " + e.offer + "]"
+  }
+  if _, err := io.WriteString(c, greeting+"\n"); err != nil {
+    return err
+  }
+
+  br := bufio.NewReader(c)
+  if line, err := br.ReadString('\n'); err != nil || line != "open\n" {
+    return fmt.Errorf("expected open, got %q, %v", line, err)
+  }
+  e.headers = make(map[string]string)
+  for {
+    line, err := br.ReadString('\n')
+    if err != nil {
+      return err
+    }
+    name, value, _ := strings.Cut(strings.TrimSuffix(line, "\n"), ": ")
+    e.headers[name] = value
+    if name == "data" {
+      break
+    }
+  }
+  size, err := strconv.ParseInt(e.headers["data"], 10, 64)
+  if err != nil {
+    return err
+  }
+  body := make([]byte, size)
+  if _, err := io.ReadFull(br, body); err != nil {
+    return err
+  }
+  trailer := make([]byte, 3)
+  if _, err := io.ReadFull(br, trailer); err != nil || string(trailer) != "\n.\n" {
+    return fmt.Errorf("bad trailer %q, %v", trailer, err)
+  }
+  if e.opened, err = decodeTestPayload(e.headers[encodingHeader], body); err != nil {
+    return err
+  }
+  if want := e.headers[checksumHeader]; want != "" && want != testSHA256(e.opened) {
+    return fmt.Errorf("open checksum %s does not match the content", want)
+  }
+
+  // 按 open 中告知的扩展发送保存；reply 为 nil 时不保存，直接关闭文件
+  if e.reply != nil {
+    caps := negotiateCaps(strings.Split(e.headers[capsHeader], ","))
+    var save bytes.Buffer
+    fmt.Fprintf(&save, "save\ntoken: %s\n", e.headers["token"])
+    payload := e.reply
+    if !e.ignoreCaps {
+      if caps.Checksum {
+        sum := testSHA256(e.reply)
+        if e.badChecksum {
+          sum = testSHA256([]byte("something else"))
+        }
+        fmt.Fprintf(&save, "%s: %s\n", checksumHeader, sum)
+      }
+      if caps.Compression != "" {
+        var compressed bytes.Buffer
+        zw, err := newCompressor(caps.Compression, &compressed)
+        if err != nil {
+          return err
+        }
+        zw.Write(e.reply)
+        zw.Close()
+        payload = compressed.Bytes()
+        fmt.Fprintf(&save, "%s: %s\n", encodingHeader, caps.Compression)
+      }
+    }
+    fmt.Fprintf(&save, "data: %d\n", len(payload))
+    save.Write(payload)
+    save.WriteString("\n")
+    if _, err := save.WriteTo(c); err != nil {
+      return err
+    }
+
+    if caps.Ack {
+      if line, err := br.ReadString('\n'); err != nil || line != ackCommand+"\n" {
+        return fmt.Errorf("expected %s, got %q, %v", ackCommand, line, err)
+      }
+      e.ack = make(map[string]string)
+      for {
+        line, err := br.ReadString('\n')
+        if err != nil {
+          return err
+        }
+        if line == "\n" {
+          break
+        }
+        name, value, _ := strings.Cut(strings.TrimSuffix(line, "\n"), ": ")
+        e.ack[name] = value
+      }
+    }
+  }
+
+  if _, err := fmt.Fprintf(c, "close\ntoken: %s\n", e.headers["token"]); err != nil {
+    return err
+  }
+  io.Copy(io.Discard, br)
+  return nil
+}
+
+// runEditorSession 以 -w 运行 gomate 编辑 file，编辑器一侧由 editor 扮演，返回退出码和标准错误。
+func runEditorSession(t *testing.T, env []string, editor *capsEditor, file string, args ...string) (int, string) {
+  t.Helper()
+  addr, done := startCapsEditor(t, editor)
+  host, port, _ := net.SplitHostPort(addr)
+  args = append([]string{"-w", "-no-discover", "-h", host, "-p", port}, args...)
+  code, stderr := runGomate(t, env, append(args, file)...)
+  <-done
+  if editor.err != nil {
+    t.Fatalf("editor: %v\ngomate stderr:\n%s", editor.err, stderr)
+  }
+  return code, stderr
+}
+
+func decodeTestPayload(encoding string, body []byte) ([]byte, error) {
+  switch encoding {
+  case "":
+    return body, nil
+  case capGzip:
+    r, err := gzip.NewReader(bytes.NewReader(body))
+    if err != nil {
+      return nil, err
+    }
+    return io.ReadAll(r)
+  case capZstd:
+    r, err := zstd.NewReader(bytes.NewReader(body))
+    if err != nil {
+      return nil, err
+    }
+    defer r.Close()
+    return io.ReadAll(r)
+  }
+  return nil, fmt.Errorf("unexpected encoding %q", encoding)
+}
+
+func testSHA256(data []byte) string {
+  sum := sha256.Sum256(data)
+  return hex.EncodeToString(sum[:])
+}
+
+func TestCapsNegotiation(t *testing.T) {
+  tests := []struct {
+    name         string
+    offer        string
+    args         []string
+    ignoreCaps   bool
+    badChecksum  bool
+    wantCaps     string
+    wantEncoding string
+    wantCode     int
+  }{
+    {name: "all", offer: "zstd,gzip,ack,sha256", wantCaps: "zstd,ack,sha256", wantEncoding: capZstd, wantCode: exitSaved},
+    {name: "gzip", offer: "gzip", wantCaps: "gzip", wantEncoding: capGzip, wantCode: exitSaved},
+    {name: "ack", offer: "ack", wantCaps: "ack", wantCode: exitSaved},
+    {name: "sha256", offer: "sha256", wantCaps: "sha256", wantCode: exitSaved},
+    {name: "unknown extensions", offer: "brotli, ZSTD", wantCaps: "zstd", wantEncoding: capZstd, wantCode: exitSaved},
+    {name: "classic rmate", offer: "", wantCode: exitSaved},
+    {name: "no-extensions", offer: "zstd,ack", args: []string{"-no-extensions"}, wantCode: exitSaved},
+    // 编辑器提供了扩展，保存时却不带扩展头部：仍按经典协议写入
+    {name: "editor ignores caps", offer: "zstd,gzip,ack,sha256", ignoreCaps: true, wantCaps: "zstd,ack,sha256", wantEncoding: capZstd, wantCode: exitSaved},
+    {name: "checksum mismatch", offer: "gzip,ack,sha256", badChecksum: true, wantCaps: "gzip,ack,sha256", wantEncoding: capGzip, wantCode: exitNotSaved},
+  }
+  original := bytes.Repeat([]byte("original line of text\n"), 4096)
+  reply := bytes.Repeat([]byte("edited line of text\n"), 4096)
+
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      env := gomateEnv(t)
+      file := filepath.Join(t.TempDir(), "notes.txt")
+      if err := os.WriteFile(file, original, 0644); err != nil {
+        t.Fatal(err)
+      }
+      editor := &capsEditor{offer: tt.offer, ignoreCaps: tt.ignoreCaps, badChecksum: tt.badChecksum, reply: reply}
+      code, stderr := runEditorSession(t, env, editor, file, tt.args...)
+      if code != tt.wantCode {
+        t.Fatalf("exit %d, want %d; stderr:\n%s", code, tt.wantCode, stderr)
+      }
+
+      if got := editor.headers[capsHeader]; got != tt.wantCaps {
+        t.Errorf("open %s = %q, want %q", capsHeader, got, tt.wantCaps)
+      }
+      if got := editor.headers[encodingHeader]; got != tt.wantEncoding {
+        t.Errorf("open %s = %q, want %q", encodingHeader, got, tt.wantEncoding)
+      }
+      if strings.Contains(tt.wantCaps, capSHA256) != (editor.headers[checksumHeader] != "") {
+        t.Errorf("open %s = %q with caps %q", checksumHeader, editor.headers[checksumHeader], tt.wantCaps)
+      }
+      if !bytes.Equal(editor.opened, original) {
+        t.Errorf("editor decoded %d bytes, want the original %d bytes", len(editor.opened), len(original))
+      }
+
+      wantAck := strings.Contains(tt.wantCaps, capAck)
+      if (editor.ack != nil) != wantAck {
+        t.Errorf("ack = %v, want ack %v", editor.ack, wantAck)
+      }
+      saved, _ := os.ReadFile(file)
+      if tt.wantCode == exitSaved {
+        if !bytes.Equal(saved, reply) {
+          t.Errorf("file holds %d bytes, want the %d bytes sent by the editor", len(saved), len(reply))
+        }
+        if wantAck && editor.ack["status"] != "ok" {
+          t.Errorf("ack = %v, want status ok", editor.ack)
+        }
+      } else {
+        if !bytes.Equal(saved, original) {
+          t.Error("file overwritten by a save that failed its checksum")
+        }
+        if editor.ack["status"] != "error" || !strings.Contains(editor.ack["message"], "checksum mismatch") {
+          t.Errorf("ack = %v, want an error about the checksum", editor.ack)
+        }
+      }
+    })
+  }
+}
+
+func TestEncodeOpenContent(t *testing.T) {
+  large := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+  small := []byte("short file\n")
+  tests := []struct {
+    name         string
+    caps         Capabilities
+    content      []byte
+    wantEncoding string
+  }{
+    {name: "plain", content: large},
+    {name: "checksum only", caps: Capabilities{Checksum: true}, content: large},
+    {name: "small file stays uncompressed", caps: Capabilities{Compression: capZstd, Checksum: true}, content: small},
+    {name: "zstd", caps: Capabilities{Compression: capZstd, Checksum: true}, content: large, wantEncoding: capZstd},
+    {name: "gzip", caps: Capabilities{Compression: capGzip}, content: large, wantEncoding: capGzip},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      p, err := encodeOpenContent(tt.caps, bytes.NewReader(tt.content), int64(len(tt.content)))
+      if err != nil {
+        t.Fatal(err)
+      }
+      spool := p.spool
+      body, err := io.ReadAll(p.Body)
+      p.Close()
+      if err != nil {
+        t.Fatal(err)
+      }
+      if int64(len(body)) != p.Size {
+        t.Errorf("Size = %d, body has %d bytes", p.Size, len(body))
+      }
+      if p.Encoding != tt.wantEncoding {
+        t.Errorf("Encoding = %q, want %q", p.Encoding, tt.wantEncoding)
+      }
+      if (spool != nil) != (tt.wantEncoding != "") {
+        t.Errorf("spool = %v for encoding %q", spool, tt.wantEncoding)
+      }
+      if spool != nil {
+        if _, err := os.Stat(spool.Name()); !os.IsNotExist(err) {
+          t.Errorf("Close left the spool file behind: %v", err)
+        }
+      }
+      decoded, err := decodeTestPayload(p.Encoding, body)
+      if err != nil {
+        t.Fatal(err)
+      }
+      if !bytes.Equal(decoded, tt.content) {
+        t.Errorf("decoded %d bytes, want %d", len(decoded), len(tt.content))
+      }
+      want := ""
+      if tt.caps.Checksum {
+        want = testSHA256(tt.content)
+      }
+      if p.Checksum != want {
+        t.Errorf("Checksum = %q, want %q", p.Checksum, want)
+      }
+    })
+  }
+}
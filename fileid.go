@@ -0,0 +1,80 @@
+package main
+
+import (
+  "crypto/sha256"
+  "fmt"
+  "os"
+  "path/filepath"
+  "runtime"
+  "strings"
+)
+
+// FileID 是文件的规范身份，用于锁文件名和会话令牌注册表。
+// 身份以解析符号链接和 .. 之后的真实路径为准：sed -i、vim 的 writebackup、git checkout
+// 以及 gomate 自己的保存都会以新文件替换原文件，inode 随之改变，而路径不变。
+// 硬链接和绑定挂载使同一个文件拥有不同的真实路径，这时由设备号和 inode 识别出别名 (SameFile)。
+type FileID struct {
+  RealPath string // 解析符号链接后的绝对路径
+  // Device 和 Inode 在 Unix 上是 st_dev/st_ino，在 Windows 上是卷序列号和文件索引；
+  // 文件尚不存在时均为 0
+  Device uint64
+  Inode  uint64
+}
+
+// fileIdentity 返回 path 指向的文件的 FileID。文件不存在时，根据已存在的祖先目录确定其真实路径。
+func fileIdentity(path string) (FileID, error) {
+  abs, err := filepath.Abs(path)
+  if err != nil {
+    return FileID{}, fmt.Errorf("error getting absolute path: %w", err)
+  }
+
+  real, err := filepath.EvalSymlinks(abs)
+  if os.IsNotExist(err) {
+    // 父目录也可能尚未创建，从最近的已存在的祖先目录开始解析
+    dir, rest := filepath.Dir(abs), filepath.Base(abs)
+    for {
+      real, dirErr := filepath.EvalSymlinks(dir)
+      if dirErr == nil {
+        return FileID{RealPath: filepath.Join(real, rest)}, nil
+      }
+      parent := filepath.Dir(dir)
+      if !os.IsNotExist(dirErr) || parent == dir {
+        return FileID{}, fmt.Errorf("error resolving %s: %w", abs, dirErr)
+      }
+      dir, rest = parent, filepath.Join(filepath.Base(dir), rest)
+    }
+  }
+  if err != nil {
+    return FileID{}, fmt.Errorf("error resolving %s: %w", abs, err)
+  }
+
+  id := FileID{RealPath: real}
+  if id.Device, id.Inode, err = fileDeviceInode(real); err != nil {
+    return FileID{}, fmt.Errorf("error reading file identity of %s: %w", real, err)
+  }
+  return id, nil
+}
+
+// Key 返回用于比较的身份字符串：规范的真实路径。
+func (id FileID) Key() string {
+  if runtime.GOOS == "windows" {
+    // Windows 的文件名不区分大小写
+    return "path:" + strings.ToLower(id.RealPath)
+  }
+  return "path:" + id.RealPath
+}
+
+// Hash 返回身份的摘要，用作锁文件名。
+func (id FileID) Hash() string {
+  sum := sha256.Sum256([]byte(id.Key()))
+  return fmt.Sprintf("%x", sum[:16])
+}
+
+// SameFile 报告设备号和 inode 为 device、inode 的文件是否就是 id 所指的文件，
+// 用于识别经由硬链接或绑定挂载的另一个路径。设备号和 inode 只在同一台主机上有意义。
+func (id FileID) SameFile(device, inode uint64) bool {
+  if id.Device == 0 && id.Inode == 0 {
+    return false
+  }
+  return id.Device == device && id.Inode == inode
+}
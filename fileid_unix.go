@@ -0,0 +1,22 @@
+//go:build unix
+
+package main
+
+import (
+  "fmt"
+  "os"
+  "syscall"
+)
+
+// fileDeviceInode 返回文件所在设备号和 inode。
+func fileDeviceInode(path string) (uint64, uint64, error) {
+  st, err := os.Stat(path)
+  if err != nil {
+    return 0, 0, err
+  }
+  sys, ok := st.Sys().(*syscall.Stat_t)
+  if !ok {
+    return 0, 0, fmt.Errorf("unexpected stat type %T", st.Sys())
+  }
+  return uint64(sys.Dev), uint64(sys.Ino), nil
+}
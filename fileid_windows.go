@@ -0,0 +1,33 @@
+//go:build windows
+
+package main
+
+import (
+  "syscall"
+)
+
+// fileReadAttributes 是 FILE_READ_ATTRIBUTES 访问权限，足以读取文件信息
+const fileReadAttributes = 0x80
+
+// fileDeviceInode 返回文件所在卷的序列号和 64 位文件索引。
+// ReFS 的文件 ID 为 128 位，这里取其低 64 位，在实践中足以区分同一卷上的文件。
+func fileDeviceInode(path string) (uint64, uint64, error) {
+  p, err := syscall.UTF16PtrFromString(path)
+  if err != nil {
+    return 0, 0, err
+  }
+  // FILE_FLAG_BACKUP_SEMANTICS 使目录也可以被打开
+  h, err := syscall.CreateFile(p, fileReadAttributes,
+    syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE,
+    nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+  if err != nil {
+    return 0, 0, err
+  }
+  defer syscall.CloseHandle(h)
+
+  var info syscall.ByHandleFileInformation
+  if err := syscall.GetFileInformationByHandle(h, &info); err != nil {
+    return 0, 0, err
+  }
+  return uint64(info.VolumeSerialNumber), uint64(info.FileIndexHigh)<<32 | uint64(info.FileIndexLow), nil
+}
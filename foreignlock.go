@@ -0,0 +1,236 @@
+package main
+
+import (
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+)
+
+// 处理其他编辑器锁的方式，对应 --foreign-locks
+const (
+  foreignLocksWarn   = "warn"   // 显示警告后继续打开
+  foreignLocksRefuse = "refuse" // 拒绝打开 (-force 时降级为警告)
+  foreignLocksIgnore = "ignore" // 不检查
+)
+
+// vimSwapHeaderSize 是读取 vim 交换文件 block 0 中 PID、用户名和主机名所需的长度
+const vimSwapHeaderSize = 108
+
+// foreignLock 是 vim 或 emacs 为同一个文件留下的锁。
+type foreignLock struct {
+  Editor string     // "vim" 或 "emacs"
+  Path   string     // 交换文件或锁链接的路径
+  Owner  *LockOwner // 无法解析时为 nil
+}
+
+// Live 报告锁的持有者是否可能仍在运行。无法判断时按仍在运行处理。
+func (l foreignLock) Live() bool {
+  if l.Owner == nil {
+    return true
+  }
+  status := l.Owner.Status()
+  return status == OwnerAlive || status == OwnerUnknown
+}
+
+func (l foreignLock) String() string {
+  if l.Owner == nil {
+    return fmt.Sprintf("%s (%s)", l.Editor, l.Path)
+  }
+  return fmt.Sprintf("%s by %s (%s)", l.Editor, l.Owner, l.Path)
+}
+
+// ForeignLockError 表示 --foreign-locks refuse 时文件正在被 vim 或 emacs 编辑。
+// 它不满足 errors.Is(err, ErrInstanceAlreadyRunning)：持有文件的不是 gomate，无法请求它重新激活文件。
+type ForeignLockError struct {
+  Lock foreignLock
+}
+
+func (e *ForeignLockError) Error() string {
+  return "it is being edited in " + e.Lock.String()
+}
+
+// checkForeignLocks 查找 vim 和 emacs 为 realPath 留下的锁，根据 mode 警告或拒绝。
+func checkForeignLocks(realPath string, mode string, force bool) error {
+  if mode == foreignLocksIgnore {
+    return nil
+  }
+  for _, l := range findForeignLocks(realPath) {
+    if !l.Live() {
+      if l.Editor == "vim" {
+        // 残留的交换文件中可能有未保存的修改
+        fmt.Fprintf(os.Stderr, "gomate: warning: found stale vim swap file %s; it may contain unsaved changes\n", l.Path)
+      } else {
+        slog.Debug("ignoring stale foreign lock", "editor", l.Editor, "path", l.Path)
+      }
+      continue
+    }
+    if mode == foreignLocksRefuse && !force {
+      return &ForeignLockError{Lock: l}
+    }
+    fmt.Fprintf(os.Stderr, "gomate: warning: %s is also being edited in %s\n", realPath, l)
+  }
+  return nil
+}
+
+// findForeignLocks 返回 realPath 旁边的 vim 交换文件 (.name.swp、.swo ...)、
+// vim/neovim 交换目录中以完整路径命名的交换文件，以及 emacs 的 .#name 锁链接。
+func findForeignLocks(realPath string) []foreignLock {
+  var locks []foreignLock
+  dir, name := filepath.Split(realPath)
+
+  swapDirs := map[string]string{dir: "." + name + ".sw"}
+  if home, err := os.UserHomeDir(); err == nil {
+    // 'directory' 以 // 结尾时，交换文件以 % 代替路径分隔符的完整路径命名
+    full := strings.ReplaceAll(filepath.ToSlash(realPath), "/", "%") + ".sw"
+    swapDirs[filepath.Join(home, ".vim", "swap")] = full
+    swapDirs[filepath.Join(home, ".local", "state", "nvim", "swap")] = full
+  }
+  for swapDir, prefix := range swapDirs {
+    entries, err := os.ReadDir(swapDir)
+    if err != nil {
+      continue
+    }
+    for _, entry := range entries {
+      // vim 依次使用 .swp、.swo、.swn ... .swa
+      if n := entry.Name(); len(n) == len(prefix)+1 && strings.HasPrefix(n, prefix) {
+        path := filepath.Join(swapDir, n)
+        owner, err := readVimSwapOwner(path)
+        if err != nil {
+          slog.Debug("unreadable vim swap file", "path", path, "error", err)
+        }
+        locks = append(locks, foreignLock{Editor: "vim", Path: path, Owner: owner})
+      }
+    }
+  }
+
+  emacsPath := emacsLockPath(realPath)
+  if content, err := readEmacsLock(emacsPath); err == nil {
+    owner, err := parseEmacsLock(content)
+    if err != nil {
+      slog.Debug("unreadable emacs lock", "path", emacsPath, "error", err)
+    }
+    locks = append(locks, foreignLock{Editor: "emacs", Path: emacsPath, Owner: owner})
+  }
+  return locks
+}
+
+// readVimSwapOwner 从 vim 交换文件的 block 0 中读取 PID、用户名和主机名。
+// 这些字段在所有平台上都按小端序存储 (vim 的 long_to_char)。
+func readVimSwapOwner(path string) (*LockOwner, error) {
+  f, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+
+  header := make([]byte, vimSwapHeaderSize)
+  if _, err := f.ReadAt(header, 0); err != nil {
+    return nil, err
+  }
+  if string(header[:2]) != "b0" {
+    return nil, errors.New("not a vim swap file")
+  }
+  cString := func(b []byte) string {
+    if i := strings.IndexByte(string(b), 0); i >= 0 {
+      b = b[:i]
+    }
+    return string(b)
+  }
+  return &LockOwner{
+    PID:      int(binary.LittleEndian.Uint32(header[24:28])),
+    User:     cString(header[28:68]),
+    Hostname: cString(header[68:108]),
+  }, nil
+}
+
+// emacsLockPath 返回 emacs 为 realPath 创建的锁链接路径。
+func emacsLockPath(realPath string) string {
+  dir, name := filepath.Split(realPath)
+  return filepath.Join(dir, ".#"+name)
+}
+
+// readEmacsLock 读取 emacs 锁链接的目标；不支持符号链接时 emacs 会写入同样内容的普通文件。
+func readEmacsLock(path string) (string, error) {
+  if target, err := os.Readlink(path); err == nil {
+    return target, nil
+  }
+  content, err := os.ReadFile(path)
+  if err != nil {
+    return "", err
+  }
+  return string(content), nil
+}
+
+// parseEmacsLock 解析 user@host.pid[:boot-time] 形式的 emacs 锁内容。
+func parseEmacsLock(content string) (*LockOwner, error) {
+  content = strings.TrimSpace(content)
+  if i := strings.IndexByte(content, ':'); i >= 0 {
+    content = content[:i]
+  }
+  at := strings.IndexByte(content, '@')
+  dot := strings.LastIndexByte(content, '.')
+  if at < 0 || dot < at {
+    return nil, fmt.Errorf("invalid emacs lock %q", content)
+  }
+  pid, err := strconv.Atoi(content[dot+1:])
+  if err != nil {
+    return nil, fmt.Errorf("invalid emacs lock PID %q", content[dot+1:])
+  }
+  return &LockOwner{PID: pid, User: content[:at], Hostname: content[at+1 : dot]}, nil
+}
+
+// createEmacsLock 在 realPath 旁边创建 emacs 风格的锁链接，让 emacs 在打开同一个文件时发出警告。
+// 返回创建的链接路径；已有仍然有效的 emacs 锁时不覆盖它，返回空字符串。
+func createEmacsLock(realPath string, owner LockOwner) string {
+  path := emacsLockPath(realPath)
+  content := fmt.Sprintf("%s@%s.%d", owner.User, owner.Hostname, owner.PID)
+
+  if existing, err := readEmacsLock(path); err == nil {
+    if previous, err := parseEmacsLock(existing); err == nil && (foreignLock{Owner: previous}).Live() {
+      slog.Debug("emacs lock held by another process, not replacing it", "path", path, "owner", previous)
+      return ""
+    }
+    slog.Debug("replacing stale emacs lock", "path", path)
+    os.Remove(path)
+  }
+
+  if err := os.Symlink(content, path); err != nil {
+    // Windows 上创建符号链接通常需要特权，此时与 emacs 一样退回到普通文件
+    f, fileErr := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+    if fileErr != nil {
+      slog.Warn("failed to create emacs lock", "path", path, "error", err)
+      return ""
+    }
+    _, err = f.WriteString(content)
+    if closeErr := f.Close(); err == nil {
+      err = closeErr
+    }
+    if err != nil {
+      slog.Warn("failed to write emacs lock", "path", path, "error", err)
+      os.Remove(path)
+      return ""
+    }
+  }
+  slog.Debug("created emacs lock", "path", path, "target", content)
+  return path
+}
+
+// removeEmacsLock 删除 createEmacsLock 创建的锁链接，但不会删除其他进程之后创建的锁。
+func removeEmacsLock(path string, owner LockOwner) {
+  content, err := readEmacsLock(path)
+  if err != nil {
+    return
+  }
+  if current, err := parseEmacsLock(content); err != nil || current.PID != owner.PID || current.Hostname != owner.Hostname {
+    slog.Debug("emacs lock now belongs to someone else, leaving it", "path", path)
+    return
+  }
+  if err := os.Remove(path); err != nil {
+    slog.Warn("failed to remove emacs lock", "path", path, "error", err)
+  }
+}
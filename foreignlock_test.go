@@ -0,0 +1,48 @@
+package main
+
+import (
+  "encoding/binary"
+  "errors"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+// writeVimSwap 写入一个由 pid 持有的 vim 交换文件 (block 0 的前 108 字节)。
+func writeVimSwap(t *testing.T, path string, pid int) {
+  t.Helper()
+  header := make([]byte, vimSwapHeaderSize)
+  copy(header, "b0VIM 9.0")
+  binary.LittleEndian.PutUint32(header[24:28], uint32(pid))
+  copy(header[28:68], currentUserName())
+  host, _ := os.Hostname()
+  copy(header[68:108], host)
+  if err := os.WriteFile(path, header, 0600); err != nil {
+    t.Fatal(err)
+  }
+}
+
+func TestCheckForeignLocks(t *testing.T) {
+  dir := t.TempDir()
+  t.Setenv("HOME", t.TempDir())
+  file := filepath.Join(dir, "notes.txt")
+  swap := filepath.Join(dir, ".notes.txt.swp")
+  writeVimSwap(t, swap, os.Getpid())
+
+  err := checkForeignLocks(file, foreignLocksRefuse, false)
+  var foreignErr *ForeignLockError
+  if !errors.As(err, &foreignErr) || foreignErr.Lock.Path != swap {
+    t.Errorf("refuse: %v, want *ForeignLockError for %s", err, swap)
+  }
+  if errors.Is(err, ErrInstanceAlreadyRunning) {
+    t.Error("a vim swap file must not look like a running gomate instance")
+  }
+  for _, tt := range []struct {
+    mode  string
+    force bool
+  }{{foreignLocksRefuse, true}, {foreignLocksWarn, false}, {foreignLocksIgnore, false}} {
+    if err := checkForeignLocks(file, tt.mode, tt.force); err != nil {
+      t.Errorf("checkForeignLocks(%s, force=%v) = %v", tt.mode, tt.force, err)
+    }
+  }
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+  "bufio"
+  "fmt"
+  "io"
+  "os"
+)
+
+// frameBufferSize 是协议帧写缓冲区和读缓冲区的大小。高延迟的隧道上，
+// 每次小的写入都可能单独成为一个数据包，因此头部、内容和结尾尽量合并为少数几次写入。
+const frameBufferSize = 64 << 10
+
+// sendfileThreshold 是直接从文件发送内容的最小字节数：更大的文件由内核从文件复制到套接字
+// (Linux 上为 sendfile/splice)，更小的文件与头部合并为一次写入。
+const sendfileThreshold = 256 << 10
+
+// writeFrame 把一个协议帧写入 w：头部、恰好 size 字节的内容和结尾。
+// 文件在 stat 之后变长时只发送前 size 字节，变短时返回错误，发送的内容总是与 data: 一致。
+func writeFrame(w io.Writer, header []byte, body io.Reader, size int64, trailer string) error {
+  bw := bufio.NewWriterSize(w, frameBufferSize)
+  if _, err := bw.Write(header); err != nil {
+    return fmt.Errorf("failed to send file header: %w", err)
+  }
+
+  // 大文件：先发出头部，再让 io.CopyN 使用连接的 ReadFrom，TCP 连接上由内核完成复制
+  var dst io.Writer = bw
+  if _, isFile := body.(*os.File); isFile && size >= sendfileThreshold {
+    if _, ok := w.(io.ReaderFrom); ok {
+      if err := bw.Flush(); err != nil {
+        return fmt.Errorf("failed to send file header: %w", err)
+      }
+      dst = w
+    }
+  }
+  if _, err := io.CopyN(dst, body, size); err != nil {
+    return fmt.Errorf("failed to copy file data to connection: %w", err)
+  }
+
+  if _, err := bw.WriteString(trailer); err != nil {
+    return fmt.Errorf("failed to send end of file data: %w", err)
+  }
+  if err := bw.Flush(); err != nil {
+    return fmt.Errorf("failed to send end of file data: %w", err)
+  }
+  return nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "errors"
+  "fmt"
+  "io"
+  "log/slog"
+  "net"
+  "os"
+  "path/filepath"
+  "runtime"
+  "strings"
+  "testing"
+)
+
+// drainConn 返回一个 TCP 连接，对端读掉并丢弃收到的所有数据。
+func drainConn(tb testing.TB) net.Conn {
+  tb.Helper()
+  ln, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    tb.Fatal(err)
+  }
+  tb.Cleanup(func() { ln.Close() })
+  go func() {
+    c, err := ln.Accept()
+    if err != nil {
+      return
+    }
+    io.Copy(io.Discard, c)
+    c.Close()
+  }()
+  conn, err := net.Dial("tcp", ln.Addr().String())
+  if err != nil {
+    tb.Fatal(err)
+  }
+  tb.Cleanup(func() { conn.Close() })
+  return conn
+}
+
+// writeTestFile 写入 size 字节的文件并返回其路径。
+func writeTestFile(tb testing.TB, size int) string {
+  tb.Helper()
+  path := filepath.Join(tb.TempDir(), "data.bin")
+  if err := os.WriteFile(path, bytes.Repeat([]byte("0123456789abcdef"), size/16), 0644); err != nil {
+    tb.Fatal(err)
+  }
+  return path
+}
+
+// quietLogs 在测试期间丢弃日志，基准测试的输出不会被每次保存的记录淹没。
+func quietLogs(tb testing.TB) {
+  previous := slog.Default()
+  slog.SetDefault(slog.New(fanoutHandler(nil)))
+  tb.Cleanup(func() { slog.SetDefault(previous) })
+}
+
+// issueTestToken 为 file 签发会话令牌，测试结束时作废。
+func issueTestToken(tb testing.TB, file string) string {
+  tb.Helper()
+  id, err := fileIdentity(file)
+  if err != nil {
+    tb.Fatal(err)
+  }
+  token, err := sessionTokens.Issue(id)
+  if err != nil {
+    tb.Fatal(err)
+  }
+  tb.Cleanup(func() { sessionTokens.Expire(token) })
+  return token
+}
+
+// saveCommand 返回一条 save 命令：头部、content 和结尾的换行。
+func saveCommand(token string, content []byte, extra ...string) []byte {
+  var b bytes.Buffer
+  fmt.Fprintf(&b, "save\ntoken: %s\n", token)
+  for _, h := range extra {
+    b.WriteString(h + "\n")
+  }
+  fmt.Fprintf(&b, "data: %d\n", len(content))
+  b.Write(content)
+  b.WriteString("\n")
+  return b.Bytes()
+}
+
+func TestWriteFrame(t *testing.T) {
+  for _, size := range []int{16, sendfileThreshold} {
+    path := writeTestFile(t, size)
+    f, err := os.Open(path)
+    if err != nil {
+      t.Fatal(err)
+    }
+    defer f.Close()
+
+    client, server := net.Pipe()
+    received := make(chan []byte, 1)
+    go func() {
+      data, _ := io.ReadAll(server)
+      received <- data
+    }()
+    err = writeFrame(client, []byte("open\ndata: 16\n"), f, int64(size), "\n.\n")
+    client.Close()
+    if err != nil {
+      t.Fatalf("size %d: writeFrame: %v", size, err)
+    }
+    want, _ := os.ReadFile(path)
+    want = append(append([]byte("open\ndata: 16\n"), want...), "\n.\n"...)
+    if got := <-received; !bytes.Equal(got, want) {
+      t.Errorf("size %d: frame of %d bytes, want %d", size, len(got), len(want))
+    }
+  }
+
+  // 文件在 stat 之后变短：不能发送与 data: 不一致的内容
+  err := writeFrame(io.Discard, []byte("open\n"), strings.NewReader("short"), 10, "\n.\n")
+  if err == nil {
+    t.Error("writeFrame accepted a body shorter than its size")
+  }
+}
+
+func TestHandleSaveStreamsContent(t *testing.T) {
+  profile, err := lookupProfile("generic")
+  if err != nil {
+    t.Fatal(err)
+  }
+  file := filepath.Join(t.TempDir(), "notes.txt")
+  if err := os.WriteFile(file, []byte("old\n"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  token := issueTestToken(t, file)
+  content := bytes.Repeat([]byte("streamed line\n"), (16<<20)/14)
+  cmd := saveCommand(token, content)
+
+  var before, after runtime.MemStats
+  runtime.GC()
+  runtime.ReadMemStats(&before)
+  _, err = handleCommands(bufio.NewReader(bytes.NewReader(cmd)), io.Discard, profile, Capabilities{}, 1<<30)
+  runtime.ReadMemStats(&after)
+  if err != nil {
+    t.Fatalf("save: %v", err)
+  }
+
+  got, err := os.ReadFile(file)
+  if err != nil || !bytes.Equal(got, content) {
+    t.Fatalf("saved %d bytes, %v; want %d bytes", len(got), err, len(content))
+  }
+  // 保存的内容直接流入临时文件，不会整个留在内存中
+  if allocated := after.TotalAlloc - before.TotalAlloc; allocated > uint64(len(content))/4 {
+    t.Errorf("save of %d bytes allocated %d bytes", len(content), allocated)
+  }
+}
+
+func TestHandleSaveKeepsRecoveryWhenTargetUnwritable(t *testing.T) {
+  // 恢复目录必须只有当前用户可以访问，由 recoveryDir 以 0700 权限创建
+  recoveries := filepath.Join(t.TempDir(), "recovery")
+  t.Setenv("GOMATE_RECOVERY_DIR", recoveries)
+  profile, err := lookupProfile("generic")
+  if err != nil {
+    t.Fatal(err)
+  }
+  dir := filepath.Join(t.TempDir(), "project")
+  if err := os.Mkdir(dir, 0755); err != nil {
+    t.Fatal(err)
+  }
+  file := filepath.Join(dir, "notes.txt")
+  token := issueTestToken(t, file)
+  // 打开之后目录被一个普通文件替换，目标目录中无法创建临时文件
+  if err := os.Remove(dir); err != nil {
+    t.Fatal(err)
+  }
+  if err := os.WriteFile(dir, nil, 0644); err != nil {
+    t.Fatal(err)
+  }
+
+  content := []byte("content that must not be lost\n")
+  _, err = handleCommands(bufio.NewReader(bytes.NewReader(saveCommand(token, content))), io.Discard, profile, Capabilities{}, 1<<20)
+  var saveErr *SaveError
+  if !errors.As(err, &saveErr) || saveErr.Recovery == "" {
+    t.Fatalf("save: %v, want a SaveError with a recovery file", err)
+  }
+  entry, err := readRecovery(saveErr.RecoveryDir, saveErr.Recovery)
+  if err != nil {
+    t.Fatal(err)
+  }
+  got, err := os.ReadFile(entry.DataPath(saveErr.RecoveryDir))
+  if err != nil || !bytes.Equal(got, content) || entry.Size != int64(len(content)) {
+    t.Errorf("recovery holds %q (size %d), %v; want %q", got, entry.Size, err, content)
+  }
+  // 接收内容的临时文件已被移走
+  leftovers, _ := filepath.Glob(filepath.Join(saveErr.RecoveryDir, ".incoming-*"))
+  if len(leftovers) != 0 {
+    t.Errorf("temporary files left behind: %v", leftovers)
+  }
+}
+
+func BenchmarkWriteFrameBuffered(b *testing.B) {
+  conn := drainConn(b)
+  body := bytes.Repeat([]byte("x"), 64<<10)
+  header := []byte("open\ntoken: t\ndata: 65536\n")
+  b.SetBytes(int64(len(body)))
+  b.ReportAllocs()
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    if err := writeFrame(conn, header, bytes.NewReader(body), int64(len(body)), "\n.\n"); err != nil {
+      b.Fatal(err)
+    }
+  }
+}
+
+func BenchmarkWriteFrameSendfile(b *testing.B) {
+  conn := drainConn(b)
+  const size = 1 << 20
+  f, err := os.Open(writeTestFile(b, size))
+  if err != nil {
+    b.Fatal(err)
+  }
+  defer f.Close()
+  header := []byte("open\ntoken: t\ndata: 1048576\n")
+  b.SetBytes(size)
+  b.ReportAllocs()
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    if _, err := f.Seek(0, io.SeekStart); err != nil {
+      b.Fatal(err)
+    }
+    if err := writeFrame(conn, header, f, size, "\n.\n"); err != nil {
+      b.Fatal(err)
+    }
+  }
+}
+
+func BenchmarkHandleSave(b *testing.B) {
+  quietLogs(b)
+  profile, err := lookupProfile("generic")
+  if err != nil {
+    b.Fatal(err)
+  }
+  file := writeTestFile(b, 1<<20)
+  token := issueTestToken(b, file)
+  cmd := saveCommand(token, bytes.Repeat([]byte("saved line\n"), (1<<20)/11))
+  b.SetBytes(int64(len(cmd)))
+  b.ReportAllocs()
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    if _, err := handleCommands(bufio.NewReader(bytes.NewReader(cmd)), io.Discard, profile, Capabilities{}, 1<<30); err != nil {
+      b.Fatal(err)
+    }
+  }
+}
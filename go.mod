@@ -0,0 +1,10 @@
+module github.com/WiseScripts/gomate
+
+go 1.24.0
+
+require (
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/crypto v0.48.0
+	golang.org/x/sys v0.41.0
+	golang.org/x/term v0.40.0
+)
@@ -10,97 +10,187 @@ package main
 
 import (
   "bufio"
-  "crypto/md5"
+  "bytes"
+  "crypto/sha256"
+  "encoding/hex"
   "errors"
   "flag"
   "fmt"
   "io"
-  "log"
+  "log/slog"
   "net"
   "os"
   "os/signal"
   "path/filepath"
   "strconv"
   "strings"
-  "syscall"
+  "sync"
   "time"
 )
 
 // 全局变量定义
-var hashes = make(map[string]string)
+// savedFiles 通知主循环文件已被保存 (保存以新文件替换原文件，文件身份随之改变)
+var savedFiles = make(chan string, 16)
 var ErrInstanceAlreadyRunning = errors.New("instance already running")
 
-// configureLogging 配置 log 包的输出目标。
-func configureLogging(verbose bool) {
-  if verbose {
-    // 启用 verbose，输出到标准错误流，带标准时间/日期前缀
-    log.SetOutput(os.Stderr)
-    log.SetFlags(log.LstdFlags)
-    log.Println("Verbose logging enabled.")
-  } else {
-    // 默认情况下，将日志输出丢弃到 io.Discard (黑洞)
-    log.SetOutput(io.Discard)
-  }
+// OpenOptions 是 open 命令的可选参数，对应 -m/-t/-l/-n 命令行参数。
+type OpenOptions struct {
+  DisplayName string
+  FileType    string
+  Line        int // 0 表示不发送 selection
+  NewWindow   bool
+  TemplateDir string       // 新文件的模板目录，为空时新文件以空内容打开
+  Caps        Capabilities // 与服务端协商的协议扩展
 }
 
-// sendFile 将文件内容发送给远程编辑器。
-func sendFile(conn net.Conn, filename string) error {
+// sendFile 将文件内容发送给远程编辑器，可选头部是否发送由 profile 决定。
+func sendFile(conn net.Conn, filename string, opts OpenOptions, profile *EditorProfile) error {
+  // 文件尚不存在时发送模板内容或空内容，第一次保存时才创建它
+  var content io.ReadSeeker
+  var size int64
   f, err := os.Open(filename)
-  if err != nil {
+  switch {
+  case os.IsNotExist(err):
+    // 新文件按模板预先填好内容，模板有误时仍以空文件打开
+    initial, tmplErr := renderTemplate(opts.TemplateDir, filename)
+    if tmplErr != nil {
+      fmt.Fprintf(os.Stderr, "gomate: warning: not using a template for %s: %v\n", filename, tmplErr)
+    }
+    slog.Debug("file does not exist, sending initial content", "file", filename, "bytes", len(initial))
+    content, size = bytes.NewReader(initial), int64(len(initial))
+  case err != nil:
     return fmt.Errorf("failed to open file %s: %w", filename, err)
-  }
-  defer func() {
-    if closeErr := f.Close(); closeErr != nil {
-      log.Printf("Warning: failed to close file %s: %v", filename, closeErr)
+  default:
+    defer func() {
+      if closeErr := f.Close(); closeErr != nil {
+        slog.Warn("failed to close file", "file", filename, "error", closeErr)
+      }
+    }()
+
+    st, err := f.Stat()
+    if err != nil {
+      return fmt.Errorf("failed to stat file %s: %w", filename, err)
     }
-  }()
+    content, size = f, st.Size()
+  }
 
-  st, err := f.Stat()
+  // 令牌是随机生成的，注册表记录它对应的文件身份；保存时只接受注册表中的令牌
+  id, err := fileIdentity(filename)
   if err != nil {
-    return fmt.Errorf("failed to stat file %s: %w", filename, err)
+    return err
+  }
+  hash, err := sessionTokens.Issue(id)
+  if err != nil {
+    return fmt.Errorf("failed to generate token: %w", err)
   }
 
-  // 使用 MD5 哈希作为文件的唯一令牌
-  hash := fmt.Sprintf("%x", md5.Sum([]byte(filename)))
-  hashes[hash] = filename
+  // 协商了压缩或校验和时，发送头部之前先得到压缩后的大小和摘要
+  payload, err := encodeOpenContent(opts.Caps, content, size)
+  if err != nil {
+    return fmt.Errorf("failed to prepare %s: %w", filename, err)
+  }
+  defer payload.Close()
+  if payload.Encoding != "" {
+    slog.Debug("compressed file", "file", filename, "encoding", payload.Encoding, "plain_bytes", size, "bytes", payload.Size)
+  }
+  checksum, encoding := payload.Checksum, payload.Encoding
 
   // 遵循 `remote_subl` 协议写入头部信息
-  // 改进: 使用 log.Printf 记录发送信息，但仅在 verbose 模式下可见
-  log.Printf("Sending file header for: %s", filename)
-  log.Printf("Sending header token: %s", hash)
-  log.Printf("Sending header size: %d", st.Size())
+  slog.Debug("sending file header", "file", filename)
+  logTrace("Sending header token: %s", hash)
+  logTrace("Sending header size: %d", payload.Size)
+
+  // 由文件名得到的显示名称中的换行等控制字符被转写，-name 的值在解析参数时已经检查过
+  displayName := opts.DisplayName
+  if displayName == "" {
+    displayName = escapeHeaderValue(filepath.Base(filename))
+  }
 
-  fmt.Fprintf(conn, "open\n")
+  // 先在内存中组装头部：某个值不合法时整条命令都不发送，编辑器一侧不会收到半条命令
+  var header bytes.Buffer
+  var headerErr error
+  add := func(name string, value interface{}) {
+    if headerErr == nil {
+      headerErr = writeHeader(&header, name, value)
+    }
+  }
 
-  fmt.Fprintf(conn, "token: %v\n", hash)
-  fmt.Fprintf(conn, "display-name: %v\n", filepath.Base(filename))
-  //fmt.Fprintf(conn, "real-path: %v\n", filename)
-  //fmt.Fprintf(conn, "data-on-save: yes\n")
-  //fmt.Fprintf(conn, "re-activate: yes\n")
+  header.WriteString("open\n")
+  add("token", hash)
+  add("display-name", displayName)
 
-  fmt.Fprintf(conn, "data: %v\n", st.Size())
+  // 以下头部并非所有 rmate 服务端都能正确处理，由编辑器特性表决定是否发送
+  if profile.RealPath {
+    // real-path 必须是真实的路径，无法转写，含有控制字符时不发送
+    if err := validateHeaderValue("real-path", id.RealPath); err != nil {
+      slog.Debug("not sending real-path", "error", err)
+    } else {
+      add("real-path", id.RealPath)
+    }
+  }
+  if profile.DataOnSave {
+    add("data-on-save", "yes")
+  }
+  if profile.ReActivate {
+    add("re-activate", "yes")
+  }
+  if opts.Line > 0 {
+    if profile.Selection {
+      add("selection", opts.Line)
+    } else {
+      slog.Debug("editor profile does not support selection, ignoring -line", "profile", profile.Name, "line", opts.Line)
+    }
+  }
+  if opts.FileType != "" {
+    if profile.FileType {
+      add("file-type", opts.FileType)
+    } else {
+      slog.Debug("editor profile does not support file-type, ignoring -type", "profile", profile.Name, "type", opts.FileType)
+    }
+  }
+  if opts.NewWindow {
+    if profile.NewWindow {
+      add("new", "yes")
+    } else {
+      slog.Debug("editor profile does not support new windows, ignoring -new", "profile", profile.Name)
+    }
+  }
+  // 协议扩展只发送给提供了扩展的服务端
+  if opts.Caps.Enabled() {
+    add(capsHeader, opts.Caps)
+  }
+  if checksum != "" {
+    add(checksumHeader, checksum)
+  }
+  if encoding != "" {
+    add(encodingHeader, encoding)
+  }
+  add("data", payload.Size)
 
-  // 改进: io.Copy 失败时不应使用 log.Fatal，应返回错误
-  // 在使用 log.Fatal 函数时，内部调用 os.Exit(1)
-  // os.Exit 函数通知程序退出，并且该函数之后的逻辑将不会被执行。
-  // 在调用时需要指定退出码，为 0 时，表示正常退出程序。
-  if _, err := io.Copy(conn, f); err != nil {
-    return fmt.Errorf("failed to copy file data to connection: %w", err)
+  if headerErr != nil {
+    return fmt.Errorf("refusing to send %s: %w", filename, headerErr)
   }
 
-  fmt.Fprintf(conn, "\n.\n")
-  return nil
+  // 重新激活时，处理命令的 Goroutine 可能正在发送保存确认
+  editorWriteMu.Lock()
+  defer editorWriteMu.Unlock()
+  return writeFrame(conn, header.Bytes(), payload.Body, payload.Size, "\n.\n")
 }
 
 // handleCommands 处理来自远程编辑器的命令（close, save 等）。
-func handleCommands(buf *bufio.Reader) (bool, error) {
-  // 读取并解析命令
-  b, _, err := buf.ReadLine()
+// 超过 maxSaveSize 字节的保存会被丢弃；协商了 ack 扩展时，保存的结果通过 w 回复给服务端。
+func handleCommands(buf *bufio.Reader, w io.Writer, profile *EditorProfile, caps Capabilities, maxSaveSize int64) (bool, error) {
+  // 读取并解析命令，过长的行是协议错误，不会被拆成几行解析
+  line, err := readProtocolLine(buf)
   if err != nil {
     return false, err
   }
-  cmd := strings.TrimSpace(string(b))
-  log.Printf("Received command: %s", cmd)
+  cmd := strings.TrimSpace(line)
+  if cmd == "" {
+    // 不以换行结束保存内容的编辑器 (generic 配置) 在内容后面仍会发送一个换行，它不是命令
+    return false, nil
+  }
+  slog.Debug("received command", "command", cmd)
 
   switch cmd {
   case "close":
@@ -108,266 +198,344 @@ func handleCommands(buf *bufio.Reader) (bool, error) {
     // token: xxx
     // ""
     var token string
+    headers := &headerReader{buf: buf, cmd: cmd}
     for {
-      b, _, err = buf.ReadLine()
+      line, err := headers.next()
       if err != nil {
-        return true, fmt.Errorf("failed to read save header: %w", err)
+        return true, err
       }
-      line := strings.TrimSpace(string(b))
-      //log.Printf("Received header line: %s", line)
       if strings.HasPrefix(line, "token:") {
         token = strings.TrimSpace(line[6:])
-        log.Printf("Received header token: %s.\n", token)
-        log.Printf("Exiting gracefully.\n")
+        logTrace("Received header token: %s", token)
         break
       }
     }
+
+    // 部分编辑器在 close 之后还会发送一个空行作为结束
+    if profile.CloseBlankLine {
+      for {
+        line, err := headers.next()
+        if err != nil || line == "" {
+          break
+        }
+        slog.Debug("ignoring extra close header", "header", line)
+      }
+    }
+
+    // 伪造的 close 不能结束会话
+    if _, err := sessionTokens.Lookup(token); err != nil {
+      slog.Debug("ignoring close", "token", token, "error", err)
+      return false, nil
+    }
+    sessionTokens.Expire(token)
+    slog.Debug("exiting gracefully")
     return true, nil
 
   case "save":
     // save
     // token: xxx
+    // x-gomate-sha256: xxx (可选)
+    // x-gomate-encoding: zstd (可选，需要协商)
     // data: 128
     // body
+
+    // 收到信号时主循环据此等待保存完成
+    saveInProgress.Lock()
+    defer saveInProgress.Unlock()
     var token string
+    var checksum string
+    var encoding string
     var size int64
 
-    // 循环读取 save 命令的头部信息
+    // 保存完成 (无论成功与否) 后回复确认；连接出错时不再回复
+    finish := func(err error) (bool, error) {
+      sendSaveAck(w, caps, token, err)
+      return false, err
+    }
+
+    // 循环读取 save 命令的头部信息，头部行数和每行的长度都有上限
+    headers := &headerReader{buf: buf, cmd: cmd}
     for {
-      b, _, err = buf.ReadLine()
+      line, err := headers.next()
       if err != nil {
-        return true, fmt.Errorf("failed to read save header: %w", err)
+        return true, err
       }
-      line := strings.TrimSpace(string(b))
-      log.Printf("Header line: %s", line)
+      logTrace("Header line: %s", line)
 
       if strings.HasPrefix(line, "token:") {
         token = strings.TrimSpace(line[6:])
+      } else if strings.HasPrefix(line, checksumHeader+":") {
+        checksum = strings.TrimSpace(line[len(checksumHeader)+1:])
+      } else if strings.HasPrefix(line, encodingHeader+":") {
+        encoding = strings.ToLower(strings.TrimSpace(line[len(encodingHeader)+1:]))
       } else if strings.HasPrefix(line, "data:") {
         size, err = strconv.ParseInt(strings.TrimSpace(line[5:]), 10, 64)
         if err != nil {
-          return true, fmt.Errorf("invalid data size format: %w", err)
+          return true, fmt.Errorf("%w: invalid data size format: %v", ErrProtocol, err)
         }
         break // 找到 data: 行后跳出循环，准备接收数据
       }
     }
 
-    // 创建临时文件来接收数据
-    f, err := os.CreateTemp("", "gomate-temp-")
-    if err != nil {
-      return true, fmt.Errorf("failed to create temporary file: %w", err)
+    if size < 0 {
+      return true, fmt.Errorf("%w: invalid data size %d", ErrProtocol, size)
     }
 
-    // 改进: defer 中应记录错误，并清理临时文件（虽然重命名成功会隐式删除）
-    defer func(tempFile *os.File) {
-      if closeErr := tempFile.Close(); closeErr != nil {
-        log.Printf("Warning: failed to close temporary file: %v", closeErr)
+    // 通过 token 查找原始文件
+    id, tokenErr := sessionTokens.Lookup(token)
+    filename := id.RealPath
+
+    // 未发出或已失效的令牌以及过大的保存，既不写入文件，也不保存为恢复文件；
+    // 读掉数据，保持与编辑器的协议同步
+    if tokenErr != nil || size > maxSaveSize {
+      if _, err := io.CopyN(io.Discard, buf, size); err != nil {
+        return true, fmt.Errorf("failed to copy data from editor: %w", err)
+      }
+      if profile.SaveNewline {
+        readSaveTerminator(buf)
       }
-      // 即使重命名失败，也尝试删除，防止残留
-      if removeErr := os.Remove(tempFile.Name()); removeErr != nil && !os.IsNotExist(removeErr) {
-        log.Printf("Warning: failed to remove temporary file %s: %v", tempFile.Name(), removeErr)
+      if tokenErr != nil {
+        slog.Warn("rejected save", "token", token, "bytes", size, "error", tokenErr)
+        return finish(&SaveError{Err: fmt.Errorf("rejected save for %w %s", tokenErr, token)})
       }
-    }(f)
+      return finish(&SaveError{File: filename, Err: fmt.Errorf("%w (%d > %d bytes)", ErrSaveTooLarge, size, maxSaveSize)})
+    }
 
-    // 复制数据到临时文件
-    if _, err = io.CopyN(f, buf, size); err != nil {
+    // 内容直接流入目标文件所在目录中的临时文件，内存中不保留整个保存；
+    // 写入失败时仍然读完内容，之后保存为恢复文件
+    spool, targetErr := createSpool(filename)
+    digest := sha256.New()
+    n, err := io.Copy(io.MultiWriter(spool, digest), io.LimitReader(buf, size))
+    if err == nil && n < size {
+      err = io.ErrUnexpectedEOF
+    }
+    if err != nil {
+      spool.Remove()
       return true, fmt.Errorf("failed to copy data from editor: %w", err)
     }
 
-    // 必须在重命名之前关闭文件，确保所有数据已写入磁盘
-    if err = f.Close(); err != nil {
-      log.Printf("Warning: failed to finalize temporary file close: %v", err)
-      // 仍然尝试重命名，因为文件可能已部分写入
+    // 内容不完整或被损坏时不覆盖原文件，内容保存为恢复文件供用户检查
+    var saveErr error
+    if profile.SaveNewline {
+      saveErr = readSaveTerminator(buf)
+      if saveErr != nil && !errors.Is(saveErr, errSaveFraming) {
+        spool.Remove()
+        return true, saveErr
+      }
+    }
+    if saveErr == nil {
+      saveErr = spool.err
+    }
+    sum := hex.EncodeToString(digest.Sum(nil))
+    if saveErr == nil && encoding != "" {
+      var plain *spoolFile
+      if plain, n, sum, saveErr = decompressSpool(spool, caps, encoding, maxSaveSize); saveErr == nil {
+        spool.Remove()
+        spool = plain
+      }
+    }
+    if saveErr == nil {
+      if caps.Checksum && checksum == "" {
+        slog.Warn("save has no checksum header although it was negotiated", "file", filename, "header", checksumHeader)
+      }
+      saveErr = verifyChecksum(sum, checksum)
+    }
+    if saveErr == nil {
+      saveErr = targetErr
     }
 
-    // 通过 token 查找原始文件名并重命名
-    if filename, ok := hashes[token]; ok {
-      log.Printf("Saving content to original file: %s", filename)
-
-      // os.Rename 是一个原子操作 (如果可能)
-      return false, os.Rename(f.Name(), filename)
+    if saveErr == nil {
+      slog.Debug("saving content to original file", "file", filename)
+      saveErr = commitSaveTemp(spool.f, filename)
+    }
+    if saveErr != nil {
+      // 保存失败不结束会话，编辑器之后的保存仍然会再次尝试写入
+      e := &SaveError{File: filename, Err: saveErr}
+      if e.RecoveryDir, e.Recovery, err = saveRecovery(filename, token, spool.f, saveErr); err != nil {
+        slog.Error("failed to keep unsaved content", "file", filename, "error", err)
+      }
+      spool.Remove()
+      return finish(e)
     }
 
-    // 未知的 token 错误
-    return false, errors.New("unknown token: " + token)
+    slog.Info("saved", "file", filename, "bytes", n)
+    createdDirs.MarkSaved()
+    select {
+    case savedFiles <- filename:
+    default:
+    }
+    return finish(nil)
 
   default:
     // 改进: 记录未知的命令，但保持连接
-    log.Printf("Unknown command received, ignoring: %s", cmd)
+    slog.Warn("unknown command received, ignoring it", "command", cmd)
     return false, nil
   }
 }
 
-// ensureFileExists 检查文件是否存在，如果不存在，则创建它和所有必需的父目录。
-func ensureFileExists(filePath string) error {
-  log.Printf("Ensuring file and directory structure exists for: %s", filePath)
-
-  dirPath := filepath.Dir(filePath)
-
-  // 1. 检查并创建多级父目录
-  if dirPath != "" {
-    // 0755 权限
-    if err := os.MkdirAll(dirPath, 0755); err != nil {
-      return fmt.Errorf("failed to create directories %s: %w", dirPath, err)
-    }
-    log.Printf("Successfully ensured directory: %s", dirPath)
+// writeFileAtomic 把 content 写入 filename：先写入同一目录中的临时文件，再重命名为目标文件。
+// 这样重命名不会跨越文件系统 (例如 /tmp 是 tmpfs，而文件位于 .git/COMMIT_EDITMSG)，
+// 写入失败 (磁盘已满、没有权限等) 时原文件保持不变。
+func writeFileAtomic(filename string, content io.Reader) error {
+  f, err := createSaveTemp(filename)
+  if err != nil {
+    return err
   }
+  defer removeSaveTemp(f)
 
-  // 2. 检查文件是否存在，不存在则创建空文件
-  if _, err := os.Stat(filePath); os.IsNotExist(err) {
-    file, err := os.Create(filePath)
-    if err != nil {
-      return fmt.Errorf("failed to create file %s: %w", filePath, err)
-    }
-    // 立即关闭文件
-    if closeErr := file.Close(); closeErr != nil {
-      log.Printf("Warning: failed to close newly created file %s: %v", filePath, closeErr)
-    }
-    log.Printf("Successfully created new file: %s", filePath)
-  } else if err != nil {
-    // Stat 遇到了其他错误 (如权限问题)
-    return fmt.Errorf("error checking file status %s: %w", filePath, err)
+  if _, err := io.Copy(f, content); err != nil {
+    return fmt.Errorf("failed to write temporary file: %w", err)
   }
-
-  return nil
+  return commitSaveTemp(f, filename)
 }
 
-// killProcessByPID 尝试杀死指定 PID 的进程。
-func killProcessByPID(pid int) error {
-  log.Printf("Attempting to kill process with PID: %d", pid)
-
-  // 在 Go 中，os.FindProcess 和 os.Process.Kill/Signal
-  // 跨平台兼容性更好，但在 Windows 上实现 Kill 可能需要额外的 syscall。
-
-  // 尝试查找进程
-  proc, err := os.FindProcess(pid)
+// createSaveTemp 在 filename 所在的目录中创建保存用的临时文件。新文件的父目录在这时才创建。
+func createSaveTemp(filename string) (*os.File, error) {
+  dir := filepath.Dir(filename)
+  if err := createdDirs.MkdirAll(dir); err != nil {
+    return nil, err
+  }
+  f, err := os.CreateTemp(dir, "."+filepath.Base(filename)+".gomate-")
   if err != nil {
-    // 如果找不到进程，可能进程已经死亡
-    return fmt.Errorf("failed to find process with PID %d: %w", pid, err)
+    return nil, fmt.Errorf("failed to create temporary file: %w", err)
   }
+  return f, nil
+}
 
-  // 尝试发送中断信号 (SIGINT) 或直接终止 (Kill)
-  // 在 Windows 上， os.Kill 是通过 TerminateProcess 实现的。
-  if err := proc.Kill(); err != nil {
-    // 检查是否是因为进程已不存在导致的错误
-    if errors.Is(err, os.ErrPermission) {
-      // 如果是权限错误，可能是进程已经死亡但文件锁未释放
-      log.Printf("Permission denied when killing PID %d, assuming process is stale or access denied.", pid)
-      return nil // 假设成功
-    }
-    return fmt.Errorf("failed to kill process with PID %d: %w", pid, err)
+// removeSaveTemp 关闭并删除临时文件，已经重命名为目标文件时只是关闭。
+func removeSaveTemp(f *os.File) {
+  if closeErr := f.Close(); closeErr != nil && !errors.Is(closeErr, os.ErrClosed) {
+    slog.Warn("failed to close temporary file", "error", closeErr)
+  }
+  // 即使重命名失败，也尝试删除，防止残留
+  if removeErr := os.Remove(f.Name()); removeErr != nil && !os.IsNotExist(removeErr) {
+    slog.Warn("failed to remove temporary file", "path", f.Name(), "error", removeErr)
   }
-
-  log.Printf("Successfully killed previous instance with PID: %d", pid)
-  return nil
 }
 
-// checkMultiInstance 尝试在全局目录下创建独占锁文件，如果已存在，则根据 force 参数决定是否杀死前一个进程。
-func checkMultiInstance(filePath string, force bool) (*os.File, error) { // ❗ 接收 force 参数
-  absFilePath, err := filepath.Abs(filePath)
-  if err != nil {
-    return nil, fmt.Errorf("error getting absolute path: %w", err)
+// commitSaveTemp 把写好的临时文件写入磁盘并重命名为 filename，沿用原文件的权限。
+func commitSaveTemp(f *os.File, filename string) error {
+  // 临时文件的权限为 0600，沿用原文件的权限
+  mode := os.FileMode(0644)
+  if st, err := os.Stat(filename); err == nil {
+    mode = st.Mode().Perm()
   }
-  log.Printf("File absolute path: %s", absFilePath)
-
-  // 标准化路径 (Windows 不区分大小写，但哈希计算需要统一)
-  lowCaseAbsFilePath := strings.ToLower(absFilePath)
-
-  // 1. 定义全局锁定目录 (%ProgramData%/GomateLocks)
-  const lockDirName = "GomateLocks"
-  // ALLUSERSPROFILE 对应 C:\ProgramData
-  globalLockDir := filepath.Join(os.Getenv("ALLUSERSPROFILE"), lockDirName)
-
-  // 2. 确保锁定目录存在
-  if _, err := os.Stat(globalLockDir); os.IsNotExist(err) {
-    if err := os.MkdirAll(globalLockDir, 0755); err != nil {
-      return nil, fmt.Errorf("failed to create global lock directory %s: %w", globalLockDir, err)
-    }
+  if err := f.Chmod(mode); err != nil {
+    slog.Warn("failed to set file permissions", "path", f.Name(), "error", err)
   }
 
-  // 3. 构造锁文件路径
-  lowCaseAbsFilePathHash := fmt.Sprintf("%x", md5.Sum([]byte(lowCaseAbsFilePath)))
-  lockFilePath := filepath.Join(globalLockDir, lowCaseAbsFilePathHash)
-  log.Printf("Lock file path: %s", lockFilePath)
+  // 必须在重命名之前写入磁盘并关闭文件，磁盘已满等错误可能到这时才出现
+  if err := f.Sync(); err != nil {
+    return fmt.Errorf("failed to write temporary file: %w", err)
+  }
+  if err := f.Close(); err != nil {
+    return fmt.Errorf("failed to write temporary file: %w", err)
+  }
 
-  // 4. 尝试独占创建锁文件
-  // O_CREATE | O_EXCL: 确保文件独占创建，如果已存在则返回 os.ErrExist
-  lockFile, err := os.OpenFile(lockFilePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
-  if err != nil {
-    if os.IsExist(err) {
-      // ===================================================
-      // ❗ 锁文件已存在 - 处理多实例冲突
-      // ===================================================
-      log.Printf("File already exists: %s. An instance is already running.", lockFilePath)
-
-      if force {
-        // --- 强制模式启动 ---
-
-        // 1. 读取旧进程 PID
-        content, readErr := os.ReadFile(lockFilePath)
-        if readErr != nil {
-          log.Printf("Warning: Failed to read PID from lock file %s: %v", lockFilePath, readErr)
-          // 无法读取 PID，但强制模式下仍尝试继续，删除旧锁文件
-        }
+  // os.Rename 是一个原子操作 (如果可能)
+  return os.Rename(f.Name(), filename)
+}
 
-        pid, parseErr := strconv.Atoi(strings.TrimSpace(string(content)))
-        if parseErr == nil && pid > 0 {
-          // 2. 杀死旧进程
-          if killErr := killProcessByPID(pid); killErr != nil {
-            log.Printf("Warning: Failed to kill previous process (PID: %d): %v", pid, killErr)
-            // 尽管杀死失败，但我们尝试删除锁文件，假设进程已僵尸或已死亡
-          }
-        } else if readErr == nil {
-          // 进程 ID 无效（可能锁文件内容损坏），记录并继续
-          log.Printf("Warning: Lock file content is not a valid PID: %s", strings.TrimSpace(string(content)))
-        }
+// CommandResult 用于在 Goroutine 之间传递 handleCommands 的结果。
+type CommandResult struct {
+  Exit bool
+  Err  error
+}
 
-        // 3. 删除旧锁文件 (清理僵尸锁)
-        if removeErr := os.Remove(lockFilePath); removeErr != nil {
-          // 如果删除失败，则无法继续，返回致命错误
-          return nil, fmt.Errorf("force mode failed: cannot remove stale lock file %s: %w", lockFilePath, removeErr)
-        }
-        log.Println("Stale lock file removed. Retrying to create new lock.")
+// 进程退出码。使用 -wait 时 (例如 GIT_EDITOR="gomate --wait")，调用方据此判断编辑的结果
+const (
+  exitSaved          = 0 // 编辑器关闭了文件，期间至少保存过一次
+  exitError          = 1 // 无法打开文件：锁、连接或握手失败等
+  exitUsage          = 2 // 命令行参数错误，与 flag 包相同
+  exitNotSaved       = 3 // 编辑器关闭了文件，但从未保存
+  exitConnectionLost = 4 // 编辑器关闭文件之前连接中断
+  exitReleased       = 5 // 编辑器关闭文件之前会话被接管、关闭或超时结束
+  exitAlreadyOpen    = 6 // 文件正被另一个会话编辑，没有打开：已重新激活那个会话，或 --foreign-locks refuse 时 vim/emacs 持有它
+)
 
-        // 4. 递归调用自身或重新尝试创建锁文件
-        // 最好是重新尝试创建，而不是递归调用
-        return checkMultiInstance(filePath, force)
-      } else {
-        // --- 非强制模式 ---
-        return nil, ErrInstanceAlreadyRunning
-      }
+// alreadyOpen 处理文件已被另一个 gomate 会话打开的情况：请求那个会话在编辑器中重新激活文件。
+// wait 为 true 时 (-wait) 阻塞到那个会话结束，并根据文件在此期间是否被修改返回 exitSaved 或 exitNotSaved，
+// 调用方 (例如 git) 才能在编辑结束之后继续；否则返回 exitAlreadyOpen。
+func alreadyOpen(targetFile string, loc lockLocation, err error, wait bool, exitSignal <-chan os.Signal) int {
+  reactivated := false
+  var heldErr *LockHeldError
+  if errors.As(err, &heldErr) && heldErr.Owner != nil {
+    if ctlErr := sendControl(heldErr.Owner.Control, controlReactivate); ctlErr == nil {
+      reactivated = true
     } else {
-      // 其他致命错误
-      return nil, fmt.Errorf("error creating lock file: %w", err)
+      slog.Warn("re-activation request failed", "owner", heldErr.Owner, "error", ctlErr)
     }
+  }
+  // 日志可能被关闭，直接告诉用户是谁在编辑这个文件
+  if reactivated {
+    fmt.Fprintf(os.Stderr, "gomate: %s is already open by %s; re-activated it in the editor\n", targetFile, heldErr.Owner)
   } else {
-    // ===================================================
-    // 锁文件创建成功 - 写入当前进程 ID
-    // ===================================================
-    currentPID := os.Getpid()
-    pidStr := strconv.Itoa(currentPID)
+    fmt.Fprintf(os.Stderr, "gomate: %s is already open: %v\n", targetFile, err)
+  }
+  if !wait {
+    return exitAlreadyOpen
+  }
 
-    // 写入当前 PID 到锁文件
-    if _, writeErr := lockFile.WriteString(pidStr); writeErr != nil {
-      // 如果写入失败，应关闭并清理锁文件，然后返回错误
-      lockFile.Close()
-      os.Remove(lockFilePath)
-      return nil, fmt.Errorf("failed to write PID to lock file: %w", writeErr)
-    }
+  fmt.Fprintf(os.Stderr, "gomate: waiting for %s to be closed\n", targetFile)
+  before, _ := os.Stat(targetFile)
+  sig, err := waitForRelease(targetFile, loc, exitSignal)
+  if err != nil {
+    return fail(err)
+  }
+  if sig != nil {
+    return exitCodeForSignal(sig)
+  }
+  after, _ := os.Stat(targetFile)
+  if fileChanged(before, after) {
+    return exitSaved
+  }
+  return exitNotSaved
+}
 
-    log.Printf("Created lock file successfully and wrote PID %d: %s", currentPID, lockFilePath)
-    // 锁定成功
-    return lockFile, nil
+// fileChanged 报告文件的两次 Stat 结果 (不存在时为 nil) 是否表明文件被写入过。
+func fileChanged(before, after os.FileInfo) bool {
+  if before == nil || after == nil {
+    return before != after
   }
+  return !os.SameFile(before, after) || before.Size() != after.Size() || !before.ModTime().Equal(after.ModTime())
 }
 
-// CommandResult 用于在 Goroutine 之间传递 handleCommands 的结果。
-type CommandResult struct {
-  Exit bool
-  Err  error
+// isConnectionError 报告 err 是否表示与编辑器的连接已经中断。
+func isConnectionError(err error) bool {
+  var netErr net.Error
+  return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) ||
+    errors.Is(err, os.ErrClosed) || errors.As(err, &netErr)
+}
+
+// fail 报告使会话无法继续的错误并返回 exitError。标准错误上的日志默认关闭，因此直接输出到标准错误，
+// 同时记录到日志文件中 (后台会话的标准错误已经关闭)；-v 时不再经由日志在标准错误上重复一遍。
+func fail(err error) int {
+  fmt.Fprintf(os.Stderr, "gomate: %v\n", err)
+  fileLog.Error(err.Error())
+  return exitError
+}
+
+// failUsage 报告无效的命令行参数并返回 exitUsage。
+func failUsage(err error) int {
+  fail(err)
+  return exitUsage
 }
 
 func main() {
+  // 子命令：gomate locks ... (要编辑名为 locks 的文件，请写成 ./locks)
+  if len(os.Args) > 1 && os.Args[1] == "locks" {
+    os.Exit(runLocksCommand(os.Args[2:]))
+  }
+  // 子命令：gomate recover ... 列出并恢复未能写入文件的保存
+  if len(os.Args) > 1 && os.Args[1] == "recover" {
+    os.Exit(runRecoverCommand(os.Args[2:]))
+  }
+  // 返回之后才退出，使 run 中的 defer (释放锁、断开连接) 都能执行
+  os.Exit(run())
+}
+
+// run 打开命令行上的文件并等待编辑器关闭它，返回进程退出码。
+func run() int {
   // --- 1. 参数定义和解析 ---
   const Defaulthost = "localhost"
   const DefaultPort = 52698
@@ -376,16 +544,36 @@ func main() {
   var wait bool
   var verbose bool
   var force bool
+  var assumeYes bool
+  var closeOnly bool
+  var foreignLocks string
+  var emacsLock bool
+  var lockBeside bool
+  var sharedLockDir string
+  var idleTimeout time.Duration
+  var maxSession time.Duration
+  var templateDir string
+  var noTemplate bool
+  var maxSaveSizeText string
 
   var host string
   var port int
+  var via string
+  var proxy string
+  var sshOpts SSHOptions
+  var discoverPorts string
+  var noDiscover bool
 
   var fileName string
   var fileType string
   var fileLine int
+  var profileName string
+  var noExtensions bool
+  var logOpts LogOptions
+  var logMaxSize string
 
-  // 创建一个 channel 用于接收退出信号 (来自信号 Goroutine 或命令处理)
-  exitSignal := make(chan struct{})
+  // 创建一个 channel 用于接收退出信号 (来自信号 Goroutine)，主循环开始之前收到的信号在其中等待
+  exitSignal := make(chan os.Signal, 1)
 
   // 用于接收 handleCommands 的结果
   commandResult := make(chan CommandResult)
@@ -393,14 +581,38 @@ func main() {
   flag.BoolVar(&verbose, "v", false, "Enable verbose logging output")
   flag.BoolVar(&verbose, "verbose", false, "Enable verbose logging output")
 
+  flag.StringVar(&logOpts.Level, "log-level", os.Getenv("GOMATE_LOG_LEVEL"), "Log level: error, warn, info, debug or trace (default: info, debug with -v)")
+  flag.StringVar(&logOpts.File, "log-file", os.Getenv("GOMATE_LOG_FILE"), "Append logs to this file; background sessions default to <state dir>/gomate/gomate.log ('none' disables)")
+  flag.StringVar(&logMaxSize, "log-max-size", "10M", "Rotate the log file when it grows beyond this size")
+  flag.BoolVar(&logOpts.JSON, "log-json", false, "Write logs as JSON")
+
   flag.BoolVar(&new, "n", false, "Open in a new window")
   flag.BoolVar(&new, "new", false, "Open in a new window")
 
-  flag.BoolVar(&wait, "w", false, "Wait for file to be closed by editor")
-  flag.BoolVar(&wait, "wait", false, "Wait for file to be closed by editor")
+  flag.BoolVar(&wait, "w", false, "Wait for file to be closed by editor instead of returning once it is open")
+  flag.BoolVar(&wait, "wait", false, "Wait for file to be closed by editor instead of returning once it is open")
+
+  flag.BoolVar(&force, "f", false, "Take over a file that another instance is editing")
+  flag.BoolVar(&force, "force", false, "Take over a file that another instance is editing")
+
+  flag.BoolVar(&assumeYes, "y", false, "Confirm taking over from a running instance when used with -force")
+  flag.BoolVar(&assumeYes, "yes", false, "Confirm taking over from a running instance when used with -force")
+
+  flag.BoolVar(&closeOnly, "close", false, "Ask the instance editing the file to disconnect from the editor and exit")
+
+  flag.StringVar(&foreignLocks, "foreign-locks", foreignLocksWarn, "When vim or emacs is editing the file: warn, refuse or ignore")
+  flag.BoolVar(&emacsLock, "emacs-lock", false, "Create an emacs .#file lock link while the file is open")
+
+  flag.BoolVar(&lockBeside, "lock-beside", os.Getenv("GOMATE_LOCK_BESIDE") != "", "Keep the lock file next to the edited file, for hosts sharing a network filesystem")
+  flag.StringVar(&sharedLockDir, "shared-lock-dir", os.Getenv("GOMATE_SHARED_LOCK_DIR"), "Keep lock files in this directory on a shared filesystem")
+
+  flag.StringVar(&templateDir, "template-dir", defaultTemplateDir(), "Directory of templates for new files (default: $GOMATE_TEMPLATE_DIR or <config dir>/gomate/templates)")
+  flag.BoolVar(&noTemplate, "no-template", false, "Open new files empty instead of filling them from a template")
 
-  flag.BoolVar(&force, "f", false, "Open even if file is not writable")
-  flag.BoolVar(&force, "force", false, "Open even if file is not writable")
+  flag.StringVar(&maxSaveSizeText, "max-save-size", defaultMaxSaveSizeFlag(), "Reject saves larger than this, e.g. 64M or 1G (default: $GOMATE_MAX_SAVE_SIZE or 256M)")
+
+  flag.DurationVar(&idleTimeout, "idle-timeout", 0, "Release the file after this long without a save, e.g. 30m (0 disables)")
+  flag.DurationVar(&maxSession, "max-session", 0, "Release the file after this long regardless of activity, e.g. 8h (0 disables)")
 
   flag.StringVar(&host, "h", Defaulthost, "host of remote editor")
   flag.StringVar(&host, "host", Defaulthost, "host of remote editor")
@@ -408,40 +620,97 @@ func main() {
   flag.IntVar(&port, "port", DefaultPort, "port of remote editor")
   flag.IntVar(&port, "p", DefaultPort, "port of remote editor")
 
-  flag.IntVar(&fileLine, "line", 1, "Place caret on line number after loading file")
-  flag.IntVar(&fileLine, "l", 1, "Place caret on line number after loading file")
+  flag.StringVar(&via, "via", "", "Carry the connection over the stdin/stdout of a command, e.g. 'ssh jump nc %h %p'")
+
+  flag.StringVar(&proxy, "proxy", "", "SOCKS5 or HTTP CONNECT proxy URL for the editor connection ('none' disables ALL_PROXY/HTTPS_PROXY)")
+
+  flag.StringVar(&sshOpts.Host, "ssh", "", "Reach the editor through an SSH connection to [user@]host[:port]")
+  flag.StringVar(&sshOpts.Jump, "ssh-jump", "", "Comma-separated SSH jump hosts, like ssh -J")
+  flag.StringVar(&sshOpts.Identity, "ssh-identity", "", "SSH private key file (default: ~/.ssh/id_ed25519, id_ecdsa, id_rsa)")
+  flag.StringVar(&sshOpts.KnownHosts, "ssh-known-hosts", "", "SSH known_hosts file (default: ~/.ssh/known_hosts)")
+
+  flag.StringVar(&discoverPorts, "discover-ports", "", "Extra comma-separated localhost ports to probe when no host is configured (default: $GOMATE_DISCOVER_PORTS)")
+  flag.BoolVar(&noDiscover, "no-discover", false, "Disable editor endpoint discovery and dial host:port directly")
+
+  flag.IntVar(&fileLine, "line", 0, "Place caret on line number after loading file")
+  flag.IntVar(&fileLine, "l", 0, "Place caret on line number after loading file")
+
+  flag.StringVar(&fileName, "m", "", "The display name shown in editor")
+  flag.StringVar(&fileName, "name", "", "The display name shown in editor")
 
-  flag.StringVar(&fileName, "m", Defaulthost, "The display name shown in editor")
-  flag.StringVar(&fileName, "name", Defaulthost, "The display name shown in editor")
+  flag.StringVar(&fileType, "t", "", "Treat file as having specified type")
+  flag.StringVar(&fileType, "type", "", "Treat file as having specified type")
 
-  flag.StringVar(&fileType, "t", Defaulthost, "Treat file as having specified type")
-  flag.StringVar(&fileType, "type", Defaulthost, "Treat file as having specified type")
+  flag.StringVar(&profileName, "editor-profile", "auto", "Editor quirk profile: auto, textmate, sublime, vscode or generic")
+  flag.BoolVar(&noExtensions, "no-extensions", false, "Speak plain rmate even if the editor side offers gomate protocol extensions")
 
 
   flag.Parse()
 
-  configureLogging(verbose)
+  logOpts.Verbose = verbose
+  // 日志尚未配置，错误直接输出到标准错误
+  logMaxBytes, err := parseByteSize(logMaxSize)
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "gomate: invalid -log-max-size: %v\n", err)
+    return exitUsage
+  }
+  logOpts.MaxSize = logMaxBytes
+  if err := setupLogging(logOpts); err != nil {
+    fmt.Fprintf(os.Stderr, "gomate: %v\n", err)
+    return exitError
+  }
+
+  // --editor-profile 覆盖根据握手行的自动识别，提前校验以免连接后才报错
+  var forcedProfile *EditorProfile
+  if profileName != "auto" {
+    var err error
+    if forcedProfile, err = lookupProfile(profileName); err != nil {
+      return failUsage(fmt.Errorf("invalid -editor-profile: %w", err))
+    }
+  }
+
+  maxSaveSize, err := parseByteSize(maxSaveSizeText)
+  if err != nil {
+    return failUsage(fmt.Errorf("invalid -max-save-size: %w", err))
+  }
+
+  // -name 和 -type 的值写入 rmate 头部，不能含有换行等控制字符
+  if err := validateHeaderValue("-name", fileName); err != nil {
+    return failUsage(err)
+  }
+  if err := validateHeaderValue("-type", fileType); err != nil {
+    return failUsage(err)
+  }
+
+  switch foreignLocks {
+  case foreignLocksWarn, foreignLocksRefuse, foreignLocksIgnore:
+  default:
+    return failUsage(fmt.Errorf("invalid -foreign-locks %q (want warn, refuse or ignore)", foreignLocks))
+  }
+
+  // 记录哪些参数是在命令行上显式指定的
+  explicit := make(map[string]bool)
+  flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
 
   // --- 2. 环境变量优先级检查 ---
+  // 命令行、GOMATE_HOST 和 --via/--ssh 都没有指定编辑器位置时，才进行自动发现
+  autoDiscover := !noDiscover && !explicit["h"] && !explicit["host"] && os.Getenv("GOMATE_HOST") == "" &&
+    via == "" && sshOpts.Host == ""
+  portFixed := explicit["p"] || explicit["port"] || os.Getenv("GOMATE_PORT") != ""
+
   if envHost := os.Getenv("GOMATE_HOST"); envHost != "" {
     if host == Defaulthost {
       host = envHost
-      // 改进: 使用 fmt.Println，避免被 configureLogging 禁用
-      //fmt.Printf("Using host from environment variable GOMATE_HOST: %s\n", host)
-      // log.Printf("Using host from environment variable GOMATE_HOST: %s\n", host)
     }
   }
 
   if envPortStr := os.Getenv("GOMATE_PORT"); envPortStr != "" {
     if port == DefaultPort {
-      var envPort int
-      _, err := fmt.Sscanf(envPortStr, "%d", &envPort)
-      if err == nil {
+      envPort, err := strconv.Atoi(strings.TrimSpace(envPortStr))
+      if err == nil && envPort > 0 && envPort <= 65535 {
         port = envPort
-        // fmt.Printf("Using port from environment variable GOMATE_PORT: %d\n", port)
-        // log.Printf("Using port from environment variable GOMATE_PORT: %d\n", port)
       } else {
-        // log.Printf("Warning: GOMATE_PORT environment variable is invalid. Using port %d", port)
+        slog.Warn("ignoring invalid GOMATE_PORT", "value", envPortStr, "port", port)
       }
     }
   }
@@ -449,102 +718,209 @@ func main() {
   // --- 2. 信号处理 Goroutine ---
   // 创建一个 channel 用于接收信号
   sigs := make(chan os.Signal, 1)
-  // 告诉 Go 关注 SIGINT (Ctrl+C) 和 SIGTERM (Windows 窗口关闭)
-  signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+  // 告诉 Go 关注 SIGINT (Ctrl+C)、SIGTERM (Windows 窗口关闭) 和 SIGHUP (SSH 会话断开)
+  signal.Notify(sigs, shutdownSignals...)
 
   // 信号监听 Goroutine 启动
-  go func() {
-    sig := <-sigs // 阻塞，直到收到信号
-    log.Printf("Received system signal: %s. Initiating graceful cleanup.", sig)
-
-    // 收到信号后，执行清理并退出。
-    // 由于 lockFile 和 lockFilePath 尚未定义，我们不能在这里直接访问。
-    // 我们需要使用一个 channel 通知主 Goroutine 执行清理。
-
-    // 改进方案：使用一个 channel 专门通知主 Goroutine 退出
-    exitSignal <- struct{}{}
-  }()
+  // 收到信号后，执行清理并退出。
+  // 由于 lockFile 和 lockFilePath 尚未定义，我们不能在这里直接访问。
+  // 改进方案：使用一个 channel 专门通知主 Goroutine 退出
+  go forwardSignals(sigs, exitSignal)
 
   // --- 3. 文件存在性检查和多实例互斥 ---
   args := flag.Args()
   if len(args) == 0 {
-    fmt.Println("Error: No file path provided.")
-    fmt.Println("Usage: gomate [options] <file1> [file2...]")
-    os.Exit(1)
+    fmt.Fprintln(os.Stderr, "gomate: no file path provided")
+    fmt.Fprintln(os.Stderr, "Usage: gomate [options] <file1> [file2...]")
+    return exitUsage
+  }
+
+  lockLoc, err := resolveLockLocation(lockBeside, sharedLockDir)
+  if err != nil {
+    return fail(err)
   }
 
   targetFile := args[0]
-  if err := ensureFileExists(targetFile); err != nil {
-    // 在使用 log.Fatal 函数时，内部就调用了 os.Exit(1)
-    log.Fatalf("Fatal: Failed to ensure file existence for %s: %v", targetFile, err)
+  if closeOnly {
+    return closeRunningInstance(targetFile, lockLoc)
+  }
+  if !wait && !isDetachedChild() {
+    // 默认在后台编辑文件：由后台进程持有锁并与编辑器通信，
+    // 它打开文件之前的错误和提示仍然经由这个进程显示在终端上。信号由 runDetached 转发给后台进程
+    signal.Stop(sigs)
+    return runDetached()
+  }
+  // 不存在的文件在第一次保存时才创建，拼错的路径或连不上的编辑器不会留下空文件
+  if err := checkTargetFile(targetFile); err != nil {
+    return fail(err)
+  }
+  if lockLoc.Beside {
+    // 锁文件放在被编辑的文件旁边，目录必须先存在；没有保存时会在退出时删除
+    if err := createdDirs.MkdirAll(filepath.Dir(targetFile)); err != nil {
+      return fail(err)
+    }
   }
 
   // 检查是否已存在实例
-  log.Printf("Try to open file: %s", targetFile)
-  var lockFile *os.File
-  lockFile, err := checkMultiInstance(targetFile, force)
+  slog.Debug("trying to open file", "file", targetFile)
+  lock, err := checkMultiInstance(targetFile, LockOptions{
+    Force:        force,
+    AssumeYes:    assumeYes,
+    Location:     lockLoc,
+    ForeignLocks: foreignLocks,
+    EmacsLock:    emacsLock,
+  })
 
   if err != nil {
+    // --foreign-locks refuse：文件由 vim 或 emacs 持有，没有可以重新激活的 gomate 会话
+    var foreignErr *ForeignLockError
+    if errors.As(err, &foreignErr) {
+      fmt.Fprintf(os.Stderr, "gomate: refusing to open %s: %v\n", targetFile, foreignErr)
+      fmt.Fprintf(os.Stderr, "gomate: close it there first, or use -foreign-locks warn or -f to open it anyway\n")
+      return exitAlreadyOpen
+    }
     if errors.Is(err, ErrInstanceAlreadyRunning) {
-      os.Exit(0) // 优雅退出 (状态码 0)
+      return alreadyOpen(targetFile, lockLoc, err, wait, exitSignal)
     }
-    // 在使用 log.Fatal 函数时，内部就调用了 os.Exit(1)
-    log.Fatal(err) // 致命错误，退出并记录
+    return fail(err)
   }
 
   // ❗ 核心修正：清理函数
-  lockFilePath := lockFile.Name()
+  // 进程被强制结束时没有机会执行清理，内核也会在进程退出时释放锁
+  // 控制请求可能提前执行清理，sync.Once 保证 defer 时不会重复释放
+  var cleanupOnce sync.Once
   cleanup := func() {
-    if lockFile != nil {
-      if closeErr := lockFile.Close(); closeErr != nil {
-        log.Printf("Warning: failed to close lock file %s: %v", lockFilePath, closeErr)
+    cleanupOnce.Do(func() {
+      lock.Release()
+      // 锁文件可能位于新建的目录中，释放锁之后再删除目录
+      createdDirs.Cleanup()
+    })
+  }
+
+  // 从这里开始，出错时返回而不是直接退出，确保连接失败等情况下不会留下锁文件
+  defer cleanup()
+
+  // --- 4. 网络连接和通信 ---
+  var conn net.Conn
+  var editor string
+  if autoDiscover {
+    // 端口已固定时只探测该端口，否则再加上 --discover-ports / GOMATE_DISCOVER_PORTS
+    ports := []int{port}
+    if !portFixed {
+      extra := discoverPorts
+      if extra == "" {
+        extra = os.Getenv("GOMATE_DISCOVER_PORTS")
       }
-      if removeErr := os.Remove(lockFilePath); removeErr != nil && !os.IsNotExist(removeErr) {
-        log.Printf("Warning: failed to remove lock file %s: %v", lockFilePath, removeErr)
+      extraPorts, parseErr := parsePortList(extra)
+      if parseErr != nil {
+        return fail(fmt.Errorf("invalid discovery port list %q: %w", extra, parseErr))
       }
-      log.Println("Lock released and lock file deleted.")
+      ports = append(ports, extraPorts...)
     }
+
+    var endpoint editorEndpoint
+    conn, endpoint, err = discoverEditor(ports, proxy)
+    if err != nil {
+      return fail(fmt.Errorf("editor discovery failed (ports %v): %w", ports, err))
+    }
+    host, port = endpoint.Host, endpoint.Port
+    editor = endpoint.String()
+  } else {
+    slog.Debug("connection target", "host", host, "port", port)
+    dialOpts := DialOptions{Host: host, Port: port, Via: via, Proxy: proxy, SSH: sshOpts}
+    conn, err = dialEditor(dialOpts)
+    if err != nil {
+      // 返回前，defer 会执行 cleanup()
+      return fail(err)
+    }
+    editor = dialOpts.String()
   }
 
-  // --- 4. 网络连接和通信 ---
-  log.Printf("Connection target: %s:%d", host, port)
-  conn, err := net.Dial("tcp", fmt.Sprintf("%v:%v", host, port))
-  if err != nil {
-    // 在致命错误退出前，defer 会执行 cleanup()
-    log.Fatal(err)
+  // 记录编辑器地址，gomate locks 据此显示谁在用哪个编辑器编辑这个文件
+  if err := lock.SetEditor(editor); err != nil {
+    slog.Warn("failed to record editor endpoint in lock file", "error", err)
   }
 
+  var closeConnOnce sync.Once
   closeConn := func() {
-    if closeErr := conn.Close(); closeErr != nil {
-      log.Printf("Warning: failed to close network connection: %v", closeErr)
-    }
+    closeConnOnce.Do(func() {
+      if closeErr := conn.Close(); closeErr != nil {
+        slog.Warn("failed to close network connection", "error", closeErr)
+      }
+    })
   }
 
-  // 确保在主函数退出时, 关闭连接
+  // 确保在主函数退出时, 关闭连接 (在释放锁之前执行)
   defer closeConn()
 
-  // 确保在主函数正常退出时（如连接失败）清理锁
-  defer cleanup()
+  // 接收编辑器握手信息，并据此选择编辑器特性表
+  // 较大的读缓冲区使保存的内容以少数几次系统调用读入
+  buf := bufio.NewReaderSize(conn, frameBufferSize)
+  handshake, err := readProtocolLine(buf)
+  if err != nil {
+    return fail(fmt.Errorf("no handshake from editor: %w", err))
+  }
+  // 理解 gomate 扩展的服务端在握手行中提供扩展，普通的 rmate 编辑器不会提供
+  offer, handshake := splitCapsOffer(handshake)
+  var caps Capabilities
+  if len(offer) > 0 {
+    if noExtensions {
+      slog.Debug("editor offers protocol extensions, ignored because of -no-extensions", "offer", offer)
+    } else {
+      caps = negotiateCaps(offer)
+      slog.Debug("editor offers protocol extensions", "offer", offer, "using", caps.String())
+    }
+  }
+  greeting := parseGreeting(handshake)
+  slog.Debug("editor handshake", "greeting", greeting.Raw, "product", greeting.Product, "version", greeting.Version)
+
+  profile := detectProfile(greeting)
+  if forcedProfile != nil {
+    profile = forcedProfile
+    slog.Debug("using editor profile from --editor-profile", "profile", profile.Name)
+  } else {
+    slog.Debug("detected editor profile", "profile", profile.Name)
+  }
+
+  openOpts := OpenOptions{DisplayName: fileName, FileType: fileType, Line: fileLine, NewWindow: new, Caps: caps}
+  if !noTemplate {
+    openOpts.TemplateDir = templateDir
+  }
+
+  // 连接编辑器期间收到了中断信号，不再打开文件
+  select {
+  case sig := <-exitSignal:
+    slog.Info("interrupted before opening the file", "signal", sig)
+    return exitCodeForSignal(sig)
+  default:
+  }
 
   // 发送文件
   for _, f := range flag.Args() {
-    log.Printf("Send file %s to %s", f, host)
-    if err = sendFile(conn, f); err != nil {
+    slog.Debug("sending file", "file", f, "host", host)
+    if err = sendFile(conn, f, openOpts, profile); err != nil {
       // sendFile 失败是致命的
-      // 在致命错误退出前，defer 会执行 cleanup()
-      // 在使用 log.Fatal 函数时，内部就调用了 os.Exit(1)
-      log.Fatal(err)
+      // 返回前，defer 会执行 cleanup()
+      return fail(err)
     }
+    slog.Info("opened", "file", f, "editor", editor, "profile", profile.Name, "pid", os.Getpid())
     break // 只处理第一个文件
   }
 
-  // 接收编辑器握手信息
-  buf := bufio.NewReader(conn)
-  b, _, err := buf.ReadLine()
-  if err != nil {
-    log.Fatal(err)
+  // 打开控制套接字，让之后的 gomate 实例可以请求重新激活、接管或关闭这个会话
+  var controlRequests <-chan controlRequest
+  if control, ctlErr := startControlServer(lock.ID()); ctlErr != nil {
+    slog.Warn("control socket unavailable", "error", ctlErr)
+  } else {
+    defer control.Close()
+    controlRequests = control.Requests()
+    if err := lock.SetControl(control.Path()); err != nil {
+      slog.Warn("failed to record control socket in lock file", "error", err)
+    }
   }
-  log.Printf("Editor handshake: %s", strings.TrimSpace(string(b)))
+
+  // 文件已经在编辑器中打开，后台进程从此脱离终端，前台进程随即返回
+  detachFromTerminal()
 
   // ----------------------------------------------------
   // ❗ 核心修正：将 handleCommands 放入 Goroutine
@@ -552,7 +928,15 @@ func main() {
   // 必须在主 Goroutine 外部运行，才能保证 select 能够及时响应信号。
   go func() {
     for {
-      exit, err := handleCommands(buf)
+      exit, err := handleCommands(buf, conn, profile, caps, maxSaveSize)
+
+      // 保存失败不是致命错误：告诉用户内容保存在哪里，会话继续
+      var saveErr *SaveError
+      if errors.As(err, &saveErr) {
+        slog.Error("save failed", "file", saveErr.File, "error", saveErr.Err, "recovery", saveErr.Recovery)
+        fmt.Fprintf(os.Stderr, "gomate: %v\n", saveErr)
+        continue
+      }
 
       result := CommandResult{Exit: exit, Err: err}
 
@@ -569,29 +953,113 @@ func main() {
     }
   }()
 
+  // 共享文件系统上的锁需要定期刷新租约
+  var heartbeat <-chan time.Time
+  if interval := lock.HeartbeatInterval(); interval > 0 {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    heartbeat = ticker.C
+  }
+
+  // --idle-timeout / --max-session：遗忘的编辑器标签页不会永远占着锁
+  expiry := newSessionExpiry(idleTimeout, maxSession)
+
+  // 是否保存过文件，决定编辑器关闭文件时的退出码
+  saved := false
+  exitCode := exitSaved
+
   // ----------------------------------------------------
   // 5. 主循环等待退出信号或命令结果
   // ----------------------------------------------------
   for {
     select {
-    case <-exitSignal:
-      // 收到来自信号 Goroutine 的通知 (窗口关闭/Ctrl+C)
-      log.Println("Signal-triggered exit.")
+    case now := <-expiry.C():
+      warning, expired := expiry.Check(now)
+      // 后台会话的标准错误已经关闭，提示同时以 warn 级别写入日志文件 (后台会话默认总有日志文件)
+      if warning != "" {
+        fmt.Fprintf(os.Stderr, "gomate: %s will be released: %s\n", targetFile, warning)
+        fileLog.Warn("session ends soon", "file", targetFile, "reason", warning)
+      }
+      if expired != "" {
+        // 与关闭请求相同：先断开编辑器 (编辑器据此得知会话结束)，再释放锁
+        fmt.Fprintf(os.Stderr, "gomate: released %s after %s\n", targetFile, expired)
+        fileLog.Warn("session expired, releasing the file", "file", targetFile, "reason", expired)
+        closeConn()
+        cleanup()
+        exitCode = exitReleased
+        goto EndLoop
+      }
+
+    case <-heartbeat:
+      if hbErr := lock.Heartbeat(); hbErr != nil {
+        slog.Warn("failed to refresh lock lease", "lock", lock.Path(), "error", hbErr)
+      }
+
+    case sig := <-exitSignal:
+      // 收到来自信号 Goroutine 的通知 (窗口关闭/Ctrl+C/SSH 断开)
+      // 先让正在进行的保存完成 (或中止并回滚)，再断开编辑器，最后由 defer 释放锁
+      slog.Debug("signal-triggered exit")
+      rolledBack := finishSaves(closeConn)
+      reportOpenFiles(sig, rolledBack)
+      exitCode = exitCodeForSignal(sig)
+      goto EndLoop
+
+    case savedFile := <-savedFiles:
+      saved = true
+      // 保存后文件的 inode 已经改变；锁按路径命名不受影响，只需更新用于识别别名的记录
+      if id, idErr := fileIdentity(savedFile); idErr != nil {
+        slog.Warn("failed to read file identity after save", "file", savedFile, "error", idErr)
+      } else {
+        sessionTokens.Refresh(id)
+        if updateErr := lock.UpdateInode(id); updateErr != nil {
+          slog.Warn("failed to record the new inode in the lock file", "file", savedFile, "error", updateErr)
+        }
+      }
+      expiry.Touch()
+
+    case req := <-controlRequests:
+      // 来自另一个 gomate 实例的控制请求
+      if req.Command == controlReactivate {
+        slog.Debug("re-activating file in the editor", "file", targetFile)
+        req.Reply(sendFile(conn, targetFile, openOpts, profile))
+        expiry.Touch()
+        continue
+      }
+      // 接管或关闭：先断开编辑器，再释放锁，最后应答，请求方随即可以获得锁
+      slog.Info("releasing file on control request", "file", targetFile, "command", req.Command)
+      closeConn()
+      cleanup()
+      req.Reply(nil)
+      exitCode = exitReleased
       goto EndLoop
 
     case res := <-commandResult:
       // 收到来自命令处理 Goroutine 的结果
       if res.Err != nil {
-        log.Fatal(res.Err) // 命令处理中遇到致命错误
+        // 命令处理中遇到致命错误
+        if isConnectionError(res.Err) {
+          slog.Warn("connection to editor lost", "file", targetFile, "error", res.Err)
+          fmt.Fprintf(os.Stderr, "gomate: lost connection to the editor before %s was closed\n", targetFile)
+          exitCode = exitConnectionLost
+        } else {
+          exitCode = fail(res.Err)
+        }
+        goto EndLoop
       }
       if res.Exit {
-        log.Println("Command-triggered exit.")
+        slog.Debug("command-triggered exit")
+        // 保存成功的通知可能还留在 channel 中尚未处理
+        if !saved && len(savedFiles) == 0 {
+          fmt.Fprintf(os.Stderr, "gomate: %s was closed without saving\n", targetFile)
+          exitCode = exitNotSaved
+        }
         goto EndLoop // 退出 For 循环，执行 defer
       }
     }
   }
 
 EndLoop:
-  // main 函数正常返回，defer 会清理所有资源。
-  log.Println("Gomate client exiting.")
+  // run 函数正常返回，defer 会清理所有资源。
+  slog.Info("session ended", "file", targetFile, "exit_code", exitCode)
+  return exitCode
 }
@@ -0,0 +1,253 @@
+package main
+
+import (
+  "bytes"
+  "errors"
+  "net"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+)
+
+// testMainEnv 让测试二进制像 gomate 一样运行 main，用于检查退出码和标准错误上的输出
+const testMainEnv = "GOMATE_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+  // 由测试中的 gomate 启动的 via 命令继承了它的环境，因此以第一个参数而不是环境变量识别
+  if len(os.Args) > 2 && os.Args[1] == testViaArg {
+    os.Exit(runTestViaCommand(os.Args[2], os.Args[3:]))
+  }
+  if os.Getenv(testMainEnv) != "" {
+    main()
+    return
+  }
+  os.Exit(m.Run())
+}
+
+// gomateEnv 是子进程的隔离环境：锁目录、日志和状态目录都位于测试的临时目录中。
+func gomateEnv(t *testing.T) []string {
+  t.Helper()
+  home := t.TempDir()
+  locks := filepath.Join(home, "locks")
+  if err := os.Mkdir(locks, 0700); err != nil {
+    t.Fatal(err)
+  }
+  env := []string{testMainEnv + "=1", "HOME=" + home, "XDG_STATE_HOME=" + filepath.Join(home, "state"),
+    "XDG_RUNTIME_DIR=" + home, "GOMATE_LOCK_DIR=" + locks, "TMPDIR=" + home}
+  for _, kv := range os.Environ() {
+    name, _, _ := strings.Cut(kv, "=")
+    if name == "PATH" || name == "SYSTEMROOT" || name == "LOCALAPPDATA" {
+      env = append(env, kv)
+    }
+  }
+  return env
+}
+
+// runGomate 以 args 运行 gomate，返回退出码和标准错误。
+func runGomate(t *testing.T, env []string, args ...string) (int, string) {
+  t.Helper()
+  cmd := exec.Command(os.Args[0], args...)
+  cmd.Env = env
+  var stderr bytes.Buffer
+  cmd.Stderr = &stderr
+  err := cmd.Run()
+  var exitErr *exec.ExitError
+  if errors.As(err, &exitErr) {
+    return exitErr.ExitCode(), stderr.String()
+  }
+  if err != nil {
+    t.Fatalf("running gomate: %v", err)
+  }
+  return 0, stderr.String()
+}
+
+func TestInvalidFlagsExitWithUsageError(t *testing.T) {
+  env := gomateEnv(t)
+  file := filepath.Join(t.TempDir(), "notes.txt")
+  tests := []struct {
+    args []string
+    want string
+  }{
+    {[]string{"-editor-profile", "emacs", file}, "unknown editor profile"},
+    {[]string{"-foreign-locks", "sometimes", file}, "invalid -foreign-locks"},
+    {[]string{"-name", "notes\nclose", file}, "-name"},
+    {[]string{"-type", "text\x1b", file}, "-type"},
+  }
+  for _, tt := range tests {
+    code, stderr := runGomate(t, env, append([]string{"-w"}, tt.args...)...)
+    if code != exitUsage || !strings.Contains(stderr, tt.want) {
+      t.Errorf("gomate %v: exit %d, stderr %q; want exit %d mentioning %q", tt.args, code, stderr, exitUsage, tt.want)
+    }
+  }
+}
+
+func TestForeignLockRefusal(t *testing.T) {
+  env := gomateEnv(t)
+  dir := t.TempDir()
+  file := filepath.Join(dir, "notes.txt")
+  if err := os.WriteFile(file, []byte("hello\n"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  // 交换文件的持有者是仍在运行的测试进程
+  writeVimSwap(t, filepath.Join(dir, ".notes.txt.swp"), os.Getpid())
+
+  code, stderr := runGomate(t, env, "-w", "-foreign-locks", "refuse", "-no-discover", "-p", "1", file)
+  if code != exitAlreadyOpen {
+    t.Fatalf("exit %d, want %d; stderr:\n%s", code, exitAlreadyOpen, stderr)
+  }
+  if !strings.Contains(stderr, "refusing to open") || !strings.Contains(stderr, "vim") {
+    t.Errorf("stderr does not explain the refusal:\n%s", stderr)
+  }
+  if strings.Contains(stderr, "re-activated") {
+    t.Errorf("tried to re-activate a gomate session that does not exist:\n%s", stderr)
+  }
+
+  // warn 只警告，继续尝试连接编辑器 (这里没有编辑器，因此连接失败)
+  code, stderr = runGomate(t, env, "-w", "-foreign-locks", "warn", "-no-discover", "-h", "127.0.0.1", "-p", "1", file)
+  if code != exitError || !strings.Contains(stderr, "also being edited in vim") {
+    t.Errorf("warn: exit %d, stderr:\n%s", code, stderr)
+  }
+}
+
+// envValue 返回 env 中 name 的值。
+func envValue(env []string, name string) string {
+  for _, kv := range env {
+    if k, v, ok := strings.Cut(kv, "="); ok && k == name {
+      return v
+    }
+  }
+  return ""
+}
+
+func TestUnusableTargetReportsError(t *testing.T) {
+  env := gomateEnv(t)
+  dir := t.TempDir()
+  notDir := filepath.Join(dir, "plain")
+  if err := os.WriteFile(notDir, nil, 0644); err != nil {
+    t.Fatal(err)
+  }
+  tests := []struct {
+    args []string
+    code int
+    want string
+  }{
+    {[]string{"-w", dir}, exitError, "is a directory"},
+    {[]string{"-w", "-shared-lock-dir", filepath.Join(notDir, "locks"), filepath.Join(dir, "notes.txt")}, exitError, "shared lock directory"},
+    {[]string{"-w"}, exitUsage, "no file path provided"},
+  }
+  for _, tt := range tests {
+    code, stderr := runGomate(t, env, tt.args...)
+    if code != tt.code || !strings.Contains(stderr, tt.want) {
+      t.Errorf("gomate %v: exit %d, stderr %q; want exit %d mentioning %q", tt.args, code, stderr, tt.code, tt.want)
+    }
+  }
+}
+
+func TestAlreadyOpen(t *testing.T) {
+  env := gomateEnv(t)
+  file := filepath.Join(t.TempDir(), "notes.txt")
+  if err := os.WriteFile(file, []byte("hello\n"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  // 测试进程扮演正在编辑这个文件的会话
+  loc := lockLocation{Dir: envValue(env, "GOMATE_LOCK_DIR")}
+  lock, err := acquireInstanceLock(file, loc, false, false)
+  if err != nil {
+    t.Fatal(err)
+  }
+  released := false
+  defer func() {
+    if !released {
+      lock.Release()
+    }
+  }()
+
+  code, stderr := runGomate(t, env, "-no-discover", "-p", "1", file)
+  if code != exitAlreadyOpen || !strings.Contains(stderr, "already open") {
+    t.Fatalf("without -wait: exit %d, want %d; stderr:\n%s", code, exitAlreadyOpen, stderr)
+  }
+
+  // -wait 等到那个会话结束，期间文件被保存过
+  cmd := exec.Command(os.Args[0], "-w", "-no-discover", "-p", "1", file)
+  cmd.Env = env
+  var out bytes.Buffer
+  cmd.Stderr = &out
+  if err := cmd.Start(); err != nil {
+    t.Fatal(err)
+  }
+  done := make(chan error, 1)
+  go func() { done <- cmd.Wait() }()
+  select {
+  case err := <-done:
+    t.Fatalf("-wait returned while the file was still open: %v; stderr:\n%s", err, out.String())
+  case <-time.After(3 * releasePollInterval):
+  }
+  if err := os.WriteFile(file, []byte("hello, world\n"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  lock.Release()
+  released = true
+  select {
+  case err := <-done:
+    if err != nil {
+      t.Fatalf("-wait after the session ended: %v; stderr:\n%s", err, out.String())
+    }
+  case <-time.After(10 * time.Second):
+    cmd.Process.Kill()
+    t.Fatal("-wait did not return after the session ended")
+  }
+}
+
+func TestForceWithoutConfirmationReportsHint(t *testing.T) {
+  env := gomateEnv(t)
+  file := filepath.Join(t.TempDir(), "notes.txt")
+  if err := os.WriteFile(file, []byte("hello\n"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  lock, err := acquireInstanceLock(file, lockLocation{Dir: envValue(env, "GOMATE_LOCK_DIR")}, false, false)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer lock.Release()
+
+  // 标准输入不是终端，无法确认接管；-v 时错误也只输出一次
+  for _, args := range [][]string{{"-w", "-f", file}, {"-w", "-v", "-f", file}} {
+    code, stderr := runGomate(t, env, args...)
+    if code != exitError || strings.Count(stderr, "(use -yes)") != 1 {
+      t.Errorf("gomate %v: exit %d, stderr:\n%s\nwant exit %d and the -yes hint once", args, code, stderr, exitError)
+    }
+  }
+}
+
+func TestExpiryWarningsReachLogFile(t *testing.T) {
+  env := gomateEnv(t)
+  file := filepath.Join(t.TempDir(), "notes.txt")
+  if err := os.WriteFile(file, []byte("hello\n"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  editor := startGreetingServer(t, "220 TextMate (rmate)")
+  host, port, _ := net.SplitHostPort(editor)
+
+  // 默认在后台编辑：前台进程在文件打开后就返回，之后的警告只能写入日志文件
+  code, stderr := runGomate(t, env, "-no-discover", "-h", host, "-p", port, "-idle-timeout", "2s", file)
+  if code != exitSaved {
+    t.Fatalf("exit %d, stderr:\n%s", code, stderr)
+  }
+  logFile := filepath.Join(envValue(env, "XDG_STATE_HOME"), "gomate", "gomate.log")
+  deadline := time.Now().Add(10 * time.Second)
+  for {
+    data, _ := os.ReadFile(logFile)
+    got := string(data)
+    if strings.Contains(got, "level=WARN msg=\"session ends soon\"") &&
+      strings.Contains(got, "level=WARN msg=\"session expired, releasing the file\"") {
+      return
+    }
+    if time.Now().After(deadline) {
+      t.Fatalf("expiry warnings missing from %s:\n%s", logFile, got)
+    }
+    time.Sleep(100 * time.Millisecond)
+  }
+}
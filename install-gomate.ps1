@@ -24,13 +24,12 @@ $gomateDir = $InstallDir
 $gomateCoreDir = Join-Path -Path $gomateDir -ChildPath "core"
 
 $gomateCmdPath = Join-Path -Path $gomateDir -ChildPath "gomate.cmd"
-$gomateVbsPath = Join-Path -Path $gomateCoreDir -ChildPath "gomate.vbs"
+$gomateVbsPath = Join-Path -Path $gomateCoreDir -ChildPath "gomate.vbs" # 旧版本的隐藏启动器，安装时删除
 $gomateExePath = Join-Path -Path $gomateCoreDir -ChildPath $AssetName
 
 # --- 仓库文件下载 URL ---
 $GitHubBaseUrl = "https://raw.githubusercontent.com/$GitHubUser/$GitHubRepo/refs/heads/main"
 $CmdUrl = "$GitHubBaseUrl/gomate.cmd"
-$VbsUrl = "$GitHubBaseUrl/gomate.vbs"
 
 
 # --- 辅助函数：设置系统环境变量 (保持不变) ---
@@ -70,7 +69,7 @@ try {
 
 
 # --------------------------------------------------------------------------------------
-# --- 2. 核心配置逻辑 (从 GitHub 下载 .cmd 和 .vbs) ---
+# --- 2. 核心配置逻辑 (从 GitHub 下载 .cmd) ---
 # --------------------------------------------------------------------------------------
 
 Write-Host "`n--- 2. Setting up configuration scripts and PATH ---" -ForegroundColor Yellow
@@ -82,11 +81,11 @@ if (-not (Test-Path $gomateDir)) { New-Item -Path $gomateDir -ItemType Directory
 if (-not (Test-Path $gomateCoreDir)) { New-Item -Path $gomateCoreDir -ItemType Directory -Force | Out-Null } 
 
 try {
-    # --- 2.1 下载 gomate.exe 隐藏启动器 (gomate.vbs) ---
-    Write-Host "Downloading gomate.vbs from repository: $VbsUrl"
-    # 使用 Invoke-WebRequest 下载原始文件内容
-    Invoke-WebRequest -Uri $VbsUrl -OutFile $gomateVbsPath -UseBasicParsing -ErrorAction Stop
-    Write-Host "✅ Downloaded gomate.vbs to $gomateVbsPath" -ForegroundColor Green
+    # --- 2.1 删除旧版本的隐藏启动器 (gomate.exe 现在自行转入后台) ---
+    if (Test-Path $gomateVbsPath) {
+        Remove-Item -Path $gomateVbsPath -Force
+        Write-Host "✅ Removed obsolete $gomateVbsPath" -ForegroundColor Green
+    }
 
     # --- 2.2 下载 gomate.exe 启动脚本 (gomate.cmd) ---
     Write-Host "Downloading gomate.cmd from repository: $CmdUrl"
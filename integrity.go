@@ -0,0 +1,95 @@
+package main
+
+import (
+  "bufio"
+  "errors"
+  "fmt"
+  "io"
+  "log/slog"
+  "os"
+  "strconv"
+  "strings"
+)
+
+// checksumHeader 是 gomate 扩展头部，支持它的编辑器在 data: 之前发送内容的 SHA-256 (十六进制)
+const checksumHeader = "x-gomate-sha256"
+
+// ErrSaveTooLarge 表示编辑器声明的保存大小超过了 -max-save-size，内容被丢弃而不写入磁盘。
+var ErrSaveTooLarge = errors.New("save exceeds the maximum save size")
+
+// parseByteSize 解析 "1048576"、"512K"、"256M"、"1G" 这样的大小，后缀按 1024 进位，可以带 B/iB。
+func parseByteSize(s string) (int64, error) {
+  text := strings.ToUpper(strings.TrimSpace(s))
+  text = strings.TrimSuffix(strings.TrimSuffix(text, "B"), "I")
+
+  shift := 0
+  if n := len(text); n > 0 {
+    switch text[n-1] {
+    case 'K':
+      shift = 10
+    case 'M':
+      shift = 20
+    case 'G':
+      shift = 30
+    }
+    if shift > 0 {
+      text = text[:n-1]
+    }
+  }
+
+  n, err := strconv.ParseInt(strings.TrimSpace(text), 10, 64)
+  if err != nil || n < 0 || n > (1<<62)>>shift {
+    return 0, fmt.Errorf("invalid size %q (want e.g. 1048576, 512K, 256M or 1G)", s)
+  }
+  return n << shift, nil
+}
+
+// defaultMaxSaveSizeFlag 返回 -max-save-size 的默认值：$GOMATE_MAX_SAVE_SIZE 或 256M。
+// 超过该大小的保存不会写入文件，也不会保存为恢复文件，编辑器无法借此占满磁盘。
+func defaultMaxSaveSizeFlag() string {
+  if size := os.Getenv("GOMATE_MAX_SAVE_SIZE"); size != "" {
+    return size
+  }
+  return "256M"
+}
+
+// verifyChecksum 比较收到的内容的 SHA-256 (十六进制的 got) 与编辑器在 x-gomate-sha256 头部中发送的值，
+// 没有该头部时不做检查。
+func verifyChecksum(got string, want string) error {
+  if want == "" {
+    return nil
+  }
+  if !strings.EqualFold(got, want) {
+    return fmt.Errorf("checksum mismatch: editor sent sha256 %s, received content has %s", want, got)
+  }
+  slog.Debug("verified sha256", "sha256", got)
+  return nil
+}
+
+// errSaveFraming 表示 save 内容之后没有换行：data: 声明的大小与实际发送的内容不一致，
+// 内容可能被截断或混入了其他数据。
+var errSaveFraming = errors.New("content does not end where the data: header said; the save may be truncated or corrupted")
+
+// readSaveTerminator 读掉 save 内容之后的换行 ("\n" 或 "\r\n")。
+// 缺少换行时返回 errSaveFraming 且不读掉任何字节，之后的行按命令解析，从而与编辑器重新同步。
+// 编辑器发送内容后直接断开连接时没有换行，这不影响内容的完整性。
+func readSaveTerminator(buf *bufio.Reader) error {
+  b, err := buf.Peek(1)
+  if err == io.EOF {
+    return nil
+  }
+  if err != nil {
+    return fmt.Errorf("failed to read end of save: %w", err)
+  }
+  switch b[0] {
+  case '\n':
+    buf.Discard(1)
+    return nil
+  case '\r':
+    if b, err := buf.Peek(2); err == nil && b[1] == '\n' {
+      buf.Discard(2)
+      return nil
+    }
+  }
+  return errSaveFraming
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io/fs"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "runtime"
+  "time"
+)
+
+const (
+  // forceRelockTimeout 是强制模式下旧实例同意交出文件后，等待内核释放其文件锁的最长时间
+  forceRelockTimeout = 3 * time.Second
+  forceRelockPoll    = 100 * time.Millisecond
+
+  // sharedLockLease 是共享文件系统上的锁的租约时长，持有者每隔 sharedLockHeartbeat 刷新一次
+  sharedLockLease     = 2 * time.Minute
+  sharedLockHeartbeat = 30 * time.Second
+
+  // besideLockSuffix 是放在被编辑文件旁边的锁文件后缀：.name.gomate-lock
+  besideLockSuffix = ".gomate-lock"
+)
+
+// errLockHeld 和 errLockUnsupported 由平台相关的 tryLockFile 返回，
+// 分别表示锁已被其他进程持有，以及所在文件系统不支持内核锁。
+var (
+  errLockHeld        = errors.New("lock held by another process")
+  errLockUnsupported = errors.New("file locking not supported")
+)
+
+// InstanceLock 是一个被当前进程持有的文件锁。
+// 锁由内核维护 (flock/LockFileEx)，进程崩溃时会自动释放，残留的锁文件不会阻止后续实例。
+type InstanceLock struct {
+  file         *os.File
+  path         string
+  location     lockLocation
+  kernelLocked bool // 为 false 时仅依靠锁文件内容 (文件系统不支持内核锁)
+  owner        LockOwner
+  emacsLink    string // 为 emacs 创建的 .#name 锁链接，没有时为空
+}
+
+// Path 返回锁文件路径。
+func (l *InstanceLock) Path() string {
+  return l.path
+}
+
+// ID 返回锁的标识：锁目录中的锁文件名，或放在文件旁边时锁文件路径的摘要。
+func (l *InstanceLock) ID() string {
+  if l.location.Beside {
+    return FileID{RealPath: l.path}.Hash()
+  }
+  return filepath.Base(l.path)
+}
+
+// SetEditor 在锁文件中记录编辑器地址，供 gomate locks 显示。
+func (l *InstanceLock) SetEditor(editor string) error {
+  l.owner.Editor = editor
+  return l.writeOwner()
+}
+
+// SetControl 在锁文件中记录控制套接字，其他实例据此请求重新激活、接管或关闭。
+func (l *InstanceLock) SetControl(path string) error {
+  l.owner.Control = path
+  return l.writeOwner()
+}
+
+// UpdateInode 在保存以新文件替换原文件之后，更新锁文件中记录的设备号和 inode。
+// 锁按路径命名，不需要迁移；这里只是让别名检查继续认出这个文件。
+func (l *InstanceLock) UpdateInode(id FileID) error {
+  if l.owner.Device == id.Device && l.owner.Inode == id.Inode {
+    return nil
+  }
+  l.owner.Device, l.owner.Inode = id.Device, id.Inode
+  return l.writeOwner()
+}
+
+// HeartbeatInterval 返回刷新租约的间隔，锁没有租约时返回 0。
+func (l *InstanceLock) HeartbeatInterval() time.Duration {
+  if l.location.Lease <= 0 {
+    return 0
+  }
+  return sharedLockHeartbeat
+}
+
+// Heartbeat 刷新锁文件中的心跳时间，让其他主机知道锁仍然有效。
+func (l *InstanceLock) Heartbeat() error {
+  l.owner.Heartbeat = time.Now().UTC()
+  return l.writeOwner()
+}
+
+// writeOwner 把持有者信息以 JSON 写入锁文件。
+func (l *InstanceLock) writeOwner() error {
+  content, err := json.Marshal(l.owner)
+  if err != nil {
+    return err
+  }
+  if runtime.GOOS == "windows" {
+    // Windows 不能替换仍被打开的文件，只能原地改写
+    return writeLockContent(l.file, string(content)+"\n")
+  }
+  content = append(content, '\n')
+  // 共享锁目录带有粘滞位，不能以重命名替换其他用户留下的锁文件 (例如接管其他用户崩溃后残留的锁)，
+  // 此时只能在持有内核锁的情况下原地改写
+  if !ownedByCurrentUser(l.file) {
+    return writeLockContent(l.file, string(content))
+  }
+  err = l.replaceOwner(content)
+  if errors.Is(err, fs.ErrPermission) {
+    slog.Debug("cannot replace lock file, rewriting it in place", "path", l.path, "error", err)
+    return writeLockContent(l.file, string(content))
+  }
+  return err
+}
+
+// replaceOwner 把 content 写入同一目录中的临时文件，再重命名为锁文件。其他主机 (以及不持有内核锁的读者)
+// 随时都只能读到完整的旧记录或新记录，不会在截断和写入之间看到空文件。
+// 持有内核锁时先锁住新文件再替换：此后打开锁文件路径的实例看到的是新文件，仍然会被挡住；
+// 此前打开了旧文件的实例在拿到旧文件的锁后会发现路径已被替换，从而重试。
+func (l *InstanceLock) replaceOwner(content []byte) error {
+  dir, name := filepath.Split(l.path)
+  tmp, err := os.CreateTemp(dir, "."+name+".tmp-")
+  if err != nil {
+    return err
+  }
+  discard := func(err error) error {
+    tmp.Close()
+    os.Remove(tmp.Name())
+    return err
+  }
+  if l.location.Shared {
+    if err := tmp.Chmod(0666); err != nil {
+      slog.Warn("failed to make lock file shareable", "path", tmp.Name(), "error", err)
+    }
+  }
+  if _, err := tmp.Write(content); err != nil {
+    return discard(err)
+  }
+  if err := tmp.Sync(); err != nil {
+    return discard(err)
+  }
+  if l.kernelLocked {
+    if err := tryLockFile(tmp); err != nil {
+      return discard(fmt.Errorf("error locking new lock file: %w", err))
+    }
+  }
+  if err := os.Rename(tmp.Name(), l.path); err != nil {
+    return discard(err)
+  }
+
+  previous := l.file
+  l.file = tmp
+  if l.kernelLocked {
+    unlockFile(previous)
+  }
+  previous.Close()
+  return nil
+}
+
+// Release 删除锁文件并释放内核锁。
+func (l *InstanceLock) Release() {
+  if l.emacsLink != "" {
+    removeEmacsLock(l.emacsLink, l.owner)
+  }
+
+  // 先删除再解锁：等待中的实例拿到锁后会发现路径已指向新文件，从而重新尝试。
+  // Windows 不允许删除仍被打开的文件，此时在关闭之后再删除一次。
+  removeErr := os.Remove(l.path)
+  if l.kernelLocked {
+    if err := unlockFile(l.file); err != nil {
+      slog.Warn("failed to unlock lock file", "path", l.path, "error", err)
+    }
+  }
+  if closeErr := l.file.Close(); closeErr != nil {
+    slog.Warn("failed to close lock file", "path", l.path, "error", closeErr)
+  }
+  if removeErr != nil && !os.IsNotExist(removeErr) {
+    if removeErr = os.Remove(l.path); removeErr != nil && !os.IsNotExist(removeErr) {
+      slog.Warn("failed to remove lock file", "path", l.path, "error", removeErr)
+    }
+  }
+  slog.Debug("lock released and lock file deleted", "path", l.path)
+}
+
+// lockDirCandidate 是一个候选锁目录。
+type lockDirCandidate struct {
+  Path string
+  // Shared 表示目录由多个用户共用，锁文件需要对其他用户可写，以便接管崩溃进程留下的锁
+  Shared bool
+}
+
+// lockLocation 描述锁文件存放的位置。
+type lockLocation struct {
+  Dir    string // 锁目录，Beside 为 true 时为空
+  Shared bool   // 锁文件需要对其他用户可写
+  // Beside 为 true 时，锁文件放在被编辑文件旁边 (.name.gomate-lock)
+  Beside bool
+  // Lease 大于 0 时锁带有租约，其他主机上的实例据此判断锁是否仍然有效
+  Lease time.Duration
+}
+
+// LockPath 返回 id 对应的锁文件路径。锁按真实路径命名，替换文件 (改变 inode) 的写入不会改变它。
+func (loc lockLocation) LockPath(id FileID) string {
+  if loc.Beside {
+    dir, name := filepath.Split(id.RealPath)
+    return filepath.Join(dir, "."+name+besideLockSuffix)
+  }
+  return filepath.Join(loc.Dir, id.Hash())
+}
+
+// findAliasLock 在锁目录中查找经由另一个路径 (硬链接或绑定挂载) 打开同一个文件、仍在运行的本机实例。
+// 放在文件旁边的锁无法这样查找。
+func (loc lockLocation) findAliasLock(id FileID, ownPath string) *LockHeldError {
+  if loc.Beside {
+    return nil
+  }
+  entries, err := listLocks(loc.Dir)
+  if err != nil {
+    slog.Warn("failed to check lock directory for aliases", "dir", loc.Dir, "file", id.RealPath, "error", err)
+    return nil
+  }
+  for _, e := range entries {
+    if e.Path == ownPath || e.Owner == nil || !e.Owner.Local() || e.Status != OwnerAlive {
+      continue
+    }
+    if e.Owner.File != id.RealPath && id.SameFile(e.Owner.Device, e.Owner.Inode) {
+      slog.Debug("file is already open under another name", "file", id.RealPath, "alias", e.Owner.File, "owner", e.Owner)
+      return &LockHeldError{Path: e.Path, Owner: e.Owner, Alias: e.Owner.File}
+    }
+  }
+  return nil
+}
+
+// resolveLockLocation 根据 -lock-beside/-shared-lock-dir 选择锁的位置，默认使用本机锁目录。
+func resolveLockLocation(beside bool, sharedDir string) (lockLocation, error) {
+  if beside {
+    return lockLocation{Shared: true, Beside: true, Lease: sharedLockLease}, nil
+  }
+  if sharedDir != "" {
+    dir := lockDirCandidate{Path: sharedDir, Shared: true}
+    if err := ensureLockDir(dir); err != nil {
+      return lockLocation{}, fmt.Errorf("shared lock directory %s unusable: %w", sharedDir, err)
+    }
+    return lockLocation{Dir: sharedDir, Shared: true, Lease: sharedLockLease}, nil
+  }
+  dir, err := lockDir()
+  if err != nil {
+    return lockLocation{}, err
+  }
+  return lockLocation{Dir: dir.Path, Shared: dir.Shared}, nil
+}
+
+// lockDir 返回可用的锁目录，必要时创建它。GOMATE_LOCK_DIR 优先于平台默认位置。
+func lockDir() (lockDirCandidate, error) {
+  candidates := defaultLockDirs()
+  if dir := os.Getenv("GOMATE_LOCK_DIR"); dir != "" {
+    candidates = []lockDirCandidate{{Path: dir}}
+  }
+
+  var lastErr error
+  for _, dir := range candidates {
+    if err := ensureLockDir(dir); err != nil {
+      slog.Debug("lock directory unusable", "dir", dir.Path, "error", err)
+      lastErr = err
+      continue
+    }
+    return dir, nil
+  }
+  if lastErr == nil {
+    lastErr = errors.New("no candidate directories")
+  }
+  return lockDirCandidate{}, fmt.Errorf("failed to find a usable lock directory: %w", lastErr)
+}
+
+// LockOptions 是 checkMultiInstance 的选项，对应 -f/-y/--foreign-locks/--emacs-lock 命令行参数。
+type LockOptions struct {
+  Force     bool
+  AssumeYes bool
+  Location  lockLocation
+  // ForeignLocks 决定发现 vim/emacs 的锁时警告、拒绝还是忽略
+  ForeignLocks string
+  // EmacsLock 为 true 时，在会话期间创建 emacs 风格的 .#name 锁链接
+  EmacsLock bool
+}
+
+// checkMultiInstance 为 filePath 获取实例锁，并检查 vim 和 emacs 是否也在编辑这个文件。
+// 文件正被另一个实例编辑时，返回的错误满足 errors.Is(err, ErrInstanceAlreadyRunning)；
+// 按 ForeignLocks 拒绝其他编辑器时返回 *ForeignLockError。
+func checkMultiInstance(filePath string, opts LockOptions) (*InstanceLock, error) {
+  lock, err := acquireInstanceLock(filePath, opts.Location, opts.Force, opts.AssumeYes)
+  if err != nil {
+    return nil, err
+  }
+
+  // 持有 gomate 锁之后再检查，这样其他 gomate 实例留下的 emacs 锁链接不会被误认为 emacs
+  if err := checkForeignLocks(lock.owner.File, opts.ForeignLocks, opts.Force); err != nil {
+    lock.Release()
+    return nil, err
+  }
+  if opts.EmacsLock {
+    lock.emacsLink = createEmacsLock(lock.owner.File, lock.owner)
+  }
+  return lock, nil
+}
+
+// acquireInstanceLock 为 filePath 获取 gomate 实例锁。锁被仍在运行的实例持有，或者另一个实例正经由
+// 硬链接或绑定挂载编辑同一个文件时，非强制模式返回 *LockHeldError (满足 errors.Is(err, ErrInstanceAlreadyRunning))；
+// 强制模式在确认后通过控制套接字请求持有者交出文件并重试。持有者已退出或 PID 已被复用的锁会被自动回收。
+func acquireInstanceLock(filePath string, loc lockLocation, force bool, assumeYes bool) (*InstanceLock, error) {
+  id, err := fileIdentity(filePath)
+  if err != nil {
+    return nil, err
+  }
+  absFilePath := id.RealPath
+  slog.Debug("file identity", "file", absFilePath, "device", fmt.Sprintf("%x", id.Device), "inode", fmt.Sprintf("%x", id.Inode))
+
+  lockFilePath := loc.LockPath(id)
+  slog.Debug("lock file path", "path", lockFilePath)
+
+  // 先取得按路径命名的锁，再检查别名：两个实例同时经由不同的路径打开时，至少有一个能看到另一个
+  tryAcquire := func() (*InstanceLock, error) {
+    lock, err := acquireLock(lockFilePath, loc, id)
+    if err != nil {
+      return nil, err
+    }
+    if aliasErr := loc.findAliasLock(id, lockFilePath); aliasErr != nil {
+      lock.Release()
+      return nil, aliasErr
+    }
+    return lock, nil
+  }
+
+  lock, err := tryAcquire()
+  var heldErr *LockHeldError
+  if !errors.As(err, &heldErr) {
+    return lock, err
+  }
+  slog.Debug("lock is held", "error", heldErr)
+
+  if !force {
+    return nil, err
+  }
+
+  // --- 强制模式启动 ---
+  // 只接管能够确认身份的本机实例，并且必须经过用户确认
+  owner := heldErr.Owner
+  if owner == nil {
+    return nil, fmt.Errorf("force mode failed: cannot identify the owner of %s", heldErr.Path)
+  }
+  if !owner.Local() {
+    return nil, fmt.Errorf("force mode failed: lock is held by %s on another host", owner)
+  }
+  switch status := owner.Status(); status {
+  case OwnerAlive:
+  default:
+    // 内核锁仍被持有，但记录的进程已不是持有者，不能随意终止
+    return nil, fmt.Errorf("force mode failed: lock is held, but recorded owner %s is %s", owner, status)
+  }
+
+  if !assumeYes && !confirm(fmt.Sprintf("%s is being edited by %s. Take it over?", absFilePath, owner)) {
+    return nil, fmt.Errorf("refusing to take over from running instance %s without confirmation (use -yes)", owner)
+  }
+
+  // 持有者先断开编辑器、释放锁，然后才应答；确认期间它也可能已经自行退出
+  if owner.Status() == OwnerAlive {
+    if err := sendControl(owner.Control, controlTakeover); err != nil {
+      return nil, fmt.Errorf("force mode failed: %s did not hand over %s: %w", owner, absFilePath, err)
+    }
+    slog.Info("file handed over", "file", absFilePath, "owner", owner)
+  }
+
+  // 旧实例退出前内核可能仍未释放它的锁，稍等片刻再重试
+  deadline := time.Now().Add(forceRelockTimeout)
+  for {
+    lock, err = tryAcquire()
+    if !errors.As(err, &heldErr) || time.Now().After(deadline) {
+      break
+    }
+    time.Sleep(forceRelockPoll)
+  }
+  if errors.As(err, &heldErr) {
+    return nil, fmt.Errorf("force mode failed: lock %s still held after takeover from PID %d", heldErr.Path, owner.PID)
+  }
+  return lock, err
+}
+
+// lockHeldBy 根据锁文件中记录的持有者判断锁是否仍被持有。
+// 拿到内核锁时本机的记录一定是残留的；但网络文件系统上的内核锁不一定在主机之间生效，
+// 其他主机上租约仍然有效的持有者必须被尊重。
+func lockHeldBy(owner *LockOwner, kernelLocked bool) bool {
+  status := owner.Status()
+  if kernelLocked {
+    return !owner.Local() && status == OwnerAlive
+  }
+  return status == OwnerAlive || status == OwnerUnknown
+}
+
+// acquireLock 打开 (或创建) 锁文件并尝试获取内核锁，成功后写入当前进程和被编辑文件的信息。
+// 文件系统不支持内核锁时，退回到根据锁文件中记录的持有者是否存活来判断。
+func acquireLock(lockFilePath string, loc lockLocation, id FileID) (*InstanceLock, error) {
+  for {
+    f, err := os.OpenFile(lockFilePath, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+    created := err == nil
+    if os.IsExist(err) {
+      // 残留的锁文件本身并不代表锁被持有，真正的判断依据是内核锁
+      f, err = os.OpenFile(lockFilePath, os.O_RDWR, 0)
+    }
+    if err != nil {
+      return nil, fmt.Errorf("error opening lock file: %w", err)
+    }
+    if created && loc.Shared {
+      // 不受 umask 影响，确保其他用户在本进程崩溃后能够接管这个锁文件
+      if err := f.Chmod(0666); err != nil {
+        slog.Warn("failed to make lock file shareable", "path", lockFilePath, "error", err)
+      }
+    }
+
+    kernelLocked := true
+    lockErr := tryLockFile(f)
+    switch {
+    case lockErr == nil:
+    case errors.Is(lockErr, errLockHeld):
+      f.Close()
+      owner, _ := readLockOwner(lockFilePath)
+      return nil, &LockHeldError{Path: lockFilePath, Owner: owner}
+    case errors.Is(lockErr, errLockUnsupported):
+      slog.Debug("kernel locks unsupported, falling back to owner liveness checks", "path", lockFilePath)
+      kernelLocked = false
+    default:
+      f.Close()
+      return nil, fmt.Errorf("error locking lock file: %w", lockErr)
+    }
+
+    // 拿到锁时，旧的持有者可能刚刚删除了这个文件；如果路径已不再指向我们锁住的文件，重新来过
+    held, statErr := f.Stat()
+    current, pathErr := os.Stat(lockFilePath)
+    if statErr != nil || pathErr != nil || !os.SameFile(held, current) {
+      slog.Debug("lock file was replaced while locking, retrying", "path", lockFilePath)
+      if kernelLocked {
+        unlockFile(f)
+      }
+      f.Close()
+      continue
+    }
+
+    // 锁文件中已有的记录来自已经退出的进程 (或无法使用内核锁时需要据此判断)
+    if !created {
+      previous, readErr := readLockOwner(lockFilePath)
+      switch {
+      case readErr == nil:
+        if lockHeldBy(previous, kernelLocked) {
+          if kernelLocked {
+            unlockFile(f)
+          }
+          f.Close()
+          return nil, &LockHeldError{Path: lockFilePath, Owner: previous}
+        }
+        slog.Info("reclaiming stale lock", "path", lockFilePath, "owner", previous, "status", previous.Status())
+      case !kernelLocked || loc.Lease > 0:
+        // 内核锁不可用或不一定在主机之间生效时，空的或不完整的锁文件可能刚由另一个实例创建、
+        // 尚未写入持有者，不能当作残留回收；超过租约仍未写入时才认为创建者已经崩溃
+        if unreadableLockHeld(f, loc) {
+          if kernelLocked {
+            unlockFile(f)
+          }
+          f.Close()
+          return nil, &LockHeldError{Path: lockFilePath}
+        }
+        slog.Info("reclaiming unreadable lock file older than the lease", "path", lockFilePath, "error", readErr)
+      }
+    }
+
+    lock := &InstanceLock{file: f, path: lockFilePath, location: loc, kernelLocked: kernelLocked, owner: currentLockOwner()}
+    lock.owner.File = id.RealPath
+    lock.owner.Device, lock.owner.Inode = id.Device, id.Inode
+    if loc.Lease > 0 {
+      lock.owner.Heartbeat = time.Now().UTC()
+      lock.owner.LeaseSeconds = int(loc.Lease / time.Second)
+    }
+    if err := lock.writeOwner(); err != nil {
+      if kernelLocked {
+        unlockFile(f)
+      }
+      f.Close()
+      os.Remove(lockFilePath)
+      return nil, fmt.Errorf("failed to write lock owner to lock file: %w", err)
+    }
+
+    slog.Debug("acquired lock", "path", lockFilePath, "owner", lock.owner)
+    return lock, nil
+  }
+}
+
+// releasePollInterval 是 waitForRelease 检查锁是否已被释放的间隔。
+const releasePollInterval = 500 * time.Millisecond
+
+// waitForRelease 阻塞到其他实例释放 filePath 的锁，或者 stop 收到信号 (此时返回该信号)。
+// 锁释放后短暂地获取一次再立即释放，以同样的规则判断残留和租约过期的锁。
+func waitForRelease(filePath string, loc lockLocation, stop <-chan os.Signal) (os.Signal, error) {
+  ticker := time.NewTicker(releasePollInterval)
+  defer ticker.Stop()
+  for {
+    select {
+    case sig := <-stop:
+      return sig, nil
+    case <-ticker.C:
+    }
+    lock, err := acquireInstanceLock(filePath, loc, false, false)
+    if err == nil {
+      lock.Release()
+      return nil, nil
+    }
+    if !errors.Is(err, ErrInstanceAlreadyRunning) {
+      return nil, err
+    }
+  }
+}
+
+// unreadableLockHeld 报告无法解析的锁文件是否仍应视为被持有：最后修改时间在租约 (另加时钟偏差余量) 之内。
+// 没有租约的位置按共享锁的租约计算。
+func unreadableLockHeld(f *os.File, loc lockLocation) bool {
+  st, err := f.Stat()
+  if err != nil {
+    return true
+  }
+  lease := loc.Lease
+  if lease <= 0 {
+    lease = sharedLockLease
+  }
+  return time.Since(st.ModTime()) < lease+leaseClockSkew
+}
+
+// writeLockContent 用 content 覆盖锁文件的内容。
+func writeLockContent(f *os.File, content string) error {
+  if err := f.Truncate(0); err != nil {
+    return err
+  }
+  if _, err := f.WriteAt([]byte(content), 0); err != nil {
+    return err
+  }
+  return f.Sync()
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+  "errors"
+  "os"
+  "path/filepath"
+  "runtime"
+  "testing"
+  "time"
+)
+
+// replaceFile 像 sed -i 一样写入临时文件再重命名，使文件得到新的 inode。
+func replaceFile(t *testing.T, path string, content string) {
+  t.Helper()
+  tmp := path + ".tmp"
+  if err := os.WriteFile(tmp, []byte(content), 0644); err != nil {
+    t.Fatal(err)
+  }
+  if err := os.Rename(tmp, path); err != nil {
+    t.Fatal(err)
+  }
+}
+
+func TestLockSurvivesFileReplacement(t *testing.T) {
+  dir := t.TempDir()
+  file := filepath.Join(dir, "notes.txt")
+  if err := os.WriteFile(file, []byte("one\n"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  loc := lockLocation{Dir: t.TempDir()}
+
+  lock, err := acquireInstanceLock(file, loc, false, false)
+  if err != nil {
+    t.Fatalf("first lock: %v", err)
+  }
+  defer lock.Release()
+
+  before, _ := fileIdentity(file)
+  replaceFile(t, file, "two\n")
+  after, _ := fileIdentity(file)
+  if before.Inode == after.Inode && before.Device == after.Device {
+    t.Skip("file system reused the inode")
+  }
+
+  // 替换之后路径不变，第二个实例仍然必须发现文件已被打开
+  second, err := acquireInstanceLock(file, loc, false, false)
+  if err == nil {
+    second.Release()
+    t.Fatal("second lock acquired after the file was replaced")
+  }
+  if !errors.Is(err, ErrInstanceAlreadyRunning) {
+    t.Fatalf("second lock: %v, want ErrInstanceAlreadyRunning", err)
+  }
+  if got, want := lock.Path(), loc.LockPath(after); got != want {
+    t.Errorf("lock path %s changed to %s after replacement", got, want)
+  }
+}
+
+func TestLockDetectsHardLinkAlias(t *testing.T) {
+  dir := t.TempDir()
+  file := filepath.Join(dir, "a.txt")
+  link := filepath.Join(dir, "b.txt")
+  if err := os.WriteFile(file, []byte("shared\n"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  if err := os.Link(file, link); err != nil {
+    t.Skipf("hard links unsupported: %v", err)
+  }
+  loc := lockLocation{Dir: t.TempDir()}
+
+  lock, err := acquireInstanceLock(file, loc, false, false)
+  if err != nil {
+    t.Fatalf("lock via %s: %v", file, err)
+  }
+
+  _, err = acquireInstanceLock(link, loc, false, false)
+  var heldErr *LockHeldError
+  if !errors.As(err, &heldErr) {
+    t.Fatalf("lock via hard link: %v, want *LockHeldError", err)
+  }
+  realFile, _ := filepath.EvalSymlinks(file)
+  if heldErr.Alias != realFile {
+    t.Errorf("alias = %q, want %q", heldErr.Alias, realFile)
+  }
+  // 被拒绝的实例不留下锁文件
+  linkID, _ := fileIdentity(link)
+  if _, statErr := os.Stat(loc.LockPath(linkID)); !os.IsNotExist(statErr) {
+    t.Errorf("refused instance left %s behind: %v", loc.LockPath(linkID), statErr)
+  }
+
+  // 持有者退出之后，经由硬链接可以正常打开
+  lock.Release()
+  second, err := acquireInstanceLock(link, loc, false, false)
+  if err != nil {
+    t.Fatalf("lock via hard link after release: %v", err)
+  }
+  second.Release()
+}
+
+func TestFileIDKeyIgnoresInode(t *testing.T) {
+  a := FileID{RealPath: "/srv/notes.txt", Device: 1, Inode: 10}
+  b := FileID{RealPath: "/srv/notes.txt", Device: 1, Inode: 11}
+  if a.Key() != b.Key() || a.Hash() != b.Hash() {
+    t.Errorf("replaced file got a new key: %s vs %s", a.Key(), b.Key())
+  }
+  if !a.SameFile(1, 10) || a.SameFile(1, 11) {
+    t.Error("SameFile does not compare device and inode")
+  }
+  if (FileID{RealPath: "/srv/new.txt"}).SameFile(0, 0) {
+    t.Error("a file that does not exist yet matched an empty device/inode")
+  }
+}
+
+func TestUnreadableLeaseLockIsHeld(t *testing.T) {
+  dir := t.TempDir()
+  file := filepath.Join(dir, "notes.txt")
+  if err := os.WriteFile(file, []byte("one\n"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  loc := lockLocation{Dir: t.TempDir(), Lease: sharedLockLease}
+  id, err := fileIdentity(file)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  // 另一台主机刚刚创建了锁文件，还没有写入持有者
+  lockPath := loc.LockPath(id)
+  if err := os.WriteFile(lockPath, nil, 0644); err != nil {
+    t.Fatal(err)
+  }
+  if lock, err := acquireInstanceLock(file, loc, false, false); err == nil {
+    lock.Release()
+    t.Fatal("acquired a lease lock whose owner record is still being written")
+  } else if !errors.Is(err, ErrInstanceAlreadyRunning) {
+    t.Fatalf("lock: %v, want ErrInstanceAlreadyRunning", err)
+  }
+
+  // 超过租约仍然为空，说明创建者已经崩溃
+  old := time.Now().Add(-2 * (sharedLockLease + leaseClockSkew))
+  if err := os.Chtimes(lockPath, old, old); err != nil {
+    t.Fatal(err)
+  }
+  lock, err := acquireInstanceLock(file, loc, false, false)
+  if err != nil {
+    t.Fatalf("stale unreadable lock not reclaimed: %v", err)
+  }
+  lock.Release()
+}
+
+func TestHeartbeatReplacesOwnerAtomically(t *testing.T) {
+  dir := t.TempDir()
+  file := filepath.Join(dir, "notes.txt")
+  if err := os.WriteFile(file, []byte("one\n"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  loc := lockLocation{Dir: t.TempDir(), Lease: sharedLockLease}
+
+  lock, err := acquireInstanceLock(file, loc, false, false)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer lock.Release()
+
+  before, err := os.Stat(lock.Path())
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := lock.Heartbeat(); err != nil {
+    t.Fatalf("Heartbeat: %v", err)
+  }
+  after, err := os.Stat(lock.Path())
+  if err != nil {
+    t.Fatal(err)
+  }
+  if runtime.GOOS != "windows" && os.SameFile(before, after) {
+    t.Error("heartbeat rewrote the owner record in place")
+  }
+  if owner, err := readLockOwner(lock.Path()); err != nil || owner.PID != os.Getpid() {
+    t.Errorf("owner after heartbeat = %v, %v", owner, err)
+  }
+  entries, err := os.ReadDir(loc.Dir)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(entries) != 1 {
+    t.Errorf("lock directory holds %d entries, want only the lock file", len(entries))
+  }
+
+  // 替换后的锁文件仍然挡住第二个实例
+  if second, err := acquireInstanceLock(file, loc, false, false); err == nil {
+    second.Release()
+    t.Fatal("second lock acquired after the owner record was replaced")
+  }
+}
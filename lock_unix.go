@@ -0,0 +1,112 @@
+//go:build unix
+
+package main
+
+import (
+  "errors"
+  "fmt"
+  "os"
+  "path/filepath"
+  "syscall"
+)
+
+// sharedLockDir 位于所有用户共享的 /run/lock (tmpfs，权限 1777)，重启后自动清空
+const sharedLockDir = "/run/lock/gomate"
+
+// defaultLockDirs 按优先级列出 Unix 上的候选锁目录：
+// 共享的 /run/lock，其次是用户私有的 $XDG_RUNTIME_DIR，最后是临时目录。
+func defaultLockDirs() []lockDirCandidate {
+  var dirs []lockDirCandidate
+  if st, err := os.Stat(filepath.Dir(sharedLockDir)); err == nil && st.IsDir() {
+    dirs = append(dirs, lockDirCandidate{Path: sharedLockDir, Shared: true})
+  }
+  if xdg := os.Getenv("XDG_RUNTIME_DIR"); xdg != "" {
+    dirs = append(dirs, lockDirCandidate{Path: filepath.Join(xdg, "gomate")})
+  }
+  dirs = append(dirs, lockDirCandidate{Path: filepath.Join(os.TempDir(), fmt.Sprintf("gomate-%d", os.Getuid()))})
+  return dirs
+}
+
+// ensureLockDir 创建锁目录并检查当前用户是否可写。用户私有的目录由 ensurePrivateDir 检查。
+func ensureLockDir(dir lockDirCandidate) error {
+  if !dir.Shared {
+    return ensurePrivateDir(dir.Path)
+  }
+  perm := 0777 | os.ModeSticky
+
+  if _, err := os.Stat(dir.Path); os.IsNotExist(err) {
+    if err := os.MkdirAll(dir.Path, perm); err != nil {
+      return err
+    }
+    // MkdirAll 受 umask 影响，需要显式设置权限
+    if err := os.Chmod(dir.Path, perm); err != nil {
+      return err
+    }
+  } else if err != nil {
+    return err
+  }
+
+  // W_OK | X_OK
+  return syscall.Access(dir.Path, 0x2|0x1)
+}
+
+// ensurePrivateDir 创建只有当前用户可以访问的目录 (0700)。目录已经存在时，它必须是当前用户拥有的
+// 真实目录 (不是符号链接)，且组和其他用户没有任何权限：/tmp 下的路径可以被其他用户抢先创建，
+// 借此冒充其中的控制套接字，或者把锁文件替换为指向用户文件的符号链接。
+func ensurePrivateDir(path string) error {
+  if err := os.MkdirAll(path, 0700); err != nil {
+    return err
+  }
+  st, err := os.Lstat(path)
+  if err != nil {
+    return err
+  }
+  if !st.IsDir() {
+    return fmt.Errorf("%s is not a directory", path)
+  }
+  sys, ok := st.Sys().(*syscall.Stat_t)
+  if !ok {
+    return fmt.Errorf("unexpected stat type %T", st.Sys())
+  }
+  if uid := os.Getuid(); int(sys.Uid) != uid {
+    return fmt.Errorf("%s is owned by uid %d, not by the current user (uid %d)", path, sys.Uid, uid)
+  }
+  if perm := st.Mode().Perm(); perm&0077 != 0 {
+    return fmt.Errorf("%s has mode %04o, other users must not have access (want 0700)", path, perm)
+  }
+  return nil
+}
+
+// ownedByCurrentUser 报告 f 是否属于当前用户。
+func ownedByCurrentUser(f *os.File) bool {
+  st, err := f.Stat()
+  return err == nil && statOwnedByCurrentUser(st)
+}
+
+// controlSocketOwned 报告 st 是否是属于当前用户的套接字。
+func controlSocketOwned(st os.FileInfo) bool {
+  return st.Mode().Type() == os.ModeSocket && statOwnedByCurrentUser(st)
+}
+
+func statOwnedByCurrentUser(st os.FileInfo) bool {
+  sys, ok := st.Sys().(*syscall.Stat_t)
+  return ok && int(sys.Uid) == os.Getuid()
+}
+
+// tryLockFile 以非阻塞方式获取 f 上的排他 flock 锁，进程退出时内核会自动释放。
+func tryLockFile(f *os.File) error {
+  err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+  switch {
+  case errors.Is(err, syscall.EWOULDBLOCK):
+    return errLockHeld
+  case errors.Is(err, syscall.ENOLCK), errors.Is(err, syscall.EOPNOTSUPP), errors.Is(err, syscall.EINVAL):
+    // 部分网络文件系统不支持 flock
+    return errLockUnsupported
+  }
+  return err
+}
+
+// unlockFile 释放 f 上的 flock 锁。
+func unlockFile(f *os.File) error {
+  return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,167 @@
+//go:build unix
+
+package main
+
+import (
+  "os"
+  "path/filepath"
+  "strings"
+  "syscall"
+  "testing"
+)
+
+func TestEnsurePrivateDir(t *testing.T) {
+  base := t.TempDir()
+
+  created := filepath.Join(base, "new", "gomate")
+  if err := ensurePrivateDir(created); err != nil {
+    t.Fatalf("ensurePrivateDir(new) = %v", err)
+  }
+  if st, err := os.Stat(created); err != nil || st.Mode().Perm() != 0700 {
+    t.Fatalf("created directory mode = %v, %v; want 0700", st.Mode().Perm(), err)
+  }
+  // 已经存在的私有目录可以直接使用
+  if err := ensurePrivateDir(created); err != nil {
+    t.Errorf("ensurePrivateDir(existing) = %v", err)
+  }
+
+  open := filepath.Join(base, "open")
+  if err := os.Mkdir(open, 0700); err != nil {
+    t.Fatal(err)
+  }
+  if err := os.Chmod(open, 0755); err != nil {
+    t.Fatal(err)
+  }
+  if err := ensurePrivateDir(open); err == nil || !strings.Contains(err.Error(), "0700") {
+    t.Errorf("ensurePrivateDir(0755) = %v, want a mode error", err)
+  }
+
+  // 指向私有目录的符号链接同样被拒绝：链接本身可能属于其他用户
+  link := filepath.Join(base, "link")
+  if err := os.Symlink(created, link); err != nil {
+    t.Fatal(err)
+  }
+  if err := ensurePrivateDir(link); err == nil {
+    t.Error("ensurePrivateDir(symlink) succeeded")
+  }
+
+  file := filepath.Join(base, "file")
+  if err := os.WriteFile(file, nil, 0600); err != nil {
+    t.Fatal(err)
+  }
+  if err := ensurePrivateDir(file); err == nil {
+    t.Error("ensurePrivateDir(regular file) succeeded")
+  }
+}
+
+func TestControlDirRejectsForeignFallback(t *testing.T) {
+  // $XDG_RUNTIME_DIR 不可用时退回到 $TMPDIR/gomate-<uid>；权限过宽的目录不能存放控制套接字
+  tmp := t.TempDir()
+  t.Setenv("XDG_RUNTIME_DIR", "")
+  t.Setenv("TMPDIR", tmp)
+
+  dirs := defaultLockDirs()
+  fallback := dirs[len(dirs)-1].Path
+  if err := os.Mkdir(fallback, 0777); err != nil {
+    t.Fatal(err)
+  }
+  if err := os.Chmod(fallback, 0777); err != nil {
+    t.Fatal(err)
+  }
+  if dir, err := controlDir(); err == nil {
+    t.Fatalf("controlDir() = %s, want an error for a world-writable %s", dir, fallback)
+  }
+
+  if err := os.Chmod(fallback, 0700); err != nil {
+    t.Fatal(err)
+  }
+  dir, err := controlDir()
+  if err != nil {
+    t.Fatalf("controlDir() = %v", err)
+  }
+  if want := filepath.Join(fallback, "control"); dir != want {
+    t.Errorf("controlDir() = %s, want %s", dir, want)
+  }
+}
+
+func TestRecoveryDirIsPrivate(t *testing.T) {
+  // 默认的恢复目录以 0700 权限创建
+  state := t.TempDir()
+  t.Setenv("GOMATE_RECOVERY_DIR", "")
+  t.Setenv("XDG_STATE_HOME", state)
+  dir, err := recoveryDir()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if want := filepath.Join(state, "gomate", "recovery"); dir != want {
+    t.Errorf("recoveryDir = %s, want %s", dir, want)
+  }
+  if st, err := os.Stat(dir); err != nil || st.Mode().Perm() != 0700 {
+    t.Errorf("recovery directory mode = %v, %v; want 0700", st.Mode().Perm(), err)
+  }
+
+  // 其他用户可以访问的目录不会用来保存恢复文件，也不会退回到系统临时目录
+  shared := filepath.Join(t.TempDir(), "shared")
+  if err := os.Mkdir(shared, 0700); err != nil {
+    t.Fatal(err)
+  }
+  if err := os.Chmod(shared, 0777); err != nil {
+    t.Fatal(err)
+  }
+  t.Setenv("GOMATE_RECOVERY_DIR", shared)
+  if dir, err := recoveryDir(); err == nil {
+    t.Errorf("recoveryDir = %s, want an error for a world-writable directory", dir)
+  }
+}
+
+func TestReclaimLockOwnedByAnotherUser(t *testing.T) {
+  if os.Getuid() != 0 {
+    t.Skip("needs root to create a lock file owned by another user")
+  }
+  const otherUID = 1000
+  // 与 /run/lock/gomate 相同，共享锁目录带有粘滞位
+  locks := t.TempDir()
+  if err := os.Chmod(locks, 0777|os.ModeSticky); err != nil {
+    t.Fatal(err)
+  }
+  loc := lockLocation{Dir: locks, Shared: true}
+  file := filepath.Join(t.TempDir(), "notes.txt")
+  if err := os.WriteFile(file, []byte("one\n"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  id, err := fileIdentity(file)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  // 另一个用户的会话崩溃后留下的锁文件：其中的 PID 已经不存在，内核锁也已释放
+  path := loc.LockPath(id)
+  stale := `{"pid":2147483646,"user":"other","file":"` + id.RealPath + `"}` + "\n"
+  if err := os.WriteFile(path, []byte(stale), 0666); err != nil {
+    t.Fatal(err)
+  }
+  if err := os.Chown(path, otherUID, otherUID); err != nil {
+    t.Fatal(err)
+  }
+
+  lock, err := acquireInstanceLock(file, loc, false, false)
+  if err != nil {
+    t.Fatalf("reclaiming another user's stale lock: %v", err)
+  }
+  defer lock.Release()
+  if err := lock.Heartbeat(); err != nil {
+    t.Fatalf("Heartbeat: %v", err)
+  }
+
+  // 记录原地改写，锁文件仍属于原来的用户；粘滞位目录中的其他用户无法以重命名替换它
+  st, err := os.Stat(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if uid := st.Sys().(*syscall.Stat_t).Uid; uid != otherUID {
+    t.Errorf("lock file owned by uid %d after reclaiming, want it rewritten in place (uid %d)", uid, otherUID)
+  }
+  if owner, err := readLockOwner(path); err != nil || owner.PID != os.Getpid() {
+    t.Errorf("owner after reclaiming = %v, %v", owner, err)
+  }
+}
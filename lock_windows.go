@@ -0,0 +1,98 @@
+//go:build windows
+
+package main
+
+import (
+  "os"
+  "path/filepath"
+  "syscall"
+  "unsafe"
+)
+
+var (
+  modkernel32      = syscall.NewLazyDLL("kernel32.dll")
+  procLockFileEx   = modkernel32.NewProc("LockFileEx")
+  procUnlockFileEx = modkernel32.NewProc("UnlockFileEx")
+)
+
+const (
+  lockfileFailImmediately = 0x00000001
+  lockfileExclusiveLock   = 0x00000002
+
+  errorInvalidFunction = syscall.Errno(1)
+  errorLockViolation   = syscall.Errno(33)
+  errorNotSupported    = syscall.Errno(50)
+
+  // 锁定文件末尾之外的区域：LockFileEx 是强制锁，锁住内容本身会让其他实例无法读取 PID
+  lockRegionOffsetHigh = 0x7fffffff
+)
+
+// defaultLockDirs 返回 Windows 上的候选锁目录：所有用户共享的 %ProgramData%\GomateLocks，
+// 其次是用户私有的 %LOCALAPPDATA%\GomateLocks。
+func defaultLockDirs() []lockDirCandidate {
+  var dirs []lockDirCandidate
+  if programData := lookupEnv("ProgramData", "ALLUSERSPROFILE"); programData != "" {
+    dirs = append(dirs, lockDirCandidate{Path: filepath.Join(programData, "GomateLocks"), Shared: true})
+  }
+  if local := os.Getenv("LOCALAPPDATA"); local != "" {
+    dirs = append(dirs, lockDirCandidate{Path: filepath.Join(local, "GomateLocks")})
+  }
+  dirs = append(dirs, lockDirCandidate{Path: filepath.Join(os.TempDir(), "GomateLocks")})
+  return dirs
+}
+
+// ensureLockDir 创建锁目录并确认可以在其中创建文件。
+func ensureLockDir(dir lockDirCandidate) error {
+  if err := os.MkdirAll(dir.Path, 0755); err != nil {
+    return err
+  }
+  probe, err := os.CreateTemp(dir.Path, ".probe-")
+  if err != nil {
+    return err
+  }
+  probe.Close()
+  return os.Remove(probe.Name())
+}
+
+// ensurePrivateDir 创建用户私有的目录。Windows 上的候选目录 (%LOCALAPPDATA%、%TEMP%) 本身
+// 位于用户配置文件中，由其 ACL 保护，因此与 ensureLockDir 相同，只确认可以在其中创建文件。
+func ensurePrivateDir(path string) error {
+  return ensureLockDir(lockDirCandidate{Path: path})
+}
+
+// ownedByCurrentUser 在 Windows 上总是返回 true：锁文件在 Windows 上总是原地改写，不需要区分所有者。
+func ownedByCurrentUser(f *os.File) bool {
+  return true
+}
+
+// controlSocketOwned 在 Windows 上只确认 st 不是目录：控制目录位于用户配置文件中，由其 ACL 保护。
+func controlSocketOwned(st os.FileInfo) bool {
+  return !st.IsDir()
+}
+
+// tryLockFile 以非阻塞方式通过 LockFileEx 获取排他锁，进程退出时系统会自动释放。
+func tryLockFile(f *os.File) error {
+  ol := syscall.Overlapped{OffsetHigh: lockRegionOffsetHigh}
+  r1, _, err := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+  if r1 == 0 {
+    switch err {
+    case errorLockViolation, syscall.ERROR_IO_PENDING:
+      return errLockHeld
+    case errorNotSupported, errorInvalidFunction:
+      // 部分网络共享不支持字节范围锁
+      return errLockUnsupported
+    }
+    return err
+  }
+  return nil
+}
+
+// unlockFile 释放 tryLockFile 获取的锁。
+func unlockFile(f *os.File) error {
+  ol := syscall.Overlapped{OffsetHigh: lockRegionOffsetHigh}
+  r1, _, err := procUnlockFileEx.Call(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+  if r1 == 0 {
+    return err
+  }
+  return nil
+}
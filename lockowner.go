@@ -0,0 +1,194 @@
+package main
+
+import (
+  "bufio"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log/slog"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+
+  "golang.org/x/term"
+)
+
+const (
+  // startTimeTolerance 是比较进程启动时间时允许的误差 (不同平台的精度不同)
+  startTimeTolerance = 2 * time.Second
+  // leaseClockSkew 是判断其他主机的租约是否过期时，为主机间时钟偏差留出的余量
+  leaseClockSkew = 30 * time.Second
+)
+
+// LockOwner 记录持有锁的进程信息，以 JSON 形式写入锁文件。
+type LockOwner struct {
+  PID        int       `json:"pid"`
+  StartTime  time.Time `json:"start_time,omitempty"` // 进程启动时间，用于识别 PID 复用
+  Executable string    `json:"executable,omitempty"`
+  User       string    `json:"user,omitempty"`
+  Hostname   string    `json:"hostname,omitempty"`
+  File       string    `json:"file,omitempty"`    // 被编辑文件的绝对路径
+  Editor     string    `json:"editor,omitempty"`  // 编辑器地址，连接建立后写入
+  Control    string    `json:"control,omitempty"` // 控制套接字，用于重新激活、接管和关闭
+
+  // 被编辑文件的设备号和 inode，同一台主机上的实例据此发现经由硬链接或绑定挂载打开的同一个文件
+  Device uint64 `json:"device,omitempty"`
+  Inode  uint64 `json:"inode,omitempty"`
+
+  // 共享文件系统上的锁带有租约：持有者定期刷新 Heartbeat，其他主机据此判断锁是否仍然有效
+  Heartbeat    time.Time `json:"heartbeat,omitempty"`
+  LeaseSeconds int       `json:"lease_seconds,omitempty"`
+}
+
+// OwnerStatus 是对锁持有者的存活判断。
+type OwnerStatus int
+
+const (
+  OwnerAlive   OwnerStatus = iota // 进程仍在运行，且启动时间与记录一致
+  OwnerDead                       // 进程已不存在
+  OwnerReused                     // PID 已被另一个进程复用
+  OwnerUnknown                    // 在其他主机上，且没有租约，无法判断
+  OwnerExpired                    // 在其他主机上，租约已过期 (持有者崩溃或失去连接)
+)
+
+func (s OwnerStatus) String() string {
+  switch s {
+  case OwnerAlive:
+    return "alive"
+  case OwnerDead:
+    return "dead"
+  case OwnerReused:
+    return "pid reused"
+  case OwnerExpired:
+    return "lease expired"
+  default:
+    return "unknown"
+  }
+}
+
+// currentLockOwner 描述当前进程。
+func currentLockOwner() LockOwner {
+  owner := LockOwner{PID: os.Getpid(), User: currentUserName()}
+  if start, err := processStartTime(owner.PID); err == nil {
+    owner.StartTime = start
+  } else {
+    slog.Warn("failed to read own process start time", "error", err)
+  }
+  if exe, err := os.Executable(); err == nil {
+    owner.Executable = exe
+  }
+  owner.Hostname, _ = os.Hostname()
+  return owner
+}
+
+func (o LockOwner) String() string {
+  var sb strings.Builder
+  fmt.Fprintf(&sb, "PID %d", o.PID)
+  if o.User != "" || o.Hostname != "" {
+    fmt.Fprintf(&sb, " (%s@%s)", o.User, o.Hostname)
+  }
+  if !o.StartTime.IsZero() {
+    fmt.Fprintf(&sb, ", started %s", o.StartTime.Format(time.DateTime))
+  }
+  if o.Executable != "" {
+    fmt.Fprintf(&sb, ", %s", o.Executable)
+  }
+  return sb.String()
+}
+
+// Local 报告持有者是否在本机上。
+func (o LockOwner) Local() bool {
+  host, _ := os.Hostname()
+  return o.Hostname == "" || strings.EqualFold(o.Hostname, host)
+}
+
+// Status 检查锁持有者是否仍然存活。其他主机上的持有者只能根据租约判断。
+func (o LockOwner) Status() OwnerStatus {
+  if !o.Local() {
+    if o.Heartbeat.IsZero() || o.LeaseSeconds <= 0 {
+      return OwnerUnknown
+    }
+    lease := time.Duration(o.LeaseSeconds) * time.Second
+    if time.Since(o.Heartbeat) > lease+leaseClockSkew {
+      return OwnerExpired
+    }
+    return OwnerAlive
+  }
+  if o.PID <= 0 || !processAlive(o.PID) {
+    return OwnerDead
+  }
+  if o.StartTime.IsZero() {
+    // 旧版本的锁文件只有 PID，无法识别复用
+    return OwnerAlive
+  }
+  start, err := processStartTime(o.PID)
+  if err != nil {
+    if !processAlive(o.PID) {
+      return OwnerDead
+    }
+    return OwnerAlive
+  }
+  if diff := start.Sub(o.StartTime); diff > startTimeTolerance || diff < -startTimeTolerance {
+    return OwnerReused
+  }
+  return OwnerAlive
+}
+
+// parseLockOwner 解析锁文件内容，兼容旧版本只写入 PID 的格式。
+func parseLockOwner(content []byte) (*LockOwner, error) {
+  text := strings.TrimSpace(string(content))
+  if text == "" {
+    return nil, errors.New("empty lock file")
+  }
+  if pid, err := strconv.Atoi(text); err == nil {
+    return &LockOwner{PID: pid}, nil
+  }
+  var owner LockOwner
+  if err := json.Unmarshal([]byte(text), &owner); err != nil {
+    return nil, fmt.Errorf("invalid lock file content: %w", err)
+  }
+  return &owner, nil
+}
+
+// readLockOwner 读取锁文件中记录的持有者。
+func readLockOwner(path string) (*LockOwner, error) {
+  content, err := os.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  return parseLockOwner(content)
+}
+
+// LockHeldError 表示锁被另一个仍在运行 (或无法确认已退出) 的实例持有。
+type LockHeldError struct {
+  Path  string
+  Owner *LockOwner // 无法读取锁文件时为 nil
+  Alias string     // 持有者经由另一个路径 (硬链接或绑定挂载) 编辑同一个文件时，为该路径
+}
+
+func (e *LockHeldError) Error() string {
+  if e.Owner == nil {
+    return fmt.Sprintf("lock %s is held by another instance", e.Path)
+  }
+  if e.Alias != "" {
+    return fmt.Sprintf("the same file is open as %s by %s", e.Alias, e.Owner)
+  }
+  return fmt.Sprintf("lock %s is held by %s", e.Path, e.Owner)
+}
+
+// Is 让 errors.Is(err, ErrInstanceAlreadyRunning) 继续适用。
+func (e *LockHeldError) Is(target error) bool {
+  return target == ErrInstanceAlreadyRunning
+}
+
+// confirm 在终端上询问用户，stdin 不是终端时返回 false。
+func confirm(prompt string) bool {
+  if !term.IsTerminal(int(os.Stdin.Fd())) {
+    return false
+  }
+  fmt.Fprintf(os.Stderr, "%s [y/N] ", prompt)
+  answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+  answer = strings.ToLower(strings.TrimSpace(answer))
+  return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "text/tabwriter"
+  "time"
+)
+
+// lockIDWidth 是 gomate locks list 中显示的锁 ID 长度，命令行上可以使用任意唯一的前缀
+const lockIDWidth = 12
+
+const locksUsage = `Usage: gomate locks <command> [options]
+
+Commands:
+  list                       List the files being edited and who holds them
+  show <file|lock-id>        Show the full metadata of one lock
+  clear --stale              Remove every lock whose owner has exited
+  clear <file|lock-id>...    Remove the given locks if no running instance holds them
+
+Options:
+  --shared-lock-dir DIR      Use the shared lock directory DIR (default: $GOMATE_SHARED_LOCK_DIR)
+  --lock-beside              Look for locks beside the files (show and clear <file> only)
+`
+
+// lockEntry 是锁目录中的一个锁文件。
+type lockEntry struct {
+  ID     string
+  Path   string
+  Owner  *LockOwner // 锁文件无法解析时为 nil
+  Err    error
+  Status OwnerStatus
+}
+
+// StatusText 返回用于显示的持有者状态。
+func (e lockEntry) StatusText() string {
+  if e.Owner == nil {
+    return "unknown"
+  }
+  return e.Status.String()
+}
+
+// readLockEntry 读取并检查一个锁文件。
+func readLockEntry(path string) lockEntry {
+  e := lockEntry{ID: filepath.Base(path), Path: path, Status: OwnerUnknown}
+  e.Owner, e.Err = readLockOwner(path)
+  if e.Owner != nil {
+    e.Status = e.Owner.Status()
+  }
+  return e
+}
+
+// listLocks 列出锁目录中的所有锁文件，按被编辑的文件排序。
+func listLocks(dir string) ([]lockEntry, error) {
+  files, err := os.ReadDir(dir)
+  if err != nil {
+    return nil, err
+  }
+  var entries []lockEntry
+  for _, f := range files {
+    // 跳过子目录以及 ensureLockDir 留下的探测文件
+    if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+      continue
+    }
+    entries = append(entries, readLockEntry(filepath.Join(dir, f.Name())))
+  }
+  sort.Slice(entries, func(i, j int) bool {
+    a, b := entries[i], entries[j]
+    if a.Owner != nil && b.Owner != nil && a.Owner.File != b.Owner.File {
+      return a.Owner.File < b.Owner.File
+    }
+    return a.ID < b.ID
+  })
+  return entries, nil
+}
+
+// resolveLock 把命令行参数 (被编辑的文件或锁 ID 前缀) 解析为锁文件路径。
+func resolveLock(loc lockLocation, arg string) (string, error) {
+  // 首先按文件路径查找
+  if id, err := fileIdentity(arg); err == nil {
+    path := loc.LockPath(id)
+    if _, err := os.Stat(path); err == nil {
+      return path, nil
+    }
+  }
+  if loc.Beside {
+    return "", fmt.Errorf("no lock found for %s", arg)
+  }
+  dir := loc.Dir
+
+  // 其次按锁 ID 前缀查找
+  files, err := os.ReadDir(dir)
+  if err != nil {
+    return "", err
+  }
+  var matches []string
+  for _, f := range files {
+    if !f.IsDir() && strings.HasPrefix(f.Name(), strings.ToLower(arg)) {
+      matches = append(matches, f.Name())
+    }
+  }
+  switch len(matches) {
+  case 0:
+    return "", fmt.Errorf("no lock found for %s", arg)
+  case 1:
+    return filepath.Join(dir, matches[0]), nil
+  }
+  return "", fmt.Errorf("lock ID %q is ambiguous (%d matches)", arg, len(matches))
+}
+
+// clearLock 删除一个锁文件。删除前先取得它的内核锁，确保不会误删正在运行的实例持有的锁。
+func clearLock(path string) error {
+  f, err := os.OpenFile(path, os.O_RDWR, 0)
+  if err != nil {
+    return err
+  }
+
+  kernelLocked := true
+  lockErr := tryLockFile(f)
+  switch {
+  case lockErr == nil:
+  case errors.Is(lockErr, errLockHeld):
+    f.Close()
+    owner, _ := readLockOwner(path)
+    return &LockHeldError{Path: path, Owner: owner}
+  case errors.Is(lockErr, errLockUnsupported):
+    // 只能根据记录的持有者判断
+    kernelLocked = false
+  default:
+    f.Close()
+    return fmt.Errorf("error locking lock file: %w", lockErr)
+  }
+
+  // 只能根据记录的持有者判断，或者持有者在其他主机上
+  if owner, err := readLockOwner(path); err == nil && lockHeldBy(owner, kernelLocked) {
+    if kernelLocked {
+      unlockFile(f)
+    }
+    f.Close()
+    return &LockHeldError{Path: path, Owner: owner}
+  }
+
+  (&InstanceLock{file: f, path: path, kernelLocked: kernelLocked}).Release()
+  return nil
+}
+
+// runLocksCommand 实现 gomate locks 子命令，返回进程退出码。
+func runLocksCommand(args []string) int {
+  fs := newSubcommandFlags("gomate locks", locksUsage)
+  var stale, beside bool
+  var sharedDir string
+  fs.BoolVar(&stale, "stale", false, "With clear: remove every lock whose owner has exited")
+  fs.BoolVar(&beside, "lock-beside", os.Getenv("GOMATE_LOCK_BESIDE") != "", "Look for locks beside the files")
+  fs.StringVar(&sharedDir, "shared-lock-dir", os.Getenv("GOMATE_SHARED_LOCK_DIR"), "Shared lock directory")
+  command, args, ok := fs.parse(args)
+  if !ok {
+    return exitUsage
+  }
+
+  loc, err := resolveLockLocation(beside, sharedDir)
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "gomate: %v\n", err)
+    return exitError
+  }
+  slog.Debug("lock directory", "dir", loc.Dir)
+
+  // 放在文件旁边的锁分散在各处，无法列出
+  if loc.Beside && (command == "list" || stale) {
+    fmt.Fprintf(os.Stderr, "gomate locks: %s needs a lock directory; locks beside files can only be shown or cleared by file\n", command)
+    return exitUsage
+  }
+
+  switch command {
+  case "list":
+    return locksList(loc.Dir)
+  case "show":
+    if len(args) != 1 {
+      fs.Usage()
+      return exitUsage
+    }
+    return locksShow(loc, args[0])
+  case "clear":
+    if stale == (len(args) > 0) {
+      fs.Usage()
+      return exitUsage
+    }
+    return locksClear(loc, stale, args)
+  }
+  fmt.Fprintf(os.Stderr, "gomate locks: unknown command %q\n", command)
+  fs.Usage()
+  return exitUsage
+}
+
+func locksList(dir string) int {
+  entries, err := listLocks(dir)
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "gomate: failed to read lock directory: %v\n", err)
+    return 1
+  }
+  if len(entries) == 0 {
+    fmt.Printf("No locks in %s\n", dir)
+    return 0
+  }
+
+  w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+  fmt.Fprintln(w, "ID\tSTATUS\tPID\tUSER@HOST\tSTARTED\tEDITOR\tFILE")
+  for _, e := range entries {
+    id := e.ID
+    if len(id) > lockIDWidth {
+      id = id[:lockIDWidth]
+    }
+    if e.Owner == nil {
+      fmt.Fprintf(w, "%s\t%s\t-\t-\t-\t-\t(%v)\n", id, e.StatusText(), e.Err)
+      continue
+    }
+    o := e.Owner
+    fmt.Fprintf(w, "%s\t%s\t%d\t%s@%s\t%s\t%s\t%s\n", id, e.StatusText(), o.PID,
+      orDash(o.User), orDash(o.Hostname), formatLockTime(o.StartTime), orDash(o.Editor), orDash(o.File))
+  }
+  w.Flush()
+  return 0
+}
+
+func locksShow(loc lockLocation, arg string) int {
+  path, err := resolveLock(loc, arg)
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "gomate: %v\n", err)
+    return 1
+  }
+  e := readLockEntry(path)
+
+  w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+  fmt.Fprintf(w, "Lock:\t%s\n", e.Path)
+  fmt.Fprintf(w, "Status:\t%s\n", e.StatusText())
+  if e.Owner == nil {
+    fmt.Fprintf(w, "Error:\t%v\n", e.Err)
+  } else {
+    o := e.Owner
+    fmt.Fprintf(w, "File:\t%s\n", orDash(o.File))
+    fmt.Fprintf(w, "Editor:\t%s\n", orDash(o.Editor))
+    fmt.Fprintf(w, "PID:\t%d\n", o.PID)
+    fmt.Fprintf(w, "Started:\t%s\n", formatLockTime(o.StartTime))
+    fmt.Fprintf(w, "User:\t%s\n", orDash(o.User))
+    fmt.Fprintf(w, "Host:\t%s\n", orDash(o.Hostname))
+    fmt.Fprintf(w, "Executable:\t%s\n", orDash(o.Executable))
+    if o.LeaseSeconds > 0 {
+      fmt.Fprintf(w, "Heartbeat:\t%s (lease %ds)\n", formatLockTime(o.Heartbeat), o.LeaseSeconds)
+    }
+  }
+  w.Flush()
+  return 0
+}
+
+func locksClear(loc lockLocation, stale bool, args []string) int {
+  var paths []string
+  if stale {
+    entries, err := listLocks(loc.Dir)
+    if err != nil {
+      fmt.Fprintf(os.Stderr, "gomate: failed to read lock directory: %v\n", err)
+      return 1
+    }
+    for _, e := range entries {
+      // 存活的持有者不去碰，避免短暂抢占它的锁
+      if e.Owner == nil || e.Status == OwnerDead || e.Status == OwnerReused || e.Status == OwnerExpired {
+        paths = append(paths, e.Path)
+      }
+    }
+  } else {
+    for _, arg := range args {
+      path, err := resolveLock(loc, arg)
+      if err != nil {
+        fmt.Fprintf(os.Stderr, "gomate: %v\n", err)
+        return 1
+      }
+      paths = append(paths, path)
+    }
+  }
+
+  code := 0
+  cleared := 0
+  for _, path := range paths {
+    if err := clearLock(path); err != nil {
+      if os.IsNotExist(err) {
+        // 持有者在此期间正常退出并删除了锁文件
+        continue
+      }
+      fmt.Fprintf(os.Stderr, "gomate: not clearing %s: %v\n", filepath.Base(path), err)
+      // --stale 模式下锁在检查之后被重新占用属于正常情况
+      if !stale {
+        code = 1
+      }
+      continue
+    }
+    fmt.Printf("Cleared %s\n", filepath.Base(path))
+    cleared++
+  }
+  if stale && cleared == 0 {
+    fmt.Println("No stale locks.")
+  }
+  return code
+}
+
+func orDash(s string) string {
+  if s == "" {
+    return "-"
+  }
+  return s
+}
+
+func formatLockTime(t time.Time) string {
+  if t.IsZero() {
+    return "-"
+  }
+  return t.Local().Format(time.DateTime)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+  "context"
+  "fmt"
+  "io"
+  "log"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "runtime"
+  "strings"
+  "sync"
+)
+
+// LevelTrace 低于 debug，用于逐行记录协议数据
+const LevelTrace = slog.Level(-8)
+
+// 日志文件超过 -log-max-size 时轮转为 .1、.2 …，最多保留 logBackups 个旧文件
+const logBackups = 3
+
+// LogOptions 是日志相关的命令行参数。
+type LogOptions struct {
+  Verbose bool   // -v：在标准错误上输出 debug 及以上的日志
+  Level   string // -log-level：error、warn、info、debug 或 trace，为空时按 Verbose 决定
+  File    string // -log-file：日志文件，"none" 表示不写日志文件
+  JSON    bool   // -log-json：以 JSON 格式输出
+  MaxSize int64  // 日志文件轮转的大小
+}
+
+// stderrLog 是输出到标准错误的日志，detachFromTerminal 之后被关闭
+var stderrLog struct {
+  sync.Mutex
+  w io.Writer
+}
+
+// fileLog 只写入日志文件，不写入标准错误。fail 等直接向标准错误输出消息的地方用它记录同一条消息，
+// 使 -v 时标准错误上不会出现两遍
+var fileLog = slog.New(fanoutHandler(nil))
+
+// parseLogLevel 解析 -log-level 的值。
+func parseLogLevel(s string) (slog.Level, error) {
+  switch strings.ToLower(s) {
+  case "error":
+    return slog.LevelError, nil
+  case "warn", "warning":
+    return slog.LevelWarn, nil
+  case "info":
+    return slog.LevelInfo, nil
+  case "debug":
+    return slog.LevelDebug, nil
+  case "trace":
+    return LevelTrace, nil
+  }
+  return 0, fmt.Errorf("invalid log level %q (want error, warn, info, debug or trace)", s)
+}
+
+// userStateDir 返回存放持久状态的用户目录：Unix 上为 $XDG_STATE_HOME 或 ~/.local/state，
+// Windows 上为 %LOCALAPPDATA%。
+func userStateDir() (string, error) {
+  if runtime.GOOS == "windows" {
+    return os.UserCacheDir()
+  }
+  if state := os.Getenv("XDG_STATE_HOME"); state != "" {
+    return state, nil
+  }
+  home, err := os.UserHomeDir()
+  if err != nil {
+    return "", err
+  }
+  return filepath.Join(home, ".local", "state"), nil
+}
+
+// defaultLogFile 返回后台会话默认的日志文件：用户状态目录下的 gomate/gomate.log。
+// 后台进程没有终端，出错后只能从这里找到原因。
+func defaultLogFile() string {
+  dir, err := userStateDir()
+  if err != nil {
+    return ""
+  }
+  return filepath.Join(dir, "gomate", "gomate.log")
+}
+
+// configureLogging 配置子命令的日志：-v 时在标准错误上输出 debug 及以上的日志，否则不输出。
+func configureLogging(verbose bool) {
+  if err := setupLogging(LogOptions{Verbose: verbose, File: "none"}); err != nil {
+    fmt.Fprintf(os.Stderr, "gomate: %v\n", err)
+  }
+}
+
+// setupLogging 把 slog 的默认日志 (以及依赖库经由 log 包输出的 debug 级别日志) 指向标准错误和/或日志文件。
+// 默认级别为 info (-v 时为 debug)；后台会话没有指定 -log-file 时写入 defaultLogFile。
+func setupLogging(opts LogOptions) error {
+  level := slog.LevelInfo
+  if opts.Verbose {
+    level = slog.LevelDebug
+  }
+  if opts.Level != "" {
+    var err error
+    if level, err = parseLogLevel(opts.Level); err != nil {
+      return err
+    }
+  }
+
+  // 只有 -v 或 -log-level 时才在标准错误上输出日志
+  var handlers, fileHandlers fanoutHandler
+  if opts.Verbose || opts.Level != "" {
+    stderrLog.w = os.Stderr
+    handlers = append(handlers, newLogHandler(lockedStderr{}, level, opts.JSON))
+  }
+
+  file := opts.File
+  if file == "" && isDetachedChild() {
+    file = defaultLogFile()
+  }
+  if file != "" && file != "none" {
+    w, err := openRotatingFile(file, opts.MaxSize)
+    if err != nil {
+      return fmt.Errorf("cannot open log file: %w", err)
+    }
+    fileHandlers = append(fileHandlers, newLogHandler(w, level, opts.JSON))
+    handlers = append(handlers, fileHandlers...)
+  }
+
+  slog.SetDefault(slog.New(handlers))
+  fileLog = slog.New(fileHandlers)
+  // 依赖库的 log.Printf 经由 slog 以 debug 级别输出，时间等由 slog 的 handler 负责
+  log.SetFlags(0)
+  slog.SetLogLoggerLevel(slog.LevelDebug)
+  if opts.Verbose {
+    slog.Debug("verbose logging enabled")
+  }
+  return nil
+}
+
+// detachLogging 在脱离终端时停止向标准错误输出日志，日志文件不受影响。
+func detachLogging() {
+  stderrLog.Lock()
+  defer stderrLog.Unlock()
+  stderrLog.w = io.Discard
+}
+
+// lockedStderr 写入 stderrLog.w，使 detachLogging 之后的日志不再写入已关闭的终端。
+type lockedStderr struct{}
+
+func (lockedStderr) Write(p []byte) (int, error) {
+  stderrLog.Lock()
+  defer stderrLog.Unlock()
+  return stderrLog.w.Write(p)
+}
+
+func newLogHandler(w io.Writer, level slog.Level, json bool) slog.Handler {
+  opts := &slog.HandlerOptions{
+    Level: level,
+    ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+      if a.Key == slog.LevelKey && a.Value.Any() == LevelTrace {
+        return slog.String(slog.LevelKey, "TRACE")
+      }
+      return a
+    },
+  }
+  if json {
+    return slog.NewJSONHandler(w, opts)
+  }
+  return slog.NewTextHandler(w, opts)
+}
+
+// logTrace 以 trace 级别记录一条日志，用于逐行的协议数据。
+func logTrace(format string, args ...interface{}) {
+  ctx := context.Background()
+  if slog.Default().Enabled(ctx, LevelTrace) {
+    slog.Log(ctx, LevelTrace, fmt.Sprintf(format, args...))
+  }
+}
+
+// fanoutHandler 把一条日志交给所有启用了该级别的 handler。
+type fanoutHandler []slog.Handler
+
+func (h fanoutHandler) Enabled(ctx context.Context, level slog.Level) bool {
+  for _, handler := range h {
+    if handler.Enabled(ctx, level) {
+      return true
+    }
+  }
+  return false
+}
+
+func (h fanoutHandler) Handle(ctx context.Context, r slog.Record) error {
+  var firstErr error
+  for _, handler := range h {
+    if handler.Enabled(ctx, r.Level) {
+      if err := handler.Handle(ctx, r.Clone()); err != nil && firstErr == nil {
+        firstErr = err
+      }
+    }
+  }
+  return firstErr
+}
+
+func (h fanoutHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+  out := make(fanoutHandler, len(h))
+  for i, handler := range h {
+    out[i] = handler.WithAttrs(attrs)
+  }
+  return out
+}
+
+func (h fanoutHandler) WithGroup(name string) slog.Handler {
+  out := make(fanoutHandler, len(h))
+  for i, handler := range h {
+    out[i] = handler.WithGroup(name)
+  }
+  return out
+}
+
+// rotatingFile 是按大小轮转的日志文件。多个后台会话可以追加写入同一个文件。
+type rotatingFile struct {
+  mu      sync.Mutex
+  path    string
+  maxSize int64
+  f       *os.File
+  size    int64
+}
+
+func openRotatingFile(path string, maxSize int64) (*rotatingFile, error) {
+  if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+    return nil, err
+  }
+  r := &rotatingFile{path: path, maxSize: maxSize}
+  if err := r.open(); err != nil {
+    return nil, err
+  }
+  return r, nil
+}
+
+func (r *rotatingFile) open() error {
+  f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+  if err != nil {
+    return err
+  }
+  st, err := f.Stat()
+  if err != nil {
+    f.Close()
+    return err
+  }
+  r.f, r.size = f, st.Size()
+  return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+    r.rotate()
+  }
+  n, err := r.f.Write(p)
+  r.size += int64(n)
+  return n, err
+}
+
+// rotate 把 path 重命名为 path.1，原有的 path.1 重命名为 path.2，以此类推。
+// 轮转失败时继续写入原文件。
+func (r *rotatingFile) rotate() {
+  // 其他会话可能已经轮转过，此时只需重新打开新文件
+  if st, err := os.Stat(r.path); err == nil && st.Size() < r.size {
+    r.f.Close()
+    if err := r.open(); err != nil {
+      fmt.Fprintf(os.Stderr, "gomate: cannot reopen log file: %v\n", err)
+    }
+    return
+  }
+  for i := logBackups - 1; i > 0; i-- {
+    os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+  }
+  r.f.Close()
+  if err := os.Rename(r.path, r.path+".1"); err != nil && !os.IsNotExist(err) {
+    fmt.Fprintf(os.Stderr, "gomate: cannot rotate log file: %v\n", err)
+  }
+  if err := r.open(); err != nil {
+    fmt.Fprintf(os.Stderr, "gomate: cannot reopen log file: %v\n", err)
+  }
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+  "log"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+func TestSetupLoggingLevels(t *testing.T) {
+  defer slog.SetDefault(slog.Default())
+  defer func(l *slog.Logger) { fileLog = l }(fileLog)
+  defer log.SetOutput(log.Writer())
+  defer log.SetFlags(log.Flags())
+
+  path := filepath.Join(t.TempDir(), "gomate.log")
+  if err := setupLogging(LogOptions{File: path}); err != nil {
+    t.Fatal(err)
+  }
+  slog.Debug("debug message")
+  slog.Warn("warn message", "file", "notes.txt")
+  log.Printf("Warning: library message")
+  fileLog.Error("file-only message")
+
+  data, err := os.ReadFile(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  got := string(data)
+  if strings.Contains(got, "debug message") {
+    t.Errorf("debug record written at the default info level:\n%s", got)
+  }
+  if !strings.Contains(got, "level=WARN msg=\"warn message\" file=notes.txt") {
+    t.Errorf("warn record missing:\n%s", got)
+  }
+  // log 包的输出不再根据前缀猜测级别
+  if strings.Contains(got, "library message") {
+    t.Errorf("log.Printf output promoted above debug:\n%s", got)
+  }
+  if !strings.Contains(got, "level=ERROR msg=\"file-only message\"") {
+    t.Errorf("fileLog record missing:\n%s", got)
+  }
+}
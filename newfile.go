@@ -0,0 +1,103 @@
+package main
+
+import (
+  "fmt"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "sync"
+)
+
+// createdDirs 记录本次会话为新文件创建的目录
+var createdDirs dirTracker
+
+// dirTracker 记录 gomate 自己创建的目录。新文件直到第一次保存时才写入磁盘，
+// 会话结束时如果文件从未保存过，就删除这些目录，不留下空的目录树。
+type dirTracker struct {
+  mu    sync.Mutex
+  dirs  []string // 按创建顺序排列，父目录在前
+  saved bool
+}
+
+// MkdirAll 创建 dir 及其所有不存在的父目录，并记录实际创建了哪些目录。
+func (t *dirTracker) MkdirAll(dir string) error {
+  abs, err := filepath.Abs(dir)
+  if err != nil {
+    return fmt.Errorf("error getting absolute path: %w", err)
+  }
+
+  // 找出需要创建的目录，从最接近根的开始创建
+  var missing []string
+  for d := abs; ; {
+    if _, err := os.Stat(d); err == nil {
+      break
+    } else if !os.IsNotExist(err) {
+      return fmt.Errorf("error checking directory %s: %w", d, err)
+    }
+    missing = append(missing, d)
+    parent := filepath.Dir(d)
+    if parent == d {
+      break
+    }
+    d = parent
+  }
+
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  for i := len(missing) - 1; i >= 0; i-- {
+    if err := os.Mkdir(missing[i], 0755); err != nil {
+      if os.IsExist(err) {
+        // 其他进程刚刚创建了它，不归我们删除
+        continue
+      }
+      return fmt.Errorf("failed to create directory %s: %w", missing[i], err)
+    }
+    slog.Debug("created directory", "dir", missing[i])
+    t.dirs = append(t.dirs, missing[i])
+  }
+  return nil
+}
+
+// MarkSaved 记录文件已经保存过，此后创建的目录都会保留。
+func (t *dirTracker) MarkSaved() {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  if !t.saved && len(t.dirs) > 0 {
+    slog.Debug("file saved, keeping created directories", "count", len(t.dirs))
+  }
+  t.saved = true
+}
+
+// Cleanup 在会话结束时调用：文件从未保存过时，按相反顺序删除创建的目录。
+// 只删除空目录，用户在其中放入的其他文件不会被删除。
+func (t *dirTracker) Cleanup() {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  if t.saved {
+    return
+  }
+  for i := len(t.dirs) - 1; i >= 0; i-- {
+    if err := os.Remove(t.dirs[i]); err != nil {
+      slog.Debug("keeping directory", "dir", t.dirs[i], "error", err)
+      continue
+    }
+    slog.Debug("removed unused directory", "dir", t.dirs[i])
+  }
+  t.dirs = nil
+}
+
+// checkTargetFile 检查要编辑的文件。文件不存在时不创建它，等到第一次保存时再写入。
+func checkTargetFile(filePath string) error {
+  st, err := os.Stat(filePath)
+  if os.IsNotExist(err) {
+    slog.Debug("file does not exist yet, it will be created on first save", "file", filePath)
+    return nil
+  }
+  if err != nil {
+    return fmt.Errorf("error checking file status %s: %w", filePath, err)
+  }
+  if st.IsDir() {
+    return fmt.Errorf("%s is a directory", filePath)
+  }
+  return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+  "os"
+  "path/filepath"
+  "runtime"
+  "strings"
+  "testing"
+)
+
+func TestDirTracker(t *testing.T) {
+  base := t.TempDir()
+  var dirs dirTracker
+  nested := filepath.Join(base, "a", "b", "c")
+  if err := dirs.MkdirAll(nested); err != nil {
+    t.Fatal(err)
+  }
+  if st, err := os.Stat(nested); err != nil || !st.IsDir() {
+    t.Fatalf("MkdirAll did not create %s: %v", nested, err)
+  }
+  // 已经存在的目录不归 dirTracker 所有
+  if err := dirs.MkdirAll(filepath.Join(base, "a", "b")); err != nil {
+    t.Fatal(err)
+  }
+
+  // 用户放入的文件使其所在的目录保留下来，其余新建的目录都被删除
+  if err := os.WriteFile(filepath.Join(base, "a", "keep.txt"), nil, 0644); err != nil {
+    t.Fatal(err)
+  }
+  dirs.Cleanup()
+  if _, err := os.Stat(filepath.Join(base, "a", "b")); !os.IsNotExist(err) {
+    t.Errorf("unused directory a/b kept: %v", err)
+  }
+  if _, err := os.Stat(filepath.Join(base, "a", "keep.txt")); err != nil {
+    t.Errorf("non-empty directory removed: %v", err)
+  }
+
+  // 文件保存过之后，新建的目录都保留
+  var saved dirTracker
+  if err := saved.MkdirAll(filepath.Join(base, "x", "y")); err != nil {
+    t.Fatal(err)
+  }
+  saved.MarkSaved()
+  saved.Cleanup()
+  if _, err := os.Stat(filepath.Join(base, "x", "y")); err != nil {
+    t.Errorf("directory of a saved file removed: %v", err)
+  }
+
+  // 路径中有普通文件时无法创建目录
+  blocker := filepath.Join(base, "file.txt")
+  if err := os.WriteFile(blocker, nil, 0644); err != nil {
+    t.Fatal(err)
+  }
+  var blocked dirTracker
+  if err := blocked.MkdirAll(filepath.Join(blocker, "sub")); err == nil {
+    t.Error("MkdirAll below a regular file succeeded")
+  }
+}
+
+func TestCheckTargetFile(t *testing.T) {
+  base := t.TempDir()
+  existing := filepath.Join(base, "notes.txt")
+  if err := os.WriteFile(existing, nil, 0644); err != nil {
+    t.Fatal(err)
+  }
+  tests := []struct {
+    path    string
+    wantErr string
+  }{
+    {existing, ""},
+    {filepath.Join(base, "new.txt"), ""},
+    {filepath.Join(base, "missing", "dir", "new.txt"), ""},
+    {base, "is a directory"},
+  }
+  if runtime.GOOS != "windows" {
+    // Windows 把普通文件之下的路径报告为不存在，直到保存时才会失败
+    tests = append(tests, struct {
+      path    string
+      wantErr string
+    }{filepath.Join(existing, "new.txt"), "not a directory"})
+  }
+  for _, tt := range tests {
+    err := checkTargetFile(tt.path)
+    if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+      t.Errorf("checkTargetFile(%s) = %v, want %q", tt.path, err, tt.wantErr)
+    }
+  }
+  // 检查不会创建文件
+  if _, err := os.Stat(filepath.Join(base, "new.txt")); !os.IsNotExist(err) {
+    t.Errorf("checkTargetFile created the file: %v", err)
+  }
+}
+
+func TestNewFileCreatedOnFirstSave(t *testing.T) {
+  env := gomateEnv(t)
+  base := t.TempDir()
+
+  // 父目录不存在：第一次保存时创建文件和目录
+  file := filepath.Join(base, "new", "dir", "notes.txt")
+  editor := &capsEditor{reply: []byte("first save\n")}
+  if code, stderr := runEditorSession(t, env, editor, file); code != exitSaved {
+    t.Fatalf("exit %d, want %d; stderr:\n%s", code, exitSaved, stderr)
+  }
+  if len(editor.opened) != 0 {
+    t.Errorf("editor received %q for a new file, want empty content", editor.opened)
+  }
+  if got, err := os.ReadFile(file); err != nil || string(got) != "first save\n" {
+    t.Errorf("new file = %q, %v", got, err)
+  }
+
+  // 没有保存就关闭：不留下文件，也不留下为它创建的目录
+  unsaved := filepath.Join(base, "other", "deeper", "draft.txt")
+  if code, stderr := runEditorSession(t, env, &capsEditor{}, unsaved); code != exitNotSaved {
+    t.Fatalf("exit %d, want %d; stderr:\n%s", code, exitNotSaved, stderr)
+  }
+  if _, err := os.Stat(filepath.Join(base, "other")); !os.IsNotExist(err) {
+    t.Errorf("directories of an unsaved new file left behind: %v", err)
+  }
+
+  // 父路径是普通文件：在连接编辑器之前报告错误
+  if runtime.GOOS == "windows" {
+    return
+  }
+  blocker := filepath.Join(base, "file.txt")
+  if err := os.WriteFile(blocker, nil, 0644); err != nil {
+    t.Fatal(err)
+  }
+  code, stderr := runGomate(t, env, "-w", "-no-discover", "-h", "127.0.0.1", "-p", "1", filepath.Join(blocker, "notes.txt"))
+  if code != exitError || !strings.Contains(stderr, "not a directory") {
+    t.Errorf("exit %d, want %d with \"not a directory\"; stderr:\n%s", code, exitError, stderr)
+  }
+}
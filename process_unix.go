@@ -0,0 +1,15 @@
+//go:build unix
+
+package main
+
+import (
+  "errors"
+  "syscall"
+)
+
+// processAlive 报告 pid 对应的进程是否仍然存在。
+// EPERM 表示进程存在但属于其他用户，同样视为存活。
+func processAlive(pid int) bool {
+  err := syscall.Kill(pid, 0)
+  return err == nil || errors.Is(err, syscall.EPERM)
+}
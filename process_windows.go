@@ -0,0 +1,44 @@
+//go:build windows
+
+package main
+
+import (
+  "syscall"
+  "time"
+)
+
+const (
+  processQueryLimitedInformation = 0x1000
+  stillActive                    = 259
+)
+
+// processAlive 报告 pid 对应的进程是否仍在运行。
+func processAlive(pid int) bool {
+  h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+  if err != nil {
+    // 拒绝访问意味着进程存在但属于其他用户
+    return err == syscall.ERROR_ACCESS_DENIED
+  }
+  defer syscall.CloseHandle(h)
+
+  var code uint32
+  if err := syscall.GetExitCodeProcess(h, &code); err != nil {
+    return true
+  }
+  return code == stillActive
+}
+
+// processStartTime 通过 GetProcessTimes 查询进程的创建时间。
+func processStartTime(pid int) (time.Time, error) {
+  h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+  if err != nil {
+    return time.Time{}, err
+  }
+  defer syscall.CloseHandle(h)
+
+  var creation, exit, kernel, user syscall.Filetime
+  if err := syscall.GetProcessTimes(h, &creation, &exit, &kernel, &user); err != nil {
+    return time.Time{}, err
+  }
+  return time.Unix(0, creation.Nanoseconds()).Truncate(time.Second), nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+  "fmt"
+  "regexp"
+  "sort"
+  "strings"
+)
+
+// EditorGreeting 是解析后的编辑器握手行，例如 "Sublime Text 3 (remote_subl plugin)"。
+type EditorGreeting struct {
+  Raw     string
+  Product string // 版本号或括号之前的名称部分
+  Version string // 第一个形如 1.2.3 的版本号
+  Detail  string // 括号中的附加信息 (插件名、操作系统等)
+}
+
+var greetingVersionRe = regexp.MustCompile(`\bv?(\d+(?:\.\d+)*)\b`)
+
+// greetingCodeRe 匹配握手行开头的状态码，例如 "220 "
+var greetingCodeRe = regexp.MustCompile(`^\d{3}(?:\s+|$)`)
+
+// parseGreeting 把握手行拆分为产品名、版本号和附加信息。开头的状态码 (220) 不属于产品名；
+// TextMate 的握手行形如 "220 <主机名> RMATE TextMate (...)"，主机名和 RMATE 同样去掉，主机名中的数字不会被当作版本号。
+func parseGreeting(line string) EditorGreeting {
+  g := EditorGreeting{Raw: strings.TrimSpace(line)}
+  rest := greetingCodeRe.ReplaceAllString(g.Raw, "")
+  if fields := strings.Fields(rest); len(fields) >= 2 && strings.EqualFold(fields[1], "rmate") {
+    rest = strings.Join(fields[2:], " ")
+  }
+
+  if open := strings.Index(rest, "("); open >= 0 {
+    if end := strings.LastIndex(rest, ")"); end > open {
+      g.Detail = strings.TrimSpace(rest[open+1 : end])
+    }
+    rest = rest[:open]
+  }
+
+  // 括号中的数字往往是操作系统版本，因此只在名称部分查找版本号
+  if loc := greetingVersionRe.FindStringSubmatchIndex(rest); loc != nil {
+    g.Version = rest[loc[2]:loc[3]]
+    rest = rest[:loc[0]]
+  }
+  g.Product = strings.TrimSpace(rest)
+  return g
+}
+
+// EditorProfile 描述一类 rmate 服务端的行为差异。
+type EditorProfile struct {
+  Name  string
+  Match []string // 在握手行中查找的关键字 (小写)
+
+  // 可以安全发送的可选头部
+  RealPath   bool // real-path: 文件的绝对路径
+  DataOnSave bool // data-on-save: yes
+  ReActivate bool // re-activate: yes
+  Selection  bool // selection: 光标所在行
+  FileType   bool // file-type: 语法类型
+  NewWindow  bool // new: yes
+
+  // CloseBlankLine 为 true 时，close 命令以空行结束，需要一并读掉
+  CloseBlankLine bool
+
+  // SaveNewline 为 true 时，save 的内容之后跟一个换行，据此检查内容的长度是否与 data: 一致
+  SaveNewline bool
+}
+
+// editorProfiles 是已知编辑器的特性表，generic 必须放在最后作为兜底。
+var editorProfiles = []*EditorProfile{
+  {
+    Name:           "textmate",
+    Match:          []string{"textmate"},
+    RealPath:       true,
+    DataOnSave:     true,
+    ReActivate:     true,
+    Selection:      true,
+    FileType:       true,
+    NewWindow:      true,
+    CloseBlankLine: true,
+    SaveNewline:    true,
+  },
+  {
+    Name:           "sublime",
+    Match:          []string{"sublime", "remote_subl", "rsub"},
+    RealPath:       true,
+    DataOnSave:     true,
+    Selection:      true,
+    CloseBlankLine: true,
+    SaveNewline:    true,
+  },
+  {
+    Name:        "vscode",
+    Match:       []string{"vscode", "vs code", "visual studio code", "remote-vscode"},
+    DataOnSave:  true,
+    Selection:   true,
+    SaveNewline: true,
+  },
+  {
+    // 未知的 rmate 服务端只发送最基本的头部；不确定内容之后是否有换行，不等待它
+    Name: "generic",
+  },
+}
+
+// lookupProfile 按名称查找特性表，用于 --editor-profile。
+func lookupProfile(name string) (*EditorProfile, error) {
+  for _, p := range editorProfiles {
+    if strings.EqualFold(p.Name, name) {
+      return p, nil
+    }
+  }
+  names := make([]string, 0, len(editorProfiles))
+  for _, p := range editorProfiles {
+    names = append(names, p.Name)
+  }
+  sort.Strings(names)
+  return nil, fmt.Errorf("unknown editor profile %q (want auto, %s)", name, strings.Join(names, ", "))
+}
+
+// detectProfile 根据握手行选择特性表，无法识别时返回 generic。
+func detectProfile(g EditorGreeting) *EditorProfile {
+  raw := strings.ToLower(g.Raw)
+  for _, p := range editorProfiles {
+    for _, keyword := range p.Match {
+      if strings.Contains(raw, keyword) {
+        return p
+      }
+    }
+  }
+  return editorProfiles[len(editorProfiles)-1]
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+  "strings"
+  "testing"
+)
+
+func TestLookupProfile(t *testing.T) {
+  for _, name := range []string{"textmate", "Sublime", "VSCODE", "generic"} {
+    if p, err := lookupProfile(name); err != nil || !strings.EqualFold(p.Name, name) {
+      t.Errorf("lookupProfile(%q) = %v, %v", name, p, err)
+    }
+  }
+
+  _, err := lookupProfile("emacs")
+  if err == nil {
+    t.Fatal("lookupProfile(emacs) succeeded")
+  }
+  // 错误信息列出所有可用的特性表，用户不必查阅文档
+  for _, want := range []string{`"emacs"`, "auto", "generic", "sublime", "textmate", "vscode"} {
+    if !strings.Contains(err.Error(), want) {
+      t.Errorf("error %q does not mention %s", err, want)
+    }
+  }
+}
+
+func TestDetectProfile(t *testing.T) {
+  tests := []struct {
+    greeting string
+    want     string
+  }{
+    {"220 Sublime Text 4 (remote_subl plugin)", "sublime"},
+    {"TextMate (Mac OS X 10.15)", "textmate"},
+    {"Visual Studio Code 1.85 (remote-vscode)", "vscode"},
+    {"rmate server 0.1", "generic"},
+  }
+  for _, tt := range tests {
+    if got := detectProfile(parseGreeting(tt.greeting)); got.Name != tt.want {
+      t.Errorf("detectProfile(%q) = %s, want %s", tt.greeting, got.Name, tt.want)
+    }
+  }
+}
+
+func TestParseGreeting(t *testing.T) {
+  tests := []struct {
+    line    string
+    profile string
+    want    EditorGreeting
+  }{
+    {"220 my-host-2.local RMATE TextMate (Mac OS X 10.15.7)", "textmate", EditorGreeting{Product: "TextMate", Detail: "Mac OS X 10.15.7"}},
+    {"220 build01 RMATE TextMate", "textmate", EditorGreeting{Product: "TextMate"}},
+    {"220 Sublime Text 4 (remote_subl plugin)", "sublime", EditorGreeting{Product: "Sublime Text", Version: "4", Detail: "remote_subl plugin"}},
+    {"Sublime Text 3 (rsub plugin)", "sublime", EditorGreeting{Product: "Sublime Text", Version: "3", Detail: "rsub plugin"}},
+    {"Visual Studio Code 1.85 (remote-vscode)", "vscode", EditorGreeting{Product: "Visual Studio Code", Version: "1.85", Detail: "remote-vscode"}},
+    {"220 VSCode v1.90.2", "vscode", EditorGreeting{Product: "VSCode", Version: "1.90.2"}},
+    {"rmate server 0.1", "generic", EditorGreeting{Product: "rmate server", Version: "0.1"}},
+    {"220", "generic", EditorGreeting{}},
+  }
+  for _, tt := range tests {
+    got := parseGreeting(tt.line)
+    tt.want.Raw = tt.line
+    if got != tt.want {
+      t.Errorf("parseGreeting(%q) = %+v, want %+v", tt.line, got, tt.want)
+    }
+    if p := detectProfile(got); p.Name != tt.profile {
+      t.Errorf("detectProfile(%q) = %s, want %s", tt.line, p.Name, tt.profile)
+    }
+  }
+}
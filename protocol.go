@@ -0,0 +1,113 @@
+package main
+
+import (
+  "bufio"
+  "errors"
+  "fmt"
+  "io"
+  "strings"
+)
+
+// maxLineLength 是从编辑器读取的一行 (命令、头部或握手行) 的最大字节数，足以容纳最长的路径
+const maxLineLength = 8192
+
+// maxHeaderLines 是一条命令最多允许的头部行数
+const maxHeaderLines = 64
+
+// ErrProtocol 表示编辑器发来的数据不符合 rmate 协议，连接无法继续使用。
+var ErrProtocol = errors.New("rmate protocol error")
+
+// readProtocolLine 读取一行并去掉行尾的 "\n" 或 "\r\n"。
+// 超过 maxLineLength 的行返回 ErrProtocol，而不是把剩余部分当作下一行解析。
+func readProtocolLine(buf *bufio.Reader) (string, error) {
+  var line []byte
+  for {
+    chunk, err := buf.ReadSlice('\n')
+    if len(line)+len(chunk) > maxLineLength+2 {
+      return "", fmt.Errorf("%w: line longer than %d bytes", ErrProtocol, maxLineLength)
+    }
+    line = append(line, chunk...)
+    if err == bufio.ErrBufferFull {
+      continue
+    }
+    if err != nil {
+      if err == io.EOF && len(line) > 0 {
+        err = io.ErrUnexpectedEOF
+      }
+      return "", err
+    }
+    break
+  }
+  line = line[:len(line)-1]
+  if n := len(line); n > 0 && line[n-1] == '\r' {
+    line = line[:n-1]
+  }
+  // 读取时按 "\r\n" 留出余量，只以 "\n" 结尾的行在这里才能确定是否过长
+  if len(line) > maxLineLength {
+    return "", fmt.Errorf("%w: line longer than %d bytes", ErrProtocol, maxLineLength)
+  }
+  return string(line), nil
+}
+
+// headerReader 读取一条命令的头部行，超过 maxHeaderLines 行时返回 ErrProtocol。
+type headerReader struct {
+  buf   *bufio.Reader
+  cmd   string
+  lines int
+}
+
+func (h *headerReader) next() (string, error) {
+  h.lines++
+  if h.lines > maxHeaderLines {
+    return "", fmt.Errorf("%w: %s command has more than %d header lines", ErrProtocol, h.cmd, maxHeaderLines)
+  }
+  line, err := readProtocolLine(h.buf)
+  if err != nil {
+    return "", fmt.Errorf("failed to read %s header: %w", h.cmd, err)
+  }
+  return strings.TrimSpace(line), nil
+}
+
+// validateHeaderValue 检查写入 rmate 头部的值：换行等控制字符会结束头部行，
+// 使文件名或 -name 的值能够注入额外的头部甚至命令。
+func validateHeaderValue(name string, value string) error {
+  for _, r := range value {
+    if r < 0x20 || r == 0x7f {
+      return fmt.Errorf("%s %q contains the control character %U", name, value, r)
+    }
+  }
+  return nil
+}
+
+// escapeHeaderValue 把控制字符转写为 \n、\r、\t 或 \xHH，用于只供显示的头部 (例如由文件名得到的 display-name)。
+func escapeHeaderValue(value string) string {
+  if validateHeaderValue("", value) == nil {
+    return value
+  }
+  var b strings.Builder
+  for _, r := range value {
+    switch {
+    case r == '\n':
+      b.WriteString(`\n`)
+    case r == '\r':
+      b.WriteString(`\r`)
+    case r == '\t':
+      b.WriteString(`\t`)
+    case r < 0x20 || r == 0x7f:
+      fmt.Fprintf(&b, `\x%02x`, r)
+    default:
+      b.WriteRune(r)
+    }
+  }
+  return b.String()
+}
+
+// writeHeader 写入一行 "name: value" 头部，值中含有控制字符时拒绝写入。
+func writeHeader(w io.Writer, name string, value interface{}) error {
+  text := fmt.Sprint(value)
+  if err := validateHeaderValue(name, text); err != nil {
+    return err
+  }
+  _, err := fmt.Fprintf(w, "%s: %s\n", name, text)
+  return err
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "errors"
+  "io"
+  "log/slog"
+  "net"
+  "os"
+  "path/filepath"
+  "runtime"
+  "strings"
+  "testing"
+)
+
+func TestReadProtocolLine(t *testing.T) {
+  long := strings.Repeat("a", maxLineLength)
+  tests := []struct {
+    name    string
+    in      string
+    want    string
+    wantErr error
+  }{
+    {name: "LF", in: "open\n", want: "open"},
+    {name: "CRLF", in: "open\r\n", want: "open"},
+    {name: "longest line", in: long + "\r\n", want: long},
+    {name: "over-long line", in: long + "a\n", wantErr: ErrProtocol},
+    {name: "over-long line without newline", in: long + long, wantErr: ErrProtocol},
+    {name: "truncated line", in: "save", wantErr: io.ErrUnexpectedEOF},
+    {name: "end of stream", in: "", wantErr: io.EOF},
+  }
+  for _, tt := range tests {
+    // 缓冲区小于最长的行，检查跨越多次 ReadSlice 的拼接
+    got, err := readProtocolLine(bufio.NewReaderSize(strings.NewReader(tt.in), 16))
+    if tt.wantErr != nil {
+      if !errors.Is(err, tt.wantErr) {
+        t.Errorf("%s: err = %v, want %v", tt.name, err, tt.wantErr)
+      }
+      continue
+    }
+    if err != nil || got != tt.want {
+      t.Errorf("%s: got %d bytes, %v; want %d bytes", tt.name, len(got), err, len(tt.want))
+    }
+  }
+}
+
+func TestHandleCommandsRejectsMalformedInput(t *testing.T) {
+  profile, err := lookupProfile("textmate")
+  if err != nil {
+    t.Fatal(err)
+  }
+  manyHeaders := strings.Repeat("x-filler: 1\n", maxHeaderLines)
+  longHeader := "token: " + strings.Repeat("a", maxLineLength) + "\n"
+  tests := []struct {
+    name string
+    in   string
+  }{
+    {name: "over-long command", in: strings.Repeat("s", maxLineLength+1) + "\n"},
+    {name: "over-long save header", in: "save\n" + longHeader + "data: 0\n\n"},
+    {name: "over-long close header", in: "close\n" + longHeader},
+    {name: "too many save headers", in: "save\n" + manyHeaders + "data: 0\n\n"},
+    {name: "too many close headers", in: "close\n" + manyHeaders + "token: x\n"},
+    {name: "invalid data size", in: "save\ntoken: x\ndata: ten\n"},
+    {name: "negative data size", in: "save\ntoken: x\ndata: -1\n"},
+  }
+  for _, tt := range tests {
+    // 出错时会话总是结束，不必检查返回的 exit
+    _, err := handleCommands(bufio.NewReader(strings.NewReader(tt.in)), io.Discard, profile, Capabilities{}, 1<<20)
+    if !errors.Is(err, ErrProtocol) {
+      t.Errorf("%s: err = %v, want %v", tt.name, err, ErrProtocol)
+    }
+  }
+}
+
+func TestValidateHeaderValue(t *testing.T) {
+  tests := []struct {
+    value string
+    ok    bool
+  }{
+    {"notes.txt", true},
+    {"名前 with spaces.txt", true},
+    {"a\nb", false},
+    {"a\rb", false},
+    {"a\x00b", false},
+    {"a\tb", false},
+    {"a\x7fb", false},
+    {"x\nsave\ntoken: other", false},
+  }
+  for _, tt := range tests {
+    err := validateHeaderValue("-name", tt.value)
+    if (err == nil) != tt.ok {
+      t.Errorf("validateHeaderValue(%q) = %v, want ok %v", tt.value, err, tt.ok)
+    }
+  }
+
+  var b strings.Builder
+  if err := writeHeader(&b, "display-name", "a\nclose"); err == nil || b.Len() != 0 {
+    t.Errorf("writeHeader wrote %q, %v; want nothing and an error", b.String(), err)
+  }
+}
+
+func TestEscapeHeaderValue(t *testing.T) {
+  tests := []struct {
+    in, want string
+  }{
+    {"notes.txt", "notes.txt"},
+    {"a\nb", `a\nb`},
+    {"a\r\nb", `a\r\nb`},
+    {"a\tb", `a\tb`},
+    {"a\x00b\x7f", `a\x00b\x7f`},
+    {"名前\n", `名前\n`},
+  }
+  for _, tt := range tests {
+    got := escapeHeaderValue(tt.in)
+    if got != tt.want {
+      t.Errorf("escapeHeaderValue(%q) = %q, want %q", tt.in, got, tt.want)
+    }
+    if err := validateHeaderValue("display-name", got); err != nil {
+      t.Errorf("escaped value %q still invalid: %v", got, err)
+    }
+  }
+}
+
+func TestSendFileEscapesFileName(t *testing.T) {
+  if runtime.GOOS == "windows" {
+    t.Skip("file names cannot contain control characters")
+  }
+  file := filepath.Join(t.TempDir(), "evil\nclose\ntoken: x")
+  if err := os.WriteFile(file, []byte("hello\n"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  profile, err := lookupProfile("generic")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  client, server := net.Pipe()
+  received := make(chan string, 1)
+  go func() {
+    data, _ := io.ReadAll(server)
+    received <- string(data)
+  }()
+  err = sendFile(client, file, OpenOptions{}, profile)
+  client.Close()
+  if err != nil {
+    t.Fatalf("sendFile: %v", err)
+  }
+
+  got := <-received
+  if !strings.Contains(got, "display-name: evil\\nclose\\ntoken: x\n") {
+    t.Errorf("display-name not escaped:\n%q", got)
+  }
+  if strings.Count(got, "\ntoken: ") != 1 {
+    t.Errorf("file name injected an extra header:\n%q", got)
+  }
+}
+
+func TestHandleCommandsSkipsEmptyLines(t *testing.T) {
+  var logs bytes.Buffer
+  previous := slog.Default()
+  slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+  t.Cleanup(func() { slog.SetDefault(previous) })
+
+  profile, err := lookupProfile("generic")
+  if err != nil {
+    t.Fatal(err)
+  }
+  file := filepath.Join(t.TempDir(), "notes.txt")
+  if err := os.WriteFile(file, []byte("old\n"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  token := issueTestToken(t, file)
+
+  // generic 配置不读取保存内容后面的换行，它留给下一次读取命令
+  buf := bufio.NewReader(bytes.NewReader(append(saveCommand(token, []byte("new\n")), "\r\n"...)))
+  for !atEOF(buf) {
+    if exit, err := handleCommands(buf, io.Discard, profile, Capabilities{}, 1<<20); exit || err != nil {
+      t.Fatalf("handleCommands = %v, %v", exit, err)
+    }
+  }
+  if got, _ := os.ReadFile(file); string(got) != "new\n" {
+    t.Errorf("file = %q, want the saved content", got)
+  }
+  if strings.Contains(logs.String(), "unknown command") {
+    t.Errorf("empty lines were logged as commands:\n%s", logs.String())
+  }
+}
+
+func atEOF(buf *bufio.Reader) bool {
+  _, err := buf.Peek(1)
+  return err != nil
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+  "bufio"
+  "crypto/tls"
+  "encoding/base64"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "io"
+  "log/slog"
+  "net"
+  "net/http"
+  "net/url"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// proxyHandshakeTimeout 限制与代理服务器协商的总时长
+const proxyHandshakeTimeout = 30 * time.Second
+
+// ErrProxyAuth 表示代理服务器拒绝了认证信息。
+var ErrProxyAuth = errors.New("proxy authentication failed")
+
+// lookupEnv 按顺序返回第一个非空的环境变量值 (兼容大小写两种写法)。
+func lookupEnv(names ...string) string {
+  for _, name := range names {
+    if v := os.Getenv(name); v != "" {
+      return v
+    }
+  }
+  return ""
+}
+
+// resolveProxy 决定连接 host:port 时使用的代理。
+// 优先使用 --proxy 参数，其次是 ALL_PROXY、HTTPS_PROXY 环境变量；
+// 命中 NO_PROXY 列表时直连。"none" 或 "direct" 显式禁用代理。
+// 返回 nil 表示直连。
+func resolveProxy(flagProxy string, host string, port int) (*url.URL, error) {
+  raw := flagProxy
+  fromEnv := false
+  if raw == "" {
+    raw = lookupEnv("ALL_PROXY", "all_proxy", "HTTPS_PROXY", "https_proxy")
+    fromEnv = true
+  }
+  if raw == "" || raw == "none" || raw == "direct" {
+    return nil, nil
+  }
+
+  // 环境变量中的代理通常面向外网，回环地址总是直连
+  if fromEnv && isLoopbackHost(host) {
+    slog.Debug("bypassing proxy for loopback editor host", "host", host)
+    return nil, nil
+  }
+  if noProxy := lookupEnv("NO_PROXY", "no_proxy"); noProxy != "" && matchNoProxy(noProxy, host, port) {
+    slog.Debug("bypassing proxy, host matched NO_PROXY", "host", host)
+    return nil, nil
+  }
+
+  // 允许省略 scheme，此时按 HTTP CONNECT 代理处理
+  if !strings.Contains(raw, "://") {
+    raw = "http://" + raw
+  }
+  u, err := url.Parse(raw)
+  if err != nil {
+    return nil, fmt.Errorf("invalid proxy URL %q: %w", raw, err)
+  }
+  switch u.Scheme {
+  case "socks5", "socks5h", "http", "https":
+  default:
+    return nil, fmt.Errorf("unsupported proxy scheme %q (want socks5, socks5h, http or https)", u.Scheme)
+  }
+  if u.Hostname() == "" {
+    return nil, fmt.Errorf("invalid proxy URL %q: missing host", raw)
+  }
+  return u, nil
+}
+
+// isLoopbackHost 判断主机名是否指向本机回环地址。
+func isLoopbackHost(host string) bool {
+  if strings.EqualFold(host, "localhost") {
+    return true
+  }
+  ip := net.ParseIP(host)
+  return ip != nil && ip.IsLoopback()
+}
+
+// matchNoProxy 判断 host:port 是否命中 NO_PROXY 列表。
+// 支持 "*"、主机名、".domain" 后缀、IP、CIDR，以及可选的 ":port" 限定。
+func matchNoProxy(noProxy string, host string, port int) bool {
+  host = strings.ToLower(strings.TrimSuffix(host, "."))
+  ip := net.ParseIP(host)
+
+  for _, entry := range strings.Split(noProxy, ",") {
+    entry = strings.ToLower(strings.TrimSpace(entry))
+    if entry == "" {
+      continue
+    }
+    if entry == "*" {
+      return true
+    }
+
+    if _, cidr, err := net.ParseCIDR(entry); err == nil {
+      if ip != nil && cidr.Contains(ip) {
+        return true
+      }
+      continue
+    }
+
+    // 拆分可选的端口限定
+    if h, p, err := net.SplitHostPort(entry); err == nil {
+      if p != strconv.Itoa(port) {
+        continue
+      }
+      entry = h
+    }
+    entry = strings.TrimSuffix(entry, ".")
+
+    if entryIP := net.ParseIP(entry); entryIP != nil {
+      if ip != nil && entryIP.Equal(ip) {
+        return true
+      }
+      continue
+    }
+
+    entry = strings.TrimPrefix(entry, "*")
+    if strings.HasPrefix(entry, ".") {
+      if strings.HasSuffix(host, entry) || host == entry[1:] {
+        return true
+      }
+      continue
+    }
+    if host == entry || strings.HasSuffix(host, "."+entry) {
+      return true
+    }
+  }
+  return false
+}
+
+// dialProxy 通过代理服务器连接到 host:port。
+func dialProxy(proxy *url.URL, host string, port int) (net.Conn, error) {
+  proxyAddr := proxy.Host
+  if proxy.Port() == "" {
+    switch proxy.Scheme {
+    case "socks5", "socks5h":
+      proxyAddr = net.JoinHostPort(proxy.Hostname(), "1080")
+    case "https":
+      proxyAddr = net.JoinHostPort(proxy.Hostname(), "443")
+    default:
+      proxyAddr = net.JoinHostPort(proxy.Hostname(), "8080")
+    }
+  }
+
+  dialer := net.Dialer{Timeout: proxyHandshakeTimeout}
+  var conn net.Conn
+  var err error
+  if proxy.Scheme == "https" {
+    conn, err = tls.DialWithDialer(&dialer, "tcp", proxyAddr, &tls.Config{ServerName: proxy.Hostname()})
+  } else {
+    conn, err = dialer.Dial("tcp", proxyAddr)
+  }
+  if err != nil {
+    return nil, fmt.Errorf("failed to connect to proxy %s: %w", proxy.Redacted(), err)
+  }
+
+  if err := conn.SetDeadline(time.Now().Add(proxyHandshakeTimeout)); err != nil {
+    slog.Warn("failed to set proxy handshake deadline", "error", err)
+  }
+
+  var tunnel net.Conn
+  switch proxy.Scheme {
+  case "socks5", "socks5h":
+    tunnel, err = socks5Connect(conn, proxy, host, port)
+  default:
+    tunnel, err = httpConnect(conn, proxy, host, port)
+  }
+  if err != nil {
+    conn.Close()
+    return nil, fmt.Errorf("proxy %s: %w", proxy.Redacted(), err)
+  }
+
+  if err := conn.SetDeadline(time.Time{}); err != nil {
+    slog.Warn("failed to clear proxy handshake deadline", "error", err)
+  }
+  slog.Debug("proxy tunnel established", "proxy", proxy.Redacted())
+  return tunnel, nil
+}
+
+// SOCKS5 协议常量 (RFC 1928 / RFC 1929)
+const (
+  socks5Version      = 0x05
+  socks5AuthNone     = 0x00
+  socks5AuthPassword = 0x02
+  socks5AuthNoAccept = 0xff
+  socks5CmdConnect   = 0x01
+  socks5AtypIPv4     = 0x01
+  socks5AtypDomain   = 0x03
+  socks5AtypIPv6     = 0x04
+)
+
+// socks5Replies 是 SOCKS5 CONNECT 应答码的说明
+var socks5Replies = map[byte]string{
+  0x01: "general SOCKS server failure",
+  0x02: "connection not allowed by ruleset",
+  0x03: "network unreachable",
+  0x04: "host unreachable",
+  0x05: "connection refused",
+  0x06: "TTL expired",
+  0x07: "command not supported",
+  0x08: "address type not supported",
+}
+
+// socks5Connect 在已建立的代理连接上完成 SOCKS5 握手和 CONNECT 请求。
+// socks5h 由代理解析主机名，socks5 则在本地解析。
+func socks5Connect(conn net.Conn, proxy *url.URL, host string, port int) (net.Conn, error) {
+  user := proxy.User.Username()
+  pass, _ := proxy.User.Password()
+
+  // 1. 协商认证方式
+  methods := []byte{socks5AuthNone}
+  if user != "" {
+    methods = []byte{socks5AuthNone, socks5AuthPassword}
+  }
+  greeting := append([]byte{socks5Version, byte(len(methods))}, methods...)
+  if _, err := conn.Write(greeting); err != nil {
+    return nil, fmt.Errorf("failed to send SOCKS5 greeting: %w", err)
+  }
+
+  reply := make([]byte, 2)
+  if _, err := io.ReadFull(conn, reply); err != nil {
+    return nil, fmt.Errorf("failed to read SOCKS5 greeting reply: %w", err)
+  }
+  if reply[0] != socks5Version {
+    return nil, fmt.Errorf("unexpected SOCKS version %d", reply[0])
+  }
+
+  switch reply[1] {
+  case socks5AuthNone:
+  case socks5AuthPassword:
+    if user == "" {
+      return nil, fmt.Errorf("%w: proxy requires a username and password", ErrProxyAuth)
+    }
+    if len(user) > 255 || len(pass) > 255 {
+      return nil, fmt.Errorf("%w: username or password too long", ErrProxyAuth)
+    }
+    auth := []byte{0x01, byte(len(user))}
+    auth = append(auth, user...)
+    auth = append(auth, byte(len(pass)))
+    auth = append(auth, pass...)
+    if _, err := conn.Write(auth); err != nil {
+      return nil, fmt.Errorf("failed to send SOCKS5 credentials: %w", err)
+    }
+    if _, err := io.ReadFull(conn, reply); err != nil {
+      return nil, fmt.Errorf("failed to read SOCKS5 auth reply: %w", err)
+    }
+    if reply[1] != 0x00 {
+      return nil, ErrProxyAuth
+    }
+  case socks5AuthNoAccept:
+    return nil, fmt.Errorf("%w: no acceptable authentication method", ErrProxyAuth)
+  default:
+    return nil, fmt.Errorf("unsupported SOCKS5 authentication method %d", reply[1])
+  }
+
+  // 2. 发送 CONNECT 请求
+  req := []byte{socks5Version, socks5CmdConnect, 0x00}
+  ip := net.ParseIP(host)
+  if ip == nil && proxy.Scheme == "socks5" {
+    addrs, err := net.LookupIP(host)
+    if err != nil || len(addrs) == 0 {
+      return nil, fmt.Errorf("failed to resolve %s: %v", host, err)
+    }
+    ip = addrs[0]
+  }
+  switch {
+  case ip != nil && ip.To4() != nil:
+    req = append(req, socks5AtypIPv4)
+    req = append(req, ip.To4()...)
+  case ip != nil:
+    req = append(req, socks5AtypIPv6)
+    req = append(req, ip.To16()...)
+  default:
+    if len(host) > 255 {
+      return nil, fmt.Errorf("host name too long for SOCKS5: %s", host)
+    }
+    req = append(req, socks5AtypDomain, byte(len(host)))
+    req = append(req, host...)
+  }
+  req = binary.BigEndian.AppendUint16(req, uint16(port))
+  if _, err := conn.Write(req); err != nil {
+    return nil, fmt.Errorf("failed to send SOCKS5 connect request: %w", err)
+  }
+
+  // 3. 读取应答: VER REP RSV ATYP BND.ADDR BND.PORT
+  head := make([]byte, 4)
+  if _, err := io.ReadFull(conn, head); err != nil {
+    return nil, fmt.Errorf("failed to read SOCKS5 connect reply: %w", err)
+  }
+  if head[1] != 0x00 {
+    if msg, ok := socks5Replies[head[1]]; ok {
+      return nil, fmt.Errorf("SOCKS5 connect to %s failed: %s", net.JoinHostPort(host, strconv.Itoa(port)), msg)
+    }
+    return nil, fmt.Errorf("SOCKS5 connect to %s failed: reply code %d", net.JoinHostPort(host, strconv.Itoa(port)), head[1])
+  }
+
+  var skip int
+  switch head[3] {
+  case socks5AtypIPv4:
+    skip = net.IPv4len
+  case socks5AtypIPv6:
+    skip = net.IPv6len
+  case socks5AtypDomain:
+    l := make([]byte, 1)
+    if _, err := io.ReadFull(conn, l); err != nil {
+      return nil, fmt.Errorf("failed to read SOCKS5 bound address: %w", err)
+    }
+    skip = int(l[0])
+  default:
+    return nil, fmt.Errorf("unexpected SOCKS5 address type %d", head[3])
+  }
+  if _, err := io.CopyN(io.Discard, conn, int64(skip+2)); err != nil {
+    return nil, fmt.Errorf("failed to read SOCKS5 bound address: %w", err)
+  }
+
+  return conn, nil
+}
+
+// bufferedConn 在 net.Conn 之上保留握手阶段已缓冲但未消费的数据。
+type bufferedConn struct {
+  net.Conn
+  r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+  return c.r.Read(p)
+}
+
+// ReadFrom 交给底层连接处理，使 TCP 连接上的 io.Copy 仍然可以使用 sendfile/splice。
+func (c *bufferedConn) ReadFrom(r io.Reader) (int64, error) {
+  if rf, ok := c.Conn.(io.ReaderFrom); ok {
+    return rf.ReadFrom(r)
+  }
+  return io.Copy(struct{ io.Writer }{c.Conn}, r)
+}
+
+// httpConnect 在已建立的代理连接上发送 HTTP CONNECT 请求。
+func httpConnect(conn net.Conn, proxy *url.URL, host string, port int) (net.Conn, error) {
+  target := net.JoinHostPort(host, strconv.Itoa(port))
+
+  var sb strings.Builder
+  fmt.Fprintf(&sb, "CONNECT %s HTTP/1.1\r\n", target)
+  fmt.Fprintf(&sb, "Host: %s\r\n", target)
+  if user := proxy.User.Username(); user != "" {
+    pass, _ := proxy.User.Password()
+    token := base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+    fmt.Fprintf(&sb, "Proxy-Authorization: Basic %s\r\n", token)
+  }
+  sb.WriteString("\r\n")
+  if _, err := io.WriteString(conn, sb.String()); err != nil {
+    return nil, fmt.Errorf("failed to send CONNECT request: %w", err)
+  }
+
+  // 编辑器会在连接建立后立即发送握手行，它可能和代理应答一起被读入缓冲区
+  br := bufio.NewReader(conn)
+  resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+  if err != nil {
+    return nil, fmt.Errorf("failed to read CONNECT response: %w", err)
+  }
+  resp.Body.Close()
+
+  switch {
+  case resp.StatusCode == http.StatusProxyAuthRequired:
+    return nil, fmt.Errorf("%w: %s", ErrProxyAuth, resp.Status)
+  case resp.StatusCode < 200 || resp.StatusCode > 299:
+    return nil, fmt.Errorf("CONNECT to %s rejected: %s", target, resp.Status)
+  }
+
+  return &bufferedConn{Conn: conn, r: br}, nil
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "encoding/binary"
+  "errors"
+  "io"
+  "net"
+  "net/http"
+  "net/url"
+  "strings"
+  "testing"
+)
+
+func TestMatchNoProxy(t *testing.T) {
+  tests := []struct {
+    noProxy string
+    host    string
+    port    int
+    want    bool
+  }{
+    {"*", "editor.example.com", 52698, true},
+    {"example.com", "example.com", 52698, true},
+    {"example.com", "editor.example.com", 52698, true},
+    {"example.com", "badexample.com", 52698, false},
+    {".example.com", "editor.example.com", 52698, true},
+    {".example.com", "example.com", 52698, true},
+    {"*.example.com", "editor.example.com", 52698, true},
+    {"Example.COM.", "editor.example.com.", 52698, true},
+    {"other.org, example.com", "editor.example.com", 52698, true},
+    {"other.org,,", "editor.example.com", 52698, false},
+    // 带端口的条目只对该端口生效
+    {"example.com:52698", "editor.example.com", 52698, true},
+    {"example.com:22", "editor.example.com", 52698, false},
+    {"10.0.0.5", "10.0.0.5", 52698, true},
+    {"10.0.0.5", "10.0.0.6", 52698, false},
+    {"10.0.0.5:52698", "10.0.0.5", 52698, true},
+    {"10.0.0.0/8", "10.1.2.3", 52698, true},
+    {"10.0.0.0/8", "192.168.1.1", 52698, false},
+    {"10.0.0.0/8", "ten.example.com", 52698, false},
+    {"::1", "::1", 52698, true},
+    {"[::1]:52698", "::1", 52698, true},
+    {"fd00::/8", "fd00::1", 52698, true},
+    {"", "example.com", 52698, false},
+  }
+  for _, tt := range tests {
+    if got := matchNoProxy(tt.noProxy, tt.host, tt.port); got != tt.want {
+      t.Errorf("matchNoProxy(%q, %s, %d) = %v, want %v", tt.noProxy, tt.host, tt.port, got, tt.want)
+    }
+  }
+}
+
+func TestResolveProxy(t *testing.T) {
+  t.Setenv("ALL_PROXY", "socks5h://env-proxy:1080")
+  t.Setenv("NO_PROXY", ".internal")
+  tests := []struct {
+    flag string
+    host string
+    want string // 空字符串表示直连
+  }{
+    {"", "editor.example.com", "socks5h://env-proxy:1080"},
+    {"", "editor.internal", ""},
+    // 环境变量中的代理不用于回环地址，--proxy 则总是生效
+    {"", "127.0.0.1", ""},
+    {"http://proxy:3128", "127.0.0.1", "http://proxy:3128"},
+    {"proxy:3128", "editor.example.com", "http://proxy:3128"},
+    {"none", "editor.example.com", ""},
+    {"direct", "editor.example.com", ""},
+  }
+  for _, tt := range tests {
+    u, err := resolveProxy(tt.flag, tt.host, 52698)
+    if err != nil {
+      t.Errorf("resolveProxy(%q, %s) = %v", tt.flag, tt.host, err)
+      continue
+    }
+    got := ""
+    if u != nil {
+      got = u.String()
+    }
+    if got != tt.want {
+      t.Errorf("resolveProxy(%q, %s) = %q, want %q", tt.flag, tt.host, got, tt.want)
+    }
+  }
+  for _, bad := range []string{"ftp://proxy:21", "socks5://:1080"} {
+    if _, err := resolveProxy(bad, "editor.example.com", 52698); err == nil {
+      t.Errorf("resolveProxy(%q) succeeded", bad)
+    }
+  }
+}
+
+// startTestProxy 在本地端口上运行 serve，每个连接一次。
+func startTestProxy(t *testing.T, serve func(c net.Conn)) string {
+  t.Helper()
+  ln, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() { ln.Close() })
+  go func() {
+    for {
+      c, err := ln.Accept()
+      if err != nil {
+        return
+      }
+      go func() {
+        defer c.Close()
+        serve(c)
+      }()
+    }
+  }()
+  return ln.Addr().String()
+}
+
+// testSocks5Server 是脚本化的 SOCKS5 代理：按 method 选择认证方式，检查用户名和密码，
+// 记录 CONNECT 请求，以 reply 应答；成功时在隧道中发送编辑器的握手行。
+type testSocks5Server struct {
+  method   byte
+  user     string
+  pass     string
+  reply    byte
+  requests chan []byte
+}
+
+func (s *testSocks5Server) serve(c net.Conn) {
+  br := bufio.NewReader(c)
+  head := make([]byte, 2)
+  if _, err := io.ReadFull(br, head); err != nil {
+    return
+  }
+  methods := make([]byte, head[1])
+  if _, err := io.ReadFull(br, methods); err != nil {
+    return
+  }
+  c.Write([]byte{socks5Version, s.method})
+  switch s.method {
+  case socks5AuthNoAccept:
+    return
+  case socks5AuthPassword:
+    var auth [2]byte
+    io.ReadFull(br, auth[:])
+    user := make([]byte, auth[1])
+    io.ReadFull(br, user)
+    plen, _ := br.ReadByte()
+    pass := make([]byte, plen)
+    io.ReadFull(br, pass)
+    if string(user) != s.user || string(pass) != s.pass {
+      c.Write([]byte{0x01, 0x01})
+      return
+    }
+    c.Write([]byte{0x01, 0x00})
+  }
+
+  req := make([]byte, 4)
+  if _, err := io.ReadFull(br, req); err != nil {
+    return
+  }
+  var addr []byte
+  switch req[3] {
+  case socks5AtypIPv4:
+    addr = make([]byte, net.IPv4len+2)
+  case socks5AtypIPv6:
+    addr = make([]byte, net.IPv6len+2)
+  case socks5AtypDomain:
+    n, _ := br.ReadByte()
+    req = append(req, n)
+    addr = make([]byte, int(n)+2)
+  }
+  io.ReadFull(br, addr)
+  s.requests <- append(req, addr...)
+
+  // 应答中的绑定地址使用域名形式，客户端必须按长度跳过它
+  resp := []byte{socks5Version, s.reply, 0x00, socks5AtypDomain, 5}
+  resp = append(resp, "bound"...)
+  resp = binary.BigEndian.AppendUint16(resp, 4242)
+  if s.reply == 0x00 {
+    resp = append(resp, "220 editor\n"...)
+  }
+  c.Write(resp)
+}
+
+func TestSocks5Connect(t *testing.T) {
+  domainRequest := func(host string, port uint16) []byte {
+    req := []byte{socks5Version, socks5CmdConnect, 0x00, socks5AtypDomain, byte(len(host))}
+    return binary.BigEndian.AppendUint16(append(req, host...), port)
+  }
+  tests := []struct {
+    name    string
+    proxy   string
+    server  testSocks5Server
+    host    string
+    wantReq []byte
+    wantErr string
+    auth    bool // 期望 ErrProxyAuth
+  }{
+    {name: "no auth", proxy: "socks5h://%s", server: testSocks5Server{method: socks5AuthNone},
+      host: "editor.example.com", wantReq: domainRequest("editor.example.com", 52698)},
+    {name: "password", proxy: "socks5h://alice:s3cret@%s", server: testSocks5Server{method: socks5AuthPassword, user: "alice", pass: "s3cret"},
+      host: "editor.example.com", wantReq: domainRequest("editor.example.com", 52698)},
+    {name: "IPv4 target", proxy: "socks5://%s", server: testSocks5Server{method: socks5AuthNone},
+      host: "10.1.2.3", wantReq: []byte{socks5Version, socks5CmdConnect, 0x00, socks5AtypIPv4, 10, 1, 2, 3, 0xcd, 0xda}},
+    {name: "IPv6 target", proxy: "socks5://%s", server: testSocks5Server{method: socks5AuthNone},
+      host: "::1", wantReq: append([]byte{socks5Version, socks5CmdConnect, 0x00, socks5AtypIPv6}, append(net.IPv6loopback.To16(), 0xcd, 0xda)...)},
+    {name: "wrong password", proxy: "socks5h://alice:wrong@%s", server: testSocks5Server{method: socks5AuthPassword, user: "alice", pass: "s3cret"},
+      host: "editor.example.com", auth: true},
+    {name: "password required", proxy: "socks5h://%s", server: testSocks5Server{method: socks5AuthPassword},
+      host: "editor.example.com", auth: true},
+    {name: "no acceptable method", proxy: "socks5h://%s", server: testSocks5Server{method: socks5AuthNoAccept},
+      host: "editor.example.com", auth: true},
+    {name: "connection refused", proxy: "socks5h://%s", server: testSocks5Server{method: socks5AuthNone, reply: 0x05},
+      host: "editor.example.com", wantErr: "connection refused"},
+    {name: "unknown reply", proxy: "socks5h://%s", server: testSocks5Server{method: socks5AuthNone, reply: 0x42},
+      host: "editor.example.com", wantErr: "reply code 66"},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      server := tt.server
+      server.requests = make(chan []byte, 1)
+      addr := startTestProxy(t, server.serve)
+      proxy, err := url.Parse(strings.Replace(tt.proxy, "%s", addr, 1))
+      if err != nil {
+        t.Fatal(err)
+      }
+
+      conn, err := dialProxy(proxy, tt.host, 52698)
+      switch {
+      case tt.auth:
+        if !errors.Is(err, ErrProxyAuth) {
+          t.Fatalf("dialProxy = %v, want ErrProxyAuth", err)
+        }
+        return
+      case tt.wantErr != "":
+        if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+          t.Fatalf("dialProxy = %v, want an error containing %q", err, tt.wantErr)
+        }
+        return
+      case err != nil:
+        t.Fatal(err)
+      }
+      defer conn.Close()
+      if req := <-server.requests; !bytes.Equal(req, tt.wantReq) {
+        t.Errorf("CONNECT request = %v, want %v", req, tt.wantReq)
+      }
+      // 握手之后的数据属于隧道
+      line, err := bufio.NewReader(conn).ReadString('\n')
+      if err != nil || line != "220 editor\n" {
+        t.Errorf("read %q, %v through the tunnel", line, err)
+      }
+    })
+  }
+}
+
+func TestHTTPConnect(t *testing.T) {
+  tests := []struct {
+    name      string
+    proxy     string
+    status    string
+    wantAuth  string
+    wantErr   string
+    wantProxy bool // 期望 ErrProxyAuth
+  }{
+    {name: "established", proxy: "http://%s", status: "200 Connection established"},
+    {name: "basic auth", proxy: "http://alice:s3cret@%s", status: "200 OK", wantAuth: "Basic YWxpY2U6czNjcmV0"},
+    {name: "auth required", proxy: "http://%s", status: "407 Proxy Authentication Required", wantProxy: true},
+    {name: "forbidden", proxy: "http://%s", status: "403 Forbidden", wantErr: "rejected: 403 Forbidden"},
+    {name: "bad gateway", proxy: "http://%s", status: "502 Bad Gateway", wantErr: "rejected: 502 Bad Gateway"},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      requests := make(chan *http.Request, 1)
+      addr := startTestProxy(t, func(c net.Conn) {
+        req, err := http.ReadRequest(bufio.NewReader(c))
+        if err != nil {
+          return
+        }
+        requests <- req
+        // 编辑器的握手行与代理应答在同一次写入中到达
+        io.WriteString(c, "HTTP/1.1 "+tt.status+"\r\n\r\n220 editor\n")
+      })
+      proxy, _ := url.Parse(strings.Replace(tt.proxy, "%s", addr, 1))
+
+      conn, err := dialProxy(proxy, "editor.example.com", 52698)
+      switch {
+      case tt.wantProxy:
+        if !errors.Is(err, ErrProxyAuth) {
+          t.Fatalf("dialProxy = %v, want ErrProxyAuth", err)
+        }
+        return
+      case tt.wantErr != "":
+        if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+          t.Fatalf("dialProxy = %v, want an error containing %q", err, tt.wantErr)
+        }
+        return
+      case err != nil:
+        t.Fatal(err)
+      }
+      defer conn.Close()
+
+      req := <-requests
+      if req.Method != http.MethodConnect || req.Host != "editor.example.com:52698" {
+        t.Errorf("request = %s %s, want CONNECT editor.example.com:52698", req.Method, req.Host)
+      }
+      if got := req.Header.Get("Proxy-Authorization"); got != tt.wantAuth {
+        t.Errorf("Proxy-Authorization = %q, want %q", got, tt.wantAuth)
+      }
+      line, err := bufio.NewReader(conn).ReadString('\n')
+      if err != nil || line != "220 editor\n" {
+        t.Errorf("read %q, %v after the CONNECT response", line, err)
+      }
+    })
+  }
+}
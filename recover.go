@@ -0,0 +1,417 @@
+package main
+
+import (
+  "crypto/rand"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "text/tabwriter"
+  "time"
+)
+
+const recoverUsage = `Usage: gomate recover <command> [options]
+
+Commands:
+  list                       List the saves that could not be written to their files
+  apply <id> [--to FILE]     Write a recovered save to its file (or to FILE) and remove it
+  discard <id>...            Remove recovered saves without applying them
+
+Options:
+  --recovery-dir DIR         Use DIR instead of the default recovery directory ($GOMATE_RECOVERY_DIR)
+`
+
+// recoveryMetaSuffix 和 recoveryDataSuffix 是恢复文件的元数据和内容的后缀
+const (
+  recoveryMetaSuffix = ".json"
+  recoveryDataSuffix = ".data"
+)
+
+// maxSessionRecoveries 是一个会话最多保存的恢复文件数，反复失败的保存不会占满磁盘
+const maxSessionRecoveries = 16
+
+// sessionRecoveries 是本会话已经保存的恢复文件数，只在处理命令的 Goroutine 中访问
+var sessionRecoveries int
+
+// SaveError 表示编辑器发来的保存无法写入文件 (磁盘已满、没有权限、重命名失败等)。
+// 会话不会因此结束，收到的内容保存在恢复文件中。
+type SaveError struct {
+  File        string // 目标文件，token 未知时为空
+  Err         error
+  Recovery    string // 恢复文件的 ID，写入恢复文件也失败时为空
+  RecoveryDir string
+}
+
+func (e *SaveError) Error() string {
+  target := e.File
+  if target == "" {
+    target = "unknown file"
+  }
+  if e.Recovery == "" {
+    return fmt.Sprintf("failed to save %s: %v; the content could not be kept", target, e.Err)
+  }
+  command := "gomate recover apply " + e.Recovery
+  if dir, _ := defaultRecoveryDir(); dir != e.RecoveryDir {
+    command = fmt.Sprintf("gomate recover --recovery-dir %s apply %s", e.RecoveryDir, e.Recovery)
+  }
+  return fmt.Sprintf("failed to save %s: %v; the content was kept, restore it with: %s", target, e.Err, command)
+}
+
+func (e *SaveError) Unwrap() error {
+  return e.Err
+}
+
+// RecoveryEntry 是恢复文件的元数据，以 JSON 形式写在内容旁边。
+type RecoveryEntry struct {
+  ID       string    `json:"-"`
+  File     string    `json:"file,omitempty"`
+  Token    string    `json:"token"`
+  Time     time.Time `json:"time"`
+  Size     int64     `json:"size"`
+  Error    string    `json:"error"`
+  PID      int       `json:"pid"`
+  Hostname string    `json:"hostname,omitempty"`
+}
+
+// DataPath 返回恢复内容的路径。
+func (e RecoveryEntry) DataPath(dir string) string {
+  return filepath.Join(dir, e.ID+recoveryDataSuffix)
+}
+
+// defaultRecoveryDir 返回恢复文件的默认目录：$GOMATE_RECOVERY_DIR，或者用户状态目录下的 gomate/recovery。
+// 锁目录可能位于重启后清空的 $XDG_RUNTIME_DIR，因此不把恢复文件放在那里。
+func defaultRecoveryDir() (string, error) {
+  if dir := os.Getenv("GOMATE_RECOVERY_DIR"); dir != "" {
+    return dir, nil
+  }
+  state, err := userStateDir()
+  if err != nil {
+    return "", err
+  }
+  return filepath.Join(state, "gomate", "recovery"), nil
+}
+
+// recoveryDir 返回可以写入恢复文件的目录，必要时以 0700 权限创建它，并确认它属于当前用户、其他用户无法访问。
+// 恢复文件包含被编辑文件的内容，因此不退回到所有用户共享的系统临时目录。
+func recoveryDir() (string, error) {
+  dir, err := defaultRecoveryDir()
+  if err != nil {
+    return "", err
+  }
+  if err := ensurePrivateDir(dir); err != nil {
+    return "", err
+  }
+  return dir, nil
+}
+
+// recoveryIDBytes 是恢复文件 ID 中随机后缀的字节数
+const recoveryIDBytes = 4
+
+// newRecoveryID 返回 "时间-PID-随机后缀-文件名" 形式的恢复文件 ID。
+// 同一秒内同一进程保存同名文件时，随机后缀使 ID 仍然不同；写入时另以 O_EXCL 保证不会覆盖已有的恢复文件。
+func newRecoveryID(t time.Time, pid int, filename string) (string, error) {
+  b := make([]byte, recoveryIDBytes)
+  if _, err := rand.Read(b); err != nil {
+    return "", err
+  }
+  name := "unknown"
+  if filename != "" {
+    name = filepath.Base(filename)
+  }
+  return fmt.Sprintf("%s-%d-%s-%s", t.Format("20060102-150405"), pid, hex.EncodeToString(b), name), nil
+}
+
+// saveRecovery 把无法写入 filename 的内容保存为恢复文件，返回所在目录和恢复文件的 ID。
+// content 是接收内容的临时文件，与恢复目录位于同一文件系统时直接重命名，否则复制，内容不经过内存。
+func saveRecovery(filename string, token string, content *os.File, saveErr error) (string, string, error) {
+  if sessionRecoveries >= maxSessionRecoveries {
+    return "", "", fmt.Errorf("already kept %d recovery files in this session", sessionRecoveries)
+  }
+  if content == nil {
+    return "", "", errors.New("the content could not be written to a temporary file")
+  }
+  // 关闭时才报告的写入错误意味着内容不完整，不能作为恢复文件
+  if err := content.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+    return "", "", err
+  }
+  st, err := os.Stat(content.Name())
+  if err != nil {
+    return "", "", err
+  }
+  entry := RecoveryEntry{
+    File:  filename,
+    Token: token,
+    Time:  time.Now(),
+    Size:  st.Size(),
+    Error: saveErr.Error(),
+    PID:   os.Getpid(),
+  }
+  entry.Hostname, _ = os.Hostname()
+  if entry.ID, err = newRecoveryID(entry.Time, entry.PID, filename); err != nil {
+    return "", "", err
+  }
+  meta, err := json.MarshalIndent(entry, "", "  ")
+  if err != nil {
+    return "", "", err
+  }
+
+  dir, err := recoveryDir()
+  if err != nil {
+    return "", "", err
+  }
+  if err := moveFile(content.Name(), entry.DataPath(dir)); err != nil {
+    return "", "", err
+  }
+  // 元数据最后写入，list 只列出完整的恢复文件
+  if err := writeNewFile(filepath.Join(dir, entry.ID+recoveryMetaSuffix), meta); err != nil {
+    os.Remove(entry.DataPath(dir))
+    return "", "", err
+  }
+  sessionRecoveries++
+  slog.Warn("kept unsaved content", "file", filename, "recovery", entry.DataPath(dir))
+  return dir, entry.ID, nil
+}
+
+// moveFile 把 src 移动到 dst，dst 已经存在时返回错误而不是覆盖它：同一文件系统上建立硬链接之后删除 src，
+// 否则复制到新建的 dst 之后删除 src。
+func moveFile(src, dst string) error {
+  err := os.Link(src, dst)
+  if err == nil {
+    os.Remove(src)
+    return nil
+  }
+  if os.IsExist(err) {
+    return err
+  }
+  in, err := os.Open(src)
+  if err != nil {
+    return err
+  }
+  defer in.Close()
+  out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+  if err != nil {
+    return err
+  }
+  _, err = io.Copy(out, in)
+  if err == nil {
+    err = out.Sync()
+  }
+  if closeErr := out.Close(); err == nil {
+    err = closeErr
+  }
+  if err != nil {
+    os.Remove(dst)
+    return err
+  }
+  os.Remove(src)
+  return nil
+}
+
+// writeNewFile 以 0600 权限新建 path 并写入 content，path 已经存在时返回错误。
+func writeNewFile(path string, content []byte) error {
+  f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+  if err != nil {
+    return err
+  }
+  _, err = f.Write(content)
+  if closeErr := f.Close(); err == nil {
+    err = closeErr
+  }
+  if err != nil {
+    os.Remove(path)
+  }
+  return err
+}
+
+// listRecoveries 列出恢复目录中的恢复文件，按时间排序。
+func listRecoveries(dir string) ([]RecoveryEntry, error) {
+  files, err := os.ReadDir(dir)
+  if os.IsNotExist(err) {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  var entries []RecoveryEntry
+  for _, f := range files {
+    id, ok := strings.CutSuffix(f.Name(), recoveryMetaSuffix)
+    if !ok || f.IsDir() {
+      continue
+    }
+    entry, err := readRecovery(dir, id)
+    if err != nil {
+      slog.Warn("skipping unreadable recovery file", "path", f.Name(), "error", err)
+      continue
+    }
+    entries = append(entries, entry)
+  }
+  sort.Slice(entries, func(i, j int) bool {
+    return entries[i].Time.Before(entries[j].Time)
+  })
+  return entries, nil
+}
+
+// readRecovery 读取一个恢复文件的元数据。
+func readRecovery(dir string, id string) (RecoveryEntry, error) {
+  var entry RecoveryEntry
+  content, err := os.ReadFile(filepath.Join(dir, id+recoveryMetaSuffix))
+  if err != nil {
+    return entry, err
+  }
+  if err := json.Unmarshal(content, &entry); err != nil {
+    return entry, fmt.Errorf("invalid recovery metadata: %w", err)
+  }
+  entry.ID = id
+  return entry, nil
+}
+
+// resolveRecovery 按 ID 或其唯一前缀查找恢复文件。
+func resolveRecovery(dir string, arg string) (RecoveryEntry, error) {
+  entries, err := listRecoveries(dir)
+  if err != nil {
+    return RecoveryEntry{}, err
+  }
+  var matches []RecoveryEntry
+  for _, e := range entries {
+    if e.ID == arg {
+      return e, nil
+    }
+    if strings.HasPrefix(e.ID, arg) {
+      matches = append(matches, e)
+    }
+  }
+  switch len(matches) {
+  case 0:
+    return RecoveryEntry{}, fmt.Errorf("no recovered save %s", arg)
+  case 1:
+    return matches[0], nil
+  }
+  return RecoveryEntry{}, fmt.Errorf("recovery ID %q is ambiguous (%d matches)", arg, len(matches))
+}
+
+// removeRecovery 删除一个恢复文件的内容和元数据。
+func removeRecovery(dir string, e RecoveryEntry) error {
+  if err := os.Remove(filepath.Join(dir, e.ID+recoveryMetaSuffix)); err != nil {
+    return err
+  }
+  if err := os.Remove(e.DataPath(dir)); err != nil && !os.IsNotExist(err) {
+    return err
+  }
+  return nil
+}
+
+// runRecoverCommand 实现 gomate recover 子命令，返回进程退出码。
+func runRecoverCommand(args []string) int {
+  fs := newSubcommandFlags("gomate recover", recoverUsage)
+  var dir, to string
+  defaultDir, _ := defaultRecoveryDir()
+  fs.StringVar(&dir, "recovery-dir", defaultDir, "Recovery directory")
+  fs.StringVar(&to, "to", "", "With apply: write the recovered save to this file instead")
+  command, args, ok := fs.parse(args)
+  if !ok {
+    return exitUsage
+  }
+  if dir == "" {
+    fmt.Fprintln(os.Stderr, "gomate: cannot determine the recovery directory, use --recovery-dir")
+    return exitError
+  }
+  slog.Debug("recovery directory", "dir", dir)
+
+  switch command {
+  case "list":
+    return recoverList(dir)
+  case "apply":
+    if len(args) != 1 {
+      fs.Usage()
+      return exitUsage
+    }
+    return recoverApply(dir, args[0], to)
+  case "discard":
+    if len(args) == 0 {
+      fs.Usage()
+      return exitUsage
+    }
+    return recoverDiscard(dir, args)
+  }
+  fmt.Fprintf(os.Stderr, "gomate recover: unknown command %q\n", command)
+  fs.Usage()
+  return exitUsage
+}
+
+func recoverList(dir string) int {
+  entries, err := listRecoveries(dir)
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "gomate: failed to read recovery directory: %v\n", err)
+    return 1
+  }
+  if len(entries) == 0 {
+    fmt.Printf("No recovered saves in %s\n", dir)
+    return 0
+  }
+
+  w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+  fmt.Fprintln(w, "ID\tSAVED\tSIZE\tFILE\tERROR")
+  for _, e := range entries {
+    fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", e.ID, formatLockTime(e.Time), e.Size, orDash(e.File), e.Error)
+  }
+  w.Flush()
+  return 0
+}
+
+func recoverApply(dir string, arg string, to string) int {
+  e, err := resolveRecovery(dir, arg)
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "gomate: %v\n", err)
+    return 1
+  }
+  target := to
+  if target == "" {
+    target = e.File
+  }
+  if target == "" {
+    fmt.Fprintf(os.Stderr, "gomate: the file of %s is unknown, use --to FILE\n", e.ID)
+    return 1
+  }
+
+  data, err := os.Open(e.DataPath(dir))
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "gomate: %v\n", err)
+    return 1
+  }
+  // 删除恢复文件之前关闭它，Windows 不能删除仍被打开的文件
+  err = writeFileAtomic(target, data)
+  data.Close()
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "gomate: failed to write %s: %v\n", target, err)
+    return 1
+  }
+  if err := removeRecovery(dir, e); err != nil {
+    fmt.Fprintf(os.Stderr, "gomate: wrote %s but failed to remove %s: %v\n", target, e.ID, err)
+    return 1
+  }
+  fmt.Printf("Restored %s (%d bytes from %s)\n", target, e.Size, formatLockTime(e.Time))
+  return 0
+}
+
+func recoverDiscard(dir string, args []string) int {
+  code := 0
+  for _, arg := range args {
+    e, err := resolveRecovery(dir, arg)
+    if err == nil {
+      err = removeRecovery(dir, e)
+    }
+    if err != nil {
+      fmt.Fprintf(os.Stderr, "gomate: %v\n", err)
+      code = 1
+      continue
+    }
+    fmt.Printf("Discarded %s\n", e.ID)
+  }
+  return code
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+  "errors"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+)
+
+// keepTestRecovery 在恢复目录中保存一份 content，如同它无法写入 filename。
+func keepTestRecovery(t *testing.T, filename string, content string) (string, string) {
+  t.Helper()
+  f, err := os.CreateTemp(t.TempDir(), ".incoming-")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err := f.WriteString(content); err != nil {
+    t.Fatal(err)
+  }
+  dir, id, err := saveRecovery(filename, "token", f, errors.New("disk full"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  return dir, id
+}
+
+func TestSaveRecoveryIDsAreUnique(t *testing.T) {
+  t.Setenv("GOMATE_RECOVERY_DIR", filepath.Join(t.TempDir(), "recovery"))
+  sessionRecoveries = 0
+  t.Cleanup(func() { sessionRecoveries = 0 })
+
+  // 同一秒内同一进程保存同名文件的两次失败各自得到恢复文件
+  file := filepath.Join(t.TempDir(), "notes.txt")
+  dir, first := keepTestRecovery(t, file, "first")
+  _, second := keepTestRecovery(t, file, "second")
+  if first == second {
+    t.Fatalf("both recoveries got ID %s", first)
+  }
+  entries, err := listRecoveries(dir)
+  if err != nil || len(entries) != 2 {
+    t.Fatalf("listRecoveries = %v, %v; want 2 entries", entries, err)
+  }
+  for _, e := range entries {
+    if !strings.HasSuffix(e.ID, "-notes.txt") {
+      t.Errorf("ID %s does not end with the file name", e.ID)
+    }
+  }
+}
+
+func TestNewRecoveryID(t *testing.T) {
+  now := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+  a, err := newRecoveryID(now, 42, "/srv/app/config.yml")
+  if err != nil {
+    t.Fatal(err)
+  }
+  b, _ := newRecoveryID(now, 42, "/srv/app/config.yml")
+  if a == b {
+    t.Errorf("two IDs for the same file and time are both %s", a)
+  }
+  if !strings.HasPrefix(a, "20240501-123000-42-") || !strings.HasSuffix(a, "-config.yml") {
+    t.Errorf("ID = %s", a)
+  }
+  if id, _ := newRecoveryID(now, 42, ""); !strings.HasSuffix(id, "-unknown") {
+    t.Errorf("ID without a file = %s", id)
+  }
+}
+
+func TestRecoveryFilesAreNeverOverwritten(t *testing.T) {
+  dir := t.TempDir()
+  existing := filepath.Join(dir, "kept.data")
+  if err := os.WriteFile(existing, []byte("earlier save"), 0600); err != nil {
+    t.Fatal(err)
+  }
+  src := filepath.Join(dir, ".incoming-1")
+  if err := os.WriteFile(src, []byte("later save"), 0600); err != nil {
+    t.Fatal(err)
+  }
+  if err := moveFile(src, existing); err == nil {
+    t.Error("moveFile replaced an existing recovery file")
+  }
+  if err := writeNewFile(existing, []byte("later save")); err == nil {
+    t.Error("writeNewFile replaced an existing file")
+  }
+  if got, _ := os.ReadFile(existing); string(got) != "earlier save" {
+    t.Errorf("existing recovery file holds %q", got)
+  }
+
+  moved := filepath.Join(dir, "new.data")
+  if err := moveFile(src, moved); err != nil {
+    t.Fatal(err)
+  }
+  if got, _ := os.ReadFile(moved); string(got) != "later save" {
+    t.Errorf("moved file holds %q", got)
+  }
+  if _, err := os.Stat(src); !os.IsNotExist(err) {
+    t.Errorf("source still exists after moveFile: %v", err)
+  }
+}
+
+func TestRecoverCommand(t *testing.T) {
+  env := gomateEnv(t)
+  recoveries := filepath.Join(t.TempDir(), "recovery")
+
+  tests := []struct {
+    args []string
+    want int
+  }{
+    // 选项既可以写在命令之前，也可以写在命令之后
+    {[]string{"recover", "--recovery-dir", recoveries, "list"}, exitSaved},
+    {[]string{"recover", "list", "--recovery-dir", recoveries, "-v"}, exitSaved},
+    {[]string{"recover"}, exitUsage},
+    {[]string{"recover", "--bogus", "list"}, exitUsage},
+    {[]string{"recover", "list", "--bogus"}, exitUsage},
+    {[]string{"recover", "--recovery-dir", recoveries, "apply"}, exitUsage},
+    {[]string{"recover", "--recovery-dir", recoveries, "rename"}, exitUsage},
+    {[]string{"recover", "--recovery-dir", recoveries, "discard", "missing"}, exitError},
+    {[]string{"locks", "-v", "list"}, exitSaved},
+    {[]string{"locks", "list", "--bogus"}, exitUsage},
+    {[]string{"locks"}, exitUsage},
+  }
+  for _, tt := range tests {
+    if code, stderr := runGomate(t, env, tt.args...); code != tt.want {
+      t.Errorf("gomate %s: exit %d, want %d; stderr:\n%s", strings.Join(tt.args, " "), code, tt.want, stderr)
+    }
+  }
+}
+
+func TestRecoverApplyOptionsAfterID(t *testing.T) {
+  env := gomateEnv(t)
+  t.Setenv("GOMATE_RECOVERY_DIR", filepath.Join(t.TempDir(), "recovery"))
+  sessionRecoveries = 0
+  t.Cleanup(func() { sessionRecoveries = 0 })
+  original := filepath.Join(t.TempDir(), "notes.txt")
+  dir, first := keepTestRecovery(t, original, "first save\n")
+  _, second := keepTestRecovery(t, original, "second save\n")
+
+  // recoverUsage 中的写法：选项写在恢复文件 ID 之后
+  target := filepath.Join(t.TempDir(), "restored.txt")
+  if code, stderr := runGomate(t, env, "recover", "apply", first, "--to", target, "--recovery-dir", dir); code != exitSaved {
+    t.Fatalf("recover apply <id> --to FILE: exit %d; stderr:\n%s", code, stderr)
+  }
+  if got, err := os.ReadFile(target); err != nil || string(got) != "first save\n" {
+    t.Errorf("restored file = %q, %v", got, err)
+  }
+  if _, err := readRecovery(dir, first); !os.IsNotExist(err) {
+    t.Errorf("applied recovery still exists: %v", err)
+  }
+
+  // "--" 之后的内容都是参数，即使以 - 开头
+  if code, stderr := runGomate(t, env, "recover", "--recovery-dir", dir, "discard", "--", second); code != exitSaved {
+    t.Fatalf("recover discard -- <id>: exit %d; stderr:\n%s", code, stderr)
+  }
+  if code, _ := runGomate(t, env, "recover", "--recovery-dir", dir, "discard", "--", "--to"); code != exitError {
+    t.Errorf("recover discard -- --to: exit %d, want %d for an unknown ID", code, exitError)
+  }
+}
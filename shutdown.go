@@ -0,0 +1,85 @@
+package main
+
+import (
+  "fmt"
+  "log/slog"
+  "os"
+  "sync"
+  "syscall"
+  "time"
+)
+
+// saveGracePeriod 是收到信号后等待正在进行的保存完成的时间，超时后中止并回滚这次保存。
+// saveRollbackWait 是中止保存后等待临时文件被删除的时间。测试中会缩短这两个时间。
+var (
+  saveGracePeriod  = 10 * time.Second
+  saveRollbackWait = time.Second
+)
+
+// saveInProgress 在 handleCommands 处理 save 命令期间被持有，收到信号时据此等待保存完成
+var saveInProgress sync.Mutex
+
+// shutdownSignals 是触发优雅退出的信号。SIGHUP 来自断开的 SSH 会话或关闭的终端；
+// Windows 上关闭控制台窗口时 Go 会发出 SIGTERM。
+var shutdownSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}
+
+// exitCodeForSignal 按 shell 的惯例返回被信号中断时的退出码 128+信号值。
+func exitCodeForSignal(sig os.Signal) int {
+  if s, ok := sig.(syscall.Signal); ok {
+    return 128 + int(s)
+  }
+  return exitError
+}
+
+// forwardSignals 把第一个信号交给主循环处理；再次收到信号时不再等待，立即退出。
+// 主循环开始之前 (例如连接编辑器时) 信号会一直等待，第二次中断可以放弃连接。
+func forwardSignals(sigs <-chan os.Signal, exitSignal chan<- os.Signal) {
+  sig := <-sigs // 阻塞，直到收到信号
+  slog.Info("received signal, cleaning up", "signal", sig)
+  exitSignal <- sig
+
+  sig = <-sigs
+  slog.Warn("received second signal, exiting immediately", "signal", sig)
+  fmt.Fprintf(os.Stderr, "gomate: %s again, exiting without cleanup\n", sig)
+  os.Exit(exitCodeForSignal(sig))
+}
+
+// finishSaves 等待正在进行的保存完成，然后调用 disconnect 断开编辑器 (编辑器据此得知会话结束)。
+// 超过 saveGracePeriod 时先断开连接，使保存中止并删除临时文件，原文件保持不变，此时返回 true。
+// 返回后不会再开始新的保存。
+func finishSaves(disconnect func()) (rolledBack bool) {
+  held := make(chan struct{})
+  go func() {
+    // 取得之后不再释放，阻止之后到达的保存写入文件
+    saveInProgress.Lock()
+    close(held)
+  }()
+
+  select {
+  case <-held:
+  case <-time.After(saveGracePeriod):
+    slog.Warn("save still in progress, aborting it", "after", saveGracePeriod)
+    rolledBack = true
+  }
+  disconnect()
+  if rolledBack {
+    select {
+    case <-held:
+    case <-time.After(saveRollbackWait):
+    }
+  }
+  return rolledBack
+}
+
+// reportOpenFiles 告诉用户会话被信号中断时哪些文件仍在编辑器中打开，编辑器中未保存的修改不会再写回。
+func reportOpenFiles(sig os.Signal, rolledBack bool) {
+  tokens, files := sessionTokens.OpenTokens()
+
+  fmt.Fprintf(os.Stderr, "gomate: interrupted by %s, disconnected from the editor\n", sig)
+  if rolledBack {
+    fmt.Fprintf(os.Stderr, "gomate: a save that was still in progress was aborted; the file on disk is unchanged\n")
+  }
+  for i, token := range tokens {
+    fmt.Fprintf(os.Stderr, "gomate: still open: %s (token %s); later saves in the editor will not be written\n", files[i], token)
+  }
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "errors"
+  "fmt"
+  "io"
+  "net"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "runtime"
+  "strconv"
+  "strings"
+  "syscall"
+  "testing"
+  "time"
+)
+
+type testSignal struct{}
+
+func (testSignal) String() string { return "test signal" }
+func (testSignal) Signal()        {}
+
+func TestExitCodeForSignal(t *testing.T) {
+  tests := []struct {
+    sig  os.Signal
+    want int
+  }{
+    {syscall.SIGINT, 130},
+    {syscall.SIGTERM, 143},
+    {syscall.SIGHUP, 129},
+    {testSignal{}, exitError},
+  }
+  for _, tt := range tests {
+    if got := exitCodeForSignal(tt.sig); got != tt.want {
+      t.Errorf("exitCodeForSignal(%v) = %d, want %d", tt.sig, got, tt.want)
+    }
+  }
+}
+
+// withSaveTimeouts 在测试期间缩短 finishSaves 的等待时间，并在测试结束时释放 finishSaves 取得的 saveInProgress。
+func withSaveTimeouts(t *testing.T, grace, rollback time.Duration) {
+  previousGrace, previousRollback := saveGracePeriod, saveRollbackWait
+  saveGracePeriod, saveRollbackWait = grace, rollback
+  t.Cleanup(func() {
+    saveGracePeriod, saveRollbackWait = previousGrace, previousRollback
+    saveInProgress.Unlock()
+  })
+}
+
+func TestFinishSavesWaitsForSave(t *testing.T) {
+  quietLogs(t)
+  withSaveTimeouts(t, 5*time.Second, time.Second)
+
+  // 模拟正在进行的保存：在它结束之前不能断开编辑器
+  saveInProgress.Lock()
+  saveDone := make(chan struct{})
+  go func() {
+    time.Sleep(100 * time.Millisecond)
+    close(saveDone)
+    saveInProgress.Unlock()
+  }()
+
+  disconnected := false
+  rolledBack := finishSaves(func() {
+    select {
+    case <-saveDone:
+    default:
+      t.Error("disconnected while the save was still in progress")
+    }
+    disconnected = true
+  })
+  if rolledBack || !disconnected {
+    t.Errorf("finishSaves = %v, disconnected %v; want the save to complete, then disconnect", rolledBack, disconnected)
+  }
+  // 之后到达的保存不能再开始
+  if saveInProgress.TryLock() {
+    saveInProgress.Unlock()
+    t.Error("a new save could start after finishSaves returned")
+  }
+}
+
+func TestFinishSavesAbortsStuckSave(t *testing.T) {
+  quietLogs(t)
+  withSaveTimeouts(t, 50*time.Millisecond, time.Second)
+
+  // 保存一直卡住 (编辑器停止发送数据)；断开连接使它出错返回
+  saveInProgress.Lock()
+  start := time.Now()
+  rolledBack := finishSaves(func() { saveInProgress.Unlock() })
+  if !rolledBack {
+    t.Error("finishSaves did not report the aborted save")
+  }
+  if elapsed := time.Since(start); elapsed < saveGracePeriod {
+    t.Errorf("aborted after %v, before the grace period of %v", elapsed, saveGracePeriod)
+  }
+}
+
+// TestSignalDuringSave 在编辑器发送保存内容的中途向 gomate 发送 SIGTERM：
+// 保存应当完成并写入文件，之后 gomate 断开编辑器并以 128+15 退出。
+func TestSignalDuringSave(t *testing.T) {
+  if runtime.GOOS == "windows" {
+    t.Skip("cannot send SIGTERM to a process on Windows")
+  }
+  env := gomateEnv(t)
+  file := filepath.Join(t.TempDir(), "notes.txt")
+  if err := os.WriteFile(file, []byte("original\n"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  reply := []byte(strings.Repeat("saved while shutting down\n", 100))
+
+  ln, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer ln.Close()
+  host, port, _ := net.SplitHostPort(ln.Addr().String())
+  cmd := exec.Command(os.Args[0], "-w", "-no-discover", "-h", host, "-p", port, file)
+  cmd.Env = env
+  var stderr bytes.Buffer
+  cmd.Stderr = &stderr
+  if err := cmd.Start(); err != nil {
+    t.Fatal(err)
+  }
+
+  editorErr := make(chan error, 1)
+  go func() {
+    editorErr <- func() error {
+      c, err := ln.Accept()
+      if err != nil {
+        return err
+      }
+      defer c.Close()
+      fmt.Fprintln(c, "220 signalEditor 1.0")
+      br := bufio.NewReader(c)
+      token, size := "", int64(-1)
+      for size < 0 {
+        line, err := br.ReadString('\n')
+        if err != nil {
+          return err
+        }
+        name, value, _ := strings.Cut(strings.TrimSuffix(line, "\n"), ": ")
+        switch name {
+        case "token":
+          token = value
+        case "data":
+          size, _ = strconv.ParseInt(value, 10, 64)
+        }
+      }
+      if _, err := io.CopyN(io.Discard, br, size+3); err != nil {
+        return err
+      }
+
+      // 先发送一半内容，此时保存正在进行
+      fmt.Fprintf(c, "save\ntoken: %s\ndata: %d\n", token, len(reply))
+      c.Write(reply[:len(reply)/2])
+      time.Sleep(100 * time.Millisecond)
+      if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+        return err
+      }
+      time.Sleep(200 * time.Millisecond)
+      c.Write(reply[len(reply)/2:])
+      c.Write([]byte("\n"))
+      // gomate 在保存完成后断开连接；套接字中仍有未读数据时关闭会表现为连接被重置
+      io.Copy(io.Discard, br)
+      return nil
+    }()
+  }()
+
+  err = cmd.Wait()
+  if editorErr := <-editorErr; editorErr != nil {
+    t.Fatalf("editor: %v\ngomate stderr:\n%s", editorErr, stderr.String())
+  }
+  var exitErr *exec.ExitError
+  if !errors.As(err, &exitErr) || exitErr.ExitCode() != 128+int(syscall.SIGTERM) {
+    t.Fatalf("gomate exited with %v, want %d; stderr:\n%s", err, 128+int(syscall.SIGTERM), stderr.String())
+  }
+  if got, _ := os.ReadFile(file); !bytes.Equal(got, reply) {
+    t.Errorf("file has %d bytes, want the %d bytes of the save in progress", len(got), len(reply))
+  }
+  if !strings.Contains(stderr.String(), "interrupted by terminated") || strings.Contains(stderr.String(), "aborted") {
+    t.Errorf("unexpected stderr:\n%s", stderr.String())
+  }
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "fmt"
+  "io"
+  "os"
+  "path/filepath"
+)
+
+// spoolFile 接收编辑器发来的保存内容。写入出错 (磁盘已满等) 之后不再写入，但仍然接受后续数据，
+// 连接上剩余的内容照常读掉，与编辑器保持同步；出错的原因记录在 err 中。
+type spoolFile struct {
+  f   *os.File // 为 nil 时内容无处可写，只能丢弃
+  err error
+}
+
+func (s *spoolFile) Write(p []byte) (int, error) {
+  if s.err == nil {
+    if _, err := s.f.Write(p); err != nil {
+      s.err = fmt.Errorf("failed to write temporary file: %w", err)
+    }
+  }
+  return len(p), nil
+}
+
+// Remove 关闭并删除临时文件，已经重命名为目标文件或恢复文件时只是关闭。
+func (s *spoolFile) Remove() {
+  if s.f != nil {
+    removeSaveTemp(s.f)
+  }
+}
+
+// createSpool 创建接收 filename 的保存内容的临时文件。通常位于目标文件所在的目录，保存成功时直接重命名为目标文件；
+// 无法在那里创建时 (没有权限、目录无法创建等) 改为在恢复目录中创建，内容只能保存为恢复文件，
+// 此时返回在目标目录中创建失败的原因。两处都无法创建时内容被丢弃。
+func createSpool(filename string) (*spoolFile, error) {
+  f, err := createSaveTemp(filename)
+  if err == nil {
+    return &spoolFile{f: f}, nil
+  }
+  if dir, dirErr := recoveryDir(); dirErr == nil {
+    if tmp, tmpErr := os.CreateTemp(dir, ".incoming-"); tmpErr == nil {
+      return &spoolFile{f: tmp}, err
+    }
+  }
+  return &spoolFile{err: err}, err
+}
+
+// decompressSpool 把 src 中压缩的保存内容解压到同一目录中的另一个临时文件，
+// 返回它、解压后的字节数和解压后内容的 SHA-256 (十六进制)。
+func decompressSpool(src *spoolFile, caps Capabilities, encoding string, limit int64) (*spoolFile, int64, string, error) {
+  if _, err := src.f.Seek(0, io.SeekStart); err != nil {
+    return nil, 0, "", fmt.Errorf("failed to read temporary file: %w", err)
+  }
+  f, err := os.CreateTemp(filepath.Dir(src.f.Name()), filepath.Base(src.f.Name())+".plain-")
+  if err != nil {
+    return nil, 0, "", fmt.Errorf("failed to create temporary file: %w", err)
+  }
+  plain := &spoolFile{f: f}
+  digest := sha256.New()
+  n, err := decompressTo(io.MultiWriter(plain, digest), src.f, caps, encoding, limit)
+  if err == nil {
+    err = plain.err
+  }
+  if err != nil {
+    plain.Remove()
+    return nil, 0, "", err
+  }
+  return plain, n, hex.EncodeToString(digest.Sum(nil)), nil
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+  "crypto/ed25519"
+  "crypto/rand"
+  "errors"
+  "fmt"
+  "log/slog"
+  "net"
+  "os"
+  "os/user"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+
+  "golang.org/x/crypto/ssh"
+  "golang.org/x/crypto/ssh/agent"
+  "golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+  // sshDialTimeout 限制每一跳 SSH 连接的建立和认证时间
+  sshDialTimeout = 30 * time.Second
+  // sshKeepAliveInterval 是保活请求的发送间隔，用于及时发现断开的隧道
+  sshKeepAliveInterval = 30 * time.Second
+)
+
+// sshDefaultIdentities 是未指定 --ssh-identity 时尝试加载的私钥 (相对于 ~/.ssh)
+var sshDefaultIdentities = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// sshTarget 是一跳 SSH 服务器的地址。
+type sshTarget struct {
+  User string
+  Host string
+  Port int
+}
+
+func (t sshTarget) Address() string {
+  return net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
+}
+
+func (t sshTarget) String() string {
+  return t.User + "@" + t.Address()
+}
+
+// parseSSHTarget 解析 [user@]host[:port] 形式的地址，缺省用户为当前登录用户，缺省端口为 22。
+func parseSSHTarget(s string, defaultUser string) (sshTarget, error) {
+  t := sshTarget{User: defaultUser, Port: 22}
+  if i := strings.LastIndex(s, "@"); i >= 0 {
+    t.User = s[:i]
+    s = s[i+1:]
+  }
+
+  t.Host = s
+  if h, p, err := net.SplitHostPort(s); err == nil {
+    port, err := strconv.Atoi(p)
+    if err != nil || port <= 0 || port > 65535 {
+      return t, fmt.Errorf("invalid SSH port %q", p)
+    }
+    t.Host, t.Port = h, port
+  } else {
+    t.Host = strings.Trim(s, "[]")
+  }
+
+  if t.Host == "" {
+    return t, errors.New("missing SSH host")
+  }
+  if t.User == "" {
+    return t, errors.New("missing SSH user")
+  }
+  return t, nil
+}
+
+// SSHDialer 通过 (可能经过多级跳板的) SSH 连接打开到编辑器的 direct-tcpip 通道。
+// 所有依赖都是可替换的字段，测试时可以接入进程内的 SSH 服务器。
+type SSHDialer struct {
+  // Hops 是依次经过的 SSH 服务器，最后一跳负责连接编辑器
+  Hops []sshTarget
+
+  Auth            []ssh.AuthMethod
+  HostKeyCallback ssh.HostKeyCallback
+  // HostKeyAlgorithms 为每一跳返回优先使用的主机密钥算法，可以为 nil
+  HostKeyAlgorithms func(addr string) []string
+
+  // Dial 建立到第一跳的底层连接，为 nil 时直接使用 TCP
+  Dial func(network, addr string) (net.Conn, error)
+}
+
+// sshConn 是 direct-tcpip 通道，关闭时一并关闭整条 SSH 链路。
+type sshConn struct {
+  net.Conn
+  clients []*ssh.Client
+  stop    chan struct{}
+  once    sync.Once
+}
+
+func (c *sshConn) Close() error {
+  err := c.Conn.Close()
+  c.once.Do(func() {
+    close(c.stop)
+    // 从最后一跳开始逆序关闭
+    for i := len(c.clients) - 1; i >= 0; i-- {
+      if closeErr := c.clients[i].Close(); closeErr != nil && !errors.Is(closeErr, net.ErrClosed) {
+        slog.Warn("failed to close SSH connection", "error", closeErr)
+      }
+    }
+  })
+  return err
+}
+
+// DialEditor 经由 SSH 链路连接到 host:port (从最后一跳看到的编辑器地址)。
+func (d *SSHDialer) DialEditor(host string, port int) (net.Conn, error) {
+  if len(d.Hops) == 0 {
+    return nil, errors.New("no SSH hosts configured")
+  }
+
+  dial := d.Dial
+  if dial == nil {
+    dial = (&net.Dialer{Timeout: sshDialTimeout}).Dial
+  }
+
+  var clients []*ssh.Client
+  closeAll := func() {
+    for i := len(clients) - 1; i >= 0; i-- {
+      clients[i].Close()
+    }
+  }
+
+  for i, hop := range d.Hops {
+    addr := hop.Address()
+
+    var raw net.Conn
+    var err error
+    if i == 0 {
+      raw, err = dial("tcp", addr)
+    } else {
+      raw, err = clients[i-1].Dial("tcp", addr)
+    }
+    if err != nil {
+      closeAll()
+      return nil, fmt.Errorf("failed to reach SSH host %s: %w", hop, err)
+    }
+
+    config := &ssh.ClientConfig{
+      User:            hop.User,
+      Auth:            d.Auth,
+      HostKeyCallback: d.HostKeyCallback,
+      Timeout:         sshDialTimeout,
+    }
+    if d.HostKeyAlgorithms != nil {
+      config.HostKeyAlgorithms = d.HostKeyAlgorithms(addr)
+    }
+
+    // ssh.ClientConfig.Timeout 只作用于 ssh.Dial，这里需要手动限制握手时间
+    raw.SetDeadline(time.Now().Add(sshDialTimeout))
+    c, chans, reqs, err := ssh.NewClientConn(raw, addr, config)
+    if err != nil {
+      raw.Close()
+      closeAll()
+      return nil, fmt.Errorf("SSH handshake with %s failed: %w", hop, err)
+    }
+    raw.SetDeadline(time.Time{})
+
+    slog.Debug("SSH connected", "host", hop, "server", string(c.ServerVersion()))
+    clients = append(clients, ssh.NewClient(c, chans, reqs))
+  }
+
+  last := clients[len(clients)-1]
+  target := net.JoinHostPort(host, strconv.Itoa(port))
+  ch, err := last.Dial("tcp", target)
+  if err != nil {
+    closeAll()
+    return nil, fmt.Errorf("SSH host %s could not open channel to %s: %w", d.Hops[len(d.Hops)-1], target, err)
+  }
+  slog.Debug("SSH direct-tcpip channel opened", "target", target)
+
+  conn := &sshConn{Conn: ch, clients: clients, stop: make(chan struct{})}
+  go conn.keepAlive(last)
+  return conn, nil
+}
+
+// keepAlive 定期发送 OpenSSH 保活请求，隧道失效时关闭连接以便读取方尽快返回。
+func (c *sshConn) keepAlive(client *ssh.Client) {
+  ticker := time.NewTicker(sshKeepAliveInterval)
+  defer ticker.Stop()
+  for {
+    select {
+    case <-c.stop:
+      return
+    case <-ticker.C:
+      if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+        slog.Warn("SSH keepalive failed, closing tunnel", "error", err)
+        c.Close()
+        return
+      }
+    }
+  }
+}
+
+// SSHOptions 对应 --ssh* 命令行参数。
+type SSHOptions struct {
+  Host       string // 最后一跳，[user@]host[:port]
+  Jump       string // 逗号分隔的跳板机列表，与 ssh -J 相同
+  Identity   string // 私钥文件，为空时使用 ~/.ssh 下的默认私钥
+  KnownHosts string // known_hosts 文件，为空时使用 ~/.ssh/known_hosts
+}
+
+// newSSHDialer 根据命令行参数，使用用户的私钥、ssh-agent 和 known_hosts 构造 SSHDialer。
+func newSSHDialer(opts SSHOptions) (*SSHDialer, error) {
+  defaultUser := currentUserName()
+
+  var hops []sshTarget
+  if opts.Jump != "" {
+    for _, j := range strings.Split(opts.Jump, ",") {
+      t, err := parseSSHTarget(strings.TrimSpace(j), defaultUser)
+      if err != nil {
+        return nil, fmt.Errorf("invalid --ssh-jump entry %q: %w", j, err)
+      }
+      hops = append(hops, t)
+    }
+  }
+  t, err := parseSSHTarget(opts.Host, defaultUser)
+  if err != nil {
+    return nil, fmt.Errorf("invalid --ssh host %q: %w", opts.Host, err)
+  }
+  hops = append(hops, t)
+
+  home, _ := os.UserHomeDir()
+  knownHostsFile := opts.KnownHosts
+  if knownHostsFile == "" {
+    knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+  }
+  hostKeyCallback, err := knownhosts.New(knownHostsFile)
+  if err != nil {
+    return nil, fmt.Errorf("failed to load known_hosts %s: %w", knownHostsFile, err)
+  }
+
+  auth, err := sshAuthMethods(opts.Identity, home)
+  if err != nil {
+    return nil, err
+  }
+
+  return &SSHDialer{
+    Hops:            hops,
+    Auth:            auth,
+    HostKeyCallback: hostKeyCallback,
+    HostKeyAlgorithms: func(addr string) []string {
+      return knownHostAlgorithms(hostKeyCallback, addr)
+    },
+  }, nil
+}
+
+// currentUserName 返回当前登录用户名，用作 SSH 的缺省用户。
+func currentUserName() string {
+  if u, err := user.Current(); err == nil {
+    name := u.Username
+    // Windows 上的用户名形如 DOMAIN\user
+    if i := strings.LastIndex(name, `\`); i >= 0 {
+      name = name[i+1:]
+    }
+    return name
+  }
+  return lookupEnv("USER", "USERNAME")
+}
+
+// sshAuthMethods 收集可用的认证方式：ssh-agent 优先，其次是私钥文件。
+func sshAuthMethods(identity string, home string) ([]ssh.AuthMethod, error) {
+  var methods []ssh.AuthMethod
+
+  if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+    if conn, err := net.Dial("unix", sock); err == nil {
+      slog.Debug("using ssh-agent", "socket", sock)
+      // agent 连接在进程生命周期内保持打开
+      methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+    } else {
+      slog.Warn("failed to connect to ssh-agent", "socket", sock, "error", err)
+    }
+  }
+
+  var files []string
+  if identity != "" {
+    files = []string{identity}
+  } else {
+    for _, name := range sshDefaultIdentities {
+      files = append(files, filepath.Join(home, ".ssh", name))
+    }
+  }
+
+  var signers []ssh.Signer
+  for _, file := range files {
+    pem, err := os.ReadFile(file)
+    if err != nil {
+      if identity != "" {
+        return nil, fmt.Errorf("failed to read SSH identity %s: %w", file, err)
+      }
+      continue
+    }
+    signer, err := ssh.ParsePrivateKey(pem)
+    if err != nil {
+      var passErr *ssh.PassphraseMissingError
+      if errors.As(err, &passErr) {
+        // 没有交互式输入，带口令的私钥只能通过 ssh-agent 使用
+        slog.Debug("skipping passphrase-protected key, load it into ssh-agent instead", "path", file)
+        continue
+      }
+      return nil, fmt.Errorf("failed to parse SSH identity %s: %w", file, err)
+    }
+    slog.Debug("loaded SSH identity", "path", file)
+    signers = append(signers, signer)
+  }
+  if len(signers) > 0 {
+    methods = append(methods, ssh.PublicKeys(signers...))
+  }
+
+  if len(methods) == 0 {
+    return nil, errors.New("no SSH credentials available: start ssh-agent or pass --ssh-identity")
+  }
+  return methods, nil
+}
+
+// knownHostAlgorithms 返回 known_hosts 中为 addr 记录的主机密钥算法，
+// 让服务器优先出示我们能够验证的密钥类型。
+func knownHostAlgorithms(cb ssh.HostKeyCallback, addr string) []string {
+  // 用一个不可能匹配的密钥探测 known_hosts，KeyError.Want 中列出了已知的密钥
+  _, priv, err := ed25519.GenerateKey(rand.Reader)
+  if err != nil {
+    return nil
+  }
+  probe, err := ssh.NewSignerFromKey(priv)
+  if err != nil {
+    return nil
+  }
+  tcpAddr := &net.TCPAddr{IP: net.IPv4zero}
+  err = cb(addr, tcpAddr, probe.PublicKey())
+
+  var keyErr *knownhosts.KeyError
+  if !errors.As(err, &keyErr) {
+    return nil
+  }
+
+  var algos []string
+  for _, known := range keyErr.Want {
+    switch known.Key.Type() {
+    case ssh.KeyAlgoRSA:
+      algos = append(algos, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+    default:
+      algos = append(algos, known.Key.Type())
+    }
+  }
+  return algos
+}
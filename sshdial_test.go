@@ -0,0 +1,339 @@
+package main
+
+import (
+  "bufio"
+  "crypto/ed25519"
+  "crypto/rand"
+  "io"
+  "net"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "sync"
+  "testing"
+
+  "golang.org/x/crypto/ssh"
+  "golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSSHServer 是进程内的 SSH 服务器，只接受 clientKey 认证，并像 sshd 一样处理 direct-tcpip 通道。
+type testSSHServer struct {
+  Addr    string
+  HostKey ssh.Signer
+
+  mu      sync.Mutex
+  targets []string // 收到的 direct-tcpip 通道的目标地址
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+  t.Helper()
+  _, priv, err := ed25519.GenerateKey(rand.Reader)
+  if err != nil {
+    t.Fatal(err)
+  }
+  signer, err := ssh.NewSignerFromKey(priv)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return signer
+}
+
+func startTestSSHServer(t *testing.T, clientKey ssh.PublicKey) *testSSHServer {
+  t.Helper()
+  s := &testSSHServer{HostKey: newTestSigner(t)}
+  config := &ssh.ServerConfig{
+    PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+      if string(key.Marshal()) != string(clientKey.Marshal()) {
+        return nil, io.EOF
+      }
+      return nil, nil
+    },
+  }
+  config.AddHostKey(s.HostKey)
+
+  ln, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() { ln.Close() })
+  s.Addr = ln.Addr().String()
+
+  go func() {
+    for {
+      c, err := ln.Accept()
+      if err != nil {
+        return
+      }
+      go s.serve(c, config)
+    }
+  }()
+  return s
+}
+
+func (s *testSSHServer) serve(c net.Conn, config *ssh.ServerConfig) {
+  conn, chans, reqs, err := ssh.NewServerConn(c, config)
+  if err != nil {
+    c.Close()
+    return
+  }
+  defer conn.Close()
+  go ssh.DiscardRequests(reqs)
+
+  for newCh := range chans {
+    if newCh.ChannelType() != "direct-tcpip" {
+      newCh.Reject(ssh.UnknownChannelType, "unsupported")
+      continue
+    }
+    // RFC 4254 7.2：目标主机、端口，发起方主机、端口
+    var payload struct {
+      Host     string
+      Port     uint32
+      OrigHost string
+      OrigPort uint32
+    }
+    if err := ssh.Unmarshal(newCh.ExtraData(), &payload); err != nil {
+      newCh.Reject(ssh.ConnectionFailed, err.Error())
+      continue
+    }
+    target := net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port)))
+    s.mu.Lock()
+    s.targets = append(s.targets, target)
+    s.mu.Unlock()
+
+    upstream, err := net.Dial("tcp", target)
+    if err != nil {
+      newCh.Reject(ssh.ConnectionFailed, err.Error())
+      continue
+    }
+    ch, chReqs, err := newCh.Accept()
+    if err != nil {
+      upstream.Close()
+      continue
+    }
+    go ssh.DiscardRequests(chReqs)
+    go func() {
+      io.Copy(ch, upstream)
+      ch.CloseWrite()
+    }()
+    go func() {
+      io.Copy(upstream, ch)
+      upstream.Close()
+    }()
+  }
+}
+
+func (s *testSSHServer) Targets() []string {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  return append([]string(nil), s.targets...)
+}
+
+// startEchoServer 模拟编辑器：逐行原样返回收到的内容。
+func startEchoServer(t *testing.T) (string, int) {
+  t.Helper()
+  ln, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() { ln.Close() })
+  go func() {
+    for {
+      c, err := ln.Accept()
+      if err != nil {
+        return
+      }
+      go func() {
+        defer c.Close()
+        io.Copy(c, c)
+      }()
+    }
+  }()
+  addr := ln.Addr().(*net.TCPAddr)
+  return addr.IP.String(), addr.Port
+}
+
+func mustTarget(t *testing.T, addr string) sshTarget {
+  t.Helper()
+  target, err := parseSSHTarget("tester@"+addr, "")
+  if err != nil {
+    t.Fatal(err)
+  }
+  return target
+}
+
+// writeKnownHosts 写入一个 known_hosts 文件，返回据此验证主机密钥的回调。
+func writeKnownHosts(t *testing.T, entries map[string]ssh.PublicKey) ssh.HostKeyCallback {
+  t.Helper()
+  var lines []string
+  for addr, key := range entries {
+    lines = append(lines, knownhosts.Line([]string{knownhosts.Normalize(addr)}, key))
+  }
+  path := filepath.Join(t.TempDir(), "known_hosts")
+  if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+    t.Fatal(err)
+  }
+  cb, err := knownhosts.New(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return cb
+}
+
+func roundTrip(t *testing.T, conn net.Conn, line string) {
+  t.Helper()
+  if _, err := io.WriteString(conn, line+"\n"); err != nil {
+    t.Fatalf("write: %v", err)
+  }
+  got, err := bufio.NewReader(conn).ReadString('\n')
+  if err != nil {
+    t.Fatalf("read: %v", err)
+  }
+  if strings.TrimSpace(got) != line {
+    t.Fatalf("echo = %q, want %q", got, line)
+  }
+}
+
+func TestParseSSHTarget(t *testing.T) {
+  tests := []struct {
+    in      string
+    want    sshTarget
+    wantErr bool
+  }{
+    {in: "host", want: sshTarget{User: "me", Host: "host", Port: 22}},
+    {in: "bob@host", want: sshTarget{User: "bob", Host: "host", Port: 22}},
+    {in: "bob@host:2222", want: sshTarget{User: "bob", Host: "host", Port: 2222}},
+    {in: "[::1]:2222", want: sshTarget{User: "me", Host: "::1", Port: 2222}},
+    {in: "[::1]", want: sshTarget{User: "me", Host: "::1", Port: 22}},
+    {in: "user@domain@host", want: sshTarget{User: "user@domain", Host: "host", Port: 22}},
+    {in: "host:0", wantErr: true},
+    {in: "host:ssh", wantErr: true},
+    {in: "bob@", wantErr: true},
+    {in: "@host", wantErr: true},
+  }
+  for _, tt := range tests {
+    got, err := parseSSHTarget(tt.in, "me")
+    if tt.wantErr {
+      if err == nil {
+        t.Errorf("parseSSHTarget(%q) = %+v, want error", tt.in, got)
+      }
+      continue
+    }
+    if err != nil || got != tt.want {
+      t.Errorf("parseSSHTarget(%q) = %+v, %v; want %+v", tt.in, got, err, tt.want)
+    }
+  }
+}
+
+func TestSSHDialerDirectTCPIP(t *testing.T) {
+  clientKey := newTestSigner(t)
+  server := startTestSSHServer(t, clientKey.PublicKey())
+  editorHost, editorPort := startEchoServer(t)
+
+  dialer := &SSHDialer{
+    Hops:            []sshTarget{mustTarget(t, server.Addr)},
+    Auth:            []ssh.AuthMethod{ssh.PublicKeys(clientKey)},
+    HostKeyCallback: writeKnownHosts(t, map[string]ssh.PublicKey{server.Addr: server.HostKey.PublicKey()}),
+  }
+  conn, err := dialer.DialEditor(editorHost, editorPort)
+  if err != nil {
+    t.Fatalf("DialEditor: %v", err)
+  }
+  defer conn.Close()
+
+  roundTrip(t, conn, "220 Sublime Text 4")
+  want := net.JoinHostPort(editorHost, strconv.Itoa(editorPort))
+  if got := server.Targets(); len(got) != 1 || got[0] != want {
+    t.Errorf("direct-tcpip targets = %v, want [%s]", got, want)
+  }
+}
+
+func TestSSHDialerProxyJump(t *testing.T) {
+  clientKey := newTestSigner(t)
+  jump := startTestSSHServer(t, clientKey.PublicKey())
+  last := startTestSSHServer(t, clientKey.PublicKey())
+  editorHost, editorPort := startEchoServer(t)
+
+  var dialed []string
+  dialer := &SSHDialer{
+    Hops: []sshTarget{mustTarget(t, jump.Addr), mustTarget(t, last.Addr)},
+    Auth: []ssh.AuthMethod{ssh.PublicKeys(clientKey)},
+    HostKeyCallback: writeKnownHosts(t, map[string]ssh.PublicKey{
+      jump.Addr: jump.HostKey.PublicKey(),
+      last.Addr: last.HostKey.PublicKey(),
+    }),
+    // 只有第一跳经过 Dial (实际运行时为代理)，之后的跳都经由上一跳的通道
+    Dial: func(network, addr string) (net.Conn, error) {
+      dialed = append(dialed, addr)
+      return net.Dial(network, addr)
+    },
+  }
+  conn, err := dialer.DialEditor(editorHost, editorPort)
+  if err != nil {
+    t.Fatalf("DialEditor: %v", err)
+  }
+  defer conn.Close()
+
+  roundTrip(t, conn, "hello through the jump host")
+  if len(dialed) != 1 || dialed[0] != jump.Addr {
+    t.Errorf("Dial called for %v, want only the first hop %s", dialed, jump.Addr)
+  }
+  if got := jump.Targets(); len(got) != 1 || got[0] != last.Addr {
+    t.Errorf("jump host opened %v, want [%s]", got, last.Addr)
+  }
+  want := net.JoinHostPort(editorHost, strconv.Itoa(editorPort))
+  if got := last.Targets(); len(got) != 1 || got[0] != want {
+    t.Errorf("last hop opened %v, want [%s]", got, want)
+  }
+}
+
+func TestSSHDialerRejectsUnknownHostKey(t *testing.T) {
+  clientKey := newTestSigner(t)
+  server := startTestSSHServer(t, clientKey.PublicKey())
+  editorHost, editorPort := startEchoServer(t)
+
+  // known_hosts 中记录的是另一个密钥，例如服务器被冒充
+  dialer := &SSHDialer{
+    Hops:            []sshTarget{mustTarget(t, server.Addr)},
+    Auth:            []ssh.AuthMethod{ssh.PublicKeys(clientKey)},
+    HostKeyCallback: writeKnownHosts(t, map[string]ssh.PublicKey{server.Addr: newTestSigner(t).PublicKey()}),
+  }
+  conn, err := dialer.DialEditor(editorHost, editorPort)
+  if err == nil {
+    conn.Close()
+    t.Fatal("DialEditor succeeded with a mismatched host key")
+  }
+  if !strings.Contains(err.Error(), "handshake") {
+    t.Errorf("error = %v, want a handshake failure", err)
+  }
+  if got := server.Targets(); len(got) != 0 {
+    t.Errorf("channels opened despite the host key mismatch: %v", got)
+  }
+}
+
+func TestSSHDialerRejectsUnknownClientKey(t *testing.T) {
+  server := startTestSSHServer(t, newTestSigner(t).PublicKey())
+  editorHost, editorPort := startEchoServer(t)
+
+  dialer := &SSHDialer{
+    Hops:            []sshTarget{mustTarget(t, server.Addr)},
+    Auth:            []ssh.AuthMethod{ssh.PublicKeys(newTestSigner(t))},
+    HostKeyCallback: writeKnownHosts(t, map[string]ssh.PublicKey{server.Addr: server.HostKey.PublicKey()}),
+  }
+  if conn, err := dialer.DialEditor(editorHost, editorPort); err == nil {
+    conn.Close()
+    t.Fatal("DialEditor succeeded with an unauthorized client key")
+  }
+}
+
+func TestKnownHostAlgorithms(t *testing.T) {
+  key := newTestSigner(t).PublicKey()
+  cb := writeKnownHosts(t, map[string]ssh.PublicKey{"example.com:2222": key})
+
+  if got := knownHostAlgorithms(cb, "example.com:2222"); len(got) != 1 || got[0] != ssh.KeyAlgoED25519 {
+    t.Errorf("knownHostAlgorithms(known host) = %v, want [%s]", got, ssh.KeyAlgoED25519)
+  }
+  if got := knownHostAlgorithms(cb, "other.example.com:22"); got != nil {
+    t.Errorf("knownHostAlgorithms(unknown host) = %v, want nil", got)
+  }
+}
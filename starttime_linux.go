@@ -0,0 +1,66 @@
+//go:build linux
+
+package main
+
+import (
+  "bufio"
+  "fmt"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// clockTicksPerSecond 是 /proc/<pid>/stat 中 starttime 的单位 (USER_HZ)，Linux 上固定为 100
+const clockTicksPerSecond = 100
+
+// processStartTime 从 /proc 读取进程的启动时间。
+func processStartTime(pid int) (time.Time, error) {
+  stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+  if err != nil {
+    return time.Time{}, err
+  }
+
+  // 第二个字段 (comm) 可能包含空格和括号，从最后一个 ')' 之后开始解析
+  end := strings.LastIndexByte(string(stat), ')')
+  if end < 0 {
+    return time.Time{}, fmt.Errorf("malformed /proc/%d/stat", pid)
+  }
+  fields := strings.Fields(string(stat[end+1:]))
+  // starttime 是第 22 个字段，也就是 ')' 之后的第 20 个
+  if len(fields) < 20 {
+    return time.Time{}, fmt.Errorf("malformed /proc/%d/stat", pid)
+  }
+  ticks, err := strconv.ParseInt(fields[19], 10, 64)
+  if err != nil {
+    return time.Time{}, fmt.Errorf("malformed starttime in /proc/%d/stat: %w", pid, err)
+  }
+
+  boot, err := bootTime()
+  if err != nil {
+    return time.Time{}, err
+  }
+  offset := time.Duration(ticks) * time.Second / clockTicksPerSecond
+  return boot.Add(offset).Truncate(time.Second), nil
+}
+
+// bootTime 从 /proc/stat 的 btime 行读取系统启动时间。
+func bootTime() (time.Time, error) {
+  f, err := os.Open("/proc/stat")
+  if err != nil {
+    return time.Time{}, err
+  }
+  defer f.Close()
+
+  scanner := bufio.NewScanner(f)
+  for scanner.Scan() {
+    if rest, ok := strings.CutPrefix(scanner.Text(), "btime "); ok {
+      sec, err := strconv.ParseInt(strings.TrimSpace(rest), 10, 64)
+      if err != nil {
+        return time.Time{}, err
+      }
+      return time.Unix(sec, 0), nil
+    }
+  }
+  return time.Time{}, fmt.Errorf("btime not found in /proc/stat")
+}
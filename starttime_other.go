@@ -0,0 +1,19 @@
+//go:build unix && !linux
+
+package main
+
+import (
+  "os/exec"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// processStartTime 通过 ps 查询进程的启动时间 (macOS 和 BSD 没有 /proc)。
+func processStartTime(pid int) (time.Time, error) {
+  out, err := exec.Command("ps", "-o", "lstart=", "-p", strconv.Itoa(pid)).Output()
+  if err != nil {
+    return time.Time{}, err
+  }
+  return time.ParseInLocation("Mon Jan _2 15:04:05 2006", strings.TrimSpace(string(out)), time.Local)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+)
+
+// subcommandFlags 是 gomate locks 和 gomate recover 共用的命令行解析：两者都接受 -v/-verbose，
+// 选项既可以写在命令之前，也可以写在命令之后。
+type subcommandFlags struct {
+  *flag.FlagSet
+  verbose bool
+}
+
+// newSubcommandFlags 返回名为 name 的子命令的 flag 集合，参数有误时打印 usage。
+func newSubcommandFlags(name string, usage string) *subcommandFlags {
+  s := &subcommandFlags{FlagSet: flag.NewFlagSet(name, flag.ContinueOnError)}
+  s.Usage = func() {
+    fmt.Fprint(os.Stderr, usage)
+  }
+  s.BoolVar(&s.verbose, "v", false, "Enable verbose logging output")
+  s.BoolVar(&s.verbose, "verbose", false, "Enable verbose logging output")
+  return s
+}
+
+// parse 解析 args 并按 -v 配置日志，返回命令名和命令的参数。选项可以出现在命令和参数之间的任何位置，
+// 例如 "apply <id> --to FILE"；"--" 之后的内容都是参数。参数有误或者缺少命令时返回 false，此时已经打印了错误或 usage。
+func (s *subcommandFlags) parse(args []string) (string, []string, bool) {
+  var positional []string
+  for {
+    if err := s.Parse(args); err != nil {
+      return "", nil, false
+    }
+    rest := s.Args()
+    if len(rest) == 0 {
+      break
+    }
+    // flag 在 "--" 或第一个参数处停止；"--" 之后不再解析选项
+    if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+      positional = append(positional, rest...)
+      break
+    }
+    positional = append(positional, rest[0])
+    args = rest[1:]
+  }
+  if len(positional) == 0 {
+    s.Usage()
+    return "", nil, false
+  }
+  configureLogging(s.verbose)
+  return positional[0], positional[1:], true
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "fmt"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "regexp"
+  "strings"
+  "text/template"
+  "time"
+)
+
+// templateGlobsFile 是模板目录中按文件名通配符选择模板的规则文件，每行为 "<通配符> <模板文件>"
+const templateGlobsFile = "globs"
+
+// templateSuffix 是按扩展名选择的模板文件的后缀，例如 sh.tmpl 用于 *.sh
+const templateSuffix = ".tmpl"
+
+// templateIncludeDepth 限制 include 的嵌套层数，防止模板互相包含
+const templateIncludeDepth = 8
+
+// TemplateData 是模板中可以使用的占位符，例如 {{.Date}}、{{.Package}}。
+type TemplateData struct {
+  Path     string // 文件的绝对路径
+  Filename string // 文件名，例如 main_test.go
+  Name     string // 去掉扩展名的文件名，例如 main_test
+  Dir      string // 所在目录的名称
+  Package  string // 根据所在目录推断的 Go 包名
+  User     string
+  Host     string
+  Date     string // 2006-01-02
+  Year     int
+}
+
+// defaultTemplateDir 返回默认的模板目录：$GOMATE_TEMPLATE_DIR 或用户配置目录下的 gomate/templates。
+func defaultTemplateDir() string {
+  if dir := os.Getenv("GOMATE_TEMPLATE_DIR"); dir != "" {
+    return dir
+  }
+  if config, err := os.UserConfigDir(); err == nil {
+    return filepath.Join(config, "gomate", "templates")
+  }
+  return ""
+}
+
+// findTemplate 在模板目录中为 filePath 选择模板：先按 globs 中的规则依次匹配，再按扩展名查找 <ext>.tmpl。
+// 没有合适的模板时返回空字符串。
+func findTemplate(dir string, filePath string) (string, error) {
+  abs, err := filepath.Abs(filePath)
+  if err != nil {
+    return "", fmt.Errorf("error getting absolute path: %w", err)
+  }
+  name := filepath.Base(abs)
+
+  rules, err := os.Open(filepath.Join(dir, templateGlobsFile))
+  if err == nil {
+    defer rules.Close()
+    scanner := bufio.NewScanner(rules)
+    for line := 1; scanner.Scan(); line++ {
+      fields := strings.Fields(scanner.Text())
+      if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+        continue
+      }
+      if len(fields) != 2 {
+        return "", fmt.Errorf("%s:%d: expected \"<glob> <template>\"", rules.Name(), line)
+      }
+      // 含路径分隔符的通配符匹配绝对路径，否则只匹配文件名；无论文件以相对路径还是绝对路径给出，结果都相同
+      subject := name
+      if strings.ContainsAny(fields[0], `/\`) {
+        subject = filepath.ToSlash(abs)
+      }
+      matched, err := filepath.Match(filepath.ToSlash(fields[0]), subject)
+      if err != nil {
+        return "", fmt.Errorf("%s:%d: %w", rules.Name(), line, err)
+      }
+      if matched {
+        return filepath.Join(dir, fields[1]), nil
+      }
+    }
+    if err := scanner.Err(); err != nil {
+      return "", err
+    }
+  } else if !os.IsNotExist(err) {
+    return "", err
+  }
+
+  if ext := strings.TrimPrefix(filepath.Ext(name), "."); ext != "" {
+    path := filepath.Join(dir, ext+templateSuffix)
+    if _, err := os.Stat(path); err == nil {
+      return path, nil
+    }
+  }
+  return "", nil
+}
+
+// renderTemplate 为尚不存在的 filePath 生成初始内容。没有模板目录或没有匹配的模板时返回 nil。
+func renderTemplate(dir string, filePath string) ([]byte, error) {
+  if dir == "" {
+    return nil, nil
+  }
+  path, err := findTemplate(dir, filePath)
+  if err != nil || path == "" {
+    return nil, err
+  }
+  slog.Debug("using template", "template", path, "file", filePath)
+
+  abs, err := filepath.Abs(filePath)
+  if err != nil {
+    return nil, fmt.Errorf("error getting absolute path: %w", err)
+  }
+  now := time.Now()
+  data := TemplateData{
+    Path:     abs,
+    Filename: filepath.Base(abs),
+    Name:     strings.TrimSuffix(filepath.Base(abs), filepath.Ext(abs)),
+    Dir:      filepath.Base(filepath.Dir(abs)),
+    Package:  goPackageName(filepath.Dir(abs)),
+    User:     currentUserName(),
+    Date:     now.Format(time.DateOnly),
+    Year:     now.Year(),
+  }
+  data.Host, _ = os.Hostname()
+
+  return executeTemplate(dir, path, data, 0)
+}
+
+// executeTemplate 展开一个模板文件。模板中可以用 {{include "license.tmpl"}} 包含模板目录中的其他文件。
+func executeTemplate(dir string, path string, data TemplateData, depth int) ([]byte, error) {
+  if depth > templateIncludeDepth {
+    return nil, fmt.Errorf("template %s: includes nested too deeply", path)
+  }
+  text, err := os.ReadFile(path)
+  if err != nil {
+    return nil, fmt.Errorf("failed to read template: %w", err)
+  }
+  funcs := template.FuncMap{
+    "include": func(name string) (string, error) {
+      out, err := executeTemplate(dir, filepath.Join(dir, name), data, depth+1)
+      return string(out), err
+    },
+  }
+  t, err := template.New(filepath.Base(path)).Funcs(funcs).Option("missingkey=error").Parse(string(text))
+  if err != nil {
+    return nil, fmt.Errorf("invalid template %s: %w", path, err)
+  }
+  var out bytes.Buffer
+  if err := t.Execute(&out, data); err != nil {
+    return nil, fmt.Errorf("failed to expand template %s: %w", path, err)
+  }
+  return out.Bytes(), nil
+}
+
+var goPackageClauseRe = regexp.MustCompile(`(?m)^package\s+([A-Za-z_][A-Za-z0-9_]*)`)
+
+// goPackageName 推断目录 dir 中 Go 文件的包名：优先使用目录中已有的非测试文件的 package 子句，
+// 否则由目录名生成一个合法的包名。
+func goPackageName(dir string) string {
+  if matches, _ := filepath.Glob(filepath.Join(dir, "*.go")); len(matches) > 0 {
+    for _, m := range matches {
+      if strings.HasSuffix(m, "_test.go") {
+        continue
+      }
+      if content, err := os.ReadFile(m); err == nil {
+        if sub := goPackageClauseRe.FindSubmatch(content); sub != nil {
+          return string(sub[1])
+        }
+      }
+    }
+  }
+
+  // 包名使用小写字母和数字，去掉目录名中的其他字符
+  var b strings.Builder
+  for _, r := range strings.ToLower(filepath.Base(dir)) {
+    if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' && b.Len() > 0 {
+      b.WriteRune(r)
+    }
+  }
+  if b.Len() == 0 {
+    return "main"
+  }
+  return b.String()
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+  "fmt"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+)
+
+// writeTemplates 在新的模板目录中写入 files (文件名 -> 内容)。
+func writeTemplates(t *testing.T, files map[string]string) string {
+  t.Helper()
+  dir := t.TempDir()
+  for name, content := range files {
+    if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+      t.Fatal(err)
+    }
+  }
+  return dir
+}
+
+func TestFindTemplate(t *testing.T) {
+  project := t.TempDir()
+  if err := os.Mkdir(filepath.Join(project, "cmd"), 0755); err != nil {
+    t.Fatal(err)
+  }
+  globs := strings.Join([]string{
+    "# 注释和空行被忽略",
+    "",
+    "*_test.go gotest.tmpl",
+    filepath.ToSlash(project) + "/cmd/*.go cmd.tmpl",
+    "Makefile make.tmpl",
+  }, "\n")
+  dir := writeTemplates(t, map[string]string{
+    templateGlobsFile: globs,
+    "go.tmpl":         "package {{.Package}}\n",
+    "sh.tmpl":         "#!/bin/sh\n",
+  })
+
+  tests := []struct {
+    file string
+    want string
+  }{
+    // globs 中的规则先于扩展名，并按顺序匹配
+    {filepath.Join(project, "main_test.go"), "gotest.tmpl"},
+    {filepath.Join(project, "cmd", "main_test.go"), "gotest.tmpl"},
+    {filepath.Join(project, "cmd", "main.go"), "cmd.tmpl"},
+    {filepath.Join(project, "Makefile"), "make.tmpl"},
+    {filepath.Join(project, "main.go"), "go.tmpl"},
+    {filepath.Join(project, "run.sh"), "sh.tmpl"},
+    // 没有规则和 <ext>.tmpl 时不使用模板
+    {filepath.Join(project, "notes.txt"), ""},
+    {filepath.Join(project, "LICENSE"), ""},
+  }
+  for _, tt := range tests {
+    got, err := findTemplate(dir, tt.file)
+    if err != nil {
+      t.Fatalf("findTemplate(%s) = %v", tt.file, err)
+    }
+    if want := filepath.Join(dir, tt.want); tt.want == "" && got != "" || tt.want != "" && got != want {
+      t.Errorf("findTemplate(%s) = %q, want %s", tt.file, got, tt.want)
+    }
+  }
+
+  // 含路径的规则匹配绝对路径，以相对路径给出的文件选中同一个模板
+  t.Chdir(project)
+  if got, err := findTemplate(dir, filepath.Join("cmd", "main.go")); err != nil || got != filepath.Join(dir, "cmd.tmpl") {
+    t.Errorf("findTemplate(cmd/main.go) = %q, %v; want cmd.tmpl", got, err)
+  }
+}
+
+func TestFindTemplateRejectsInvalidRules(t *testing.T) {
+  for _, rule := range []string{"*.go", "[ broken.tmpl", "*.go go.tmpl extra"} {
+    dir := writeTemplates(t, map[string]string{templateGlobsFile: rule + "\n"})
+    if _, err := findTemplate(dir, "main.go"); err == nil || !strings.Contains(err.Error(), templateGlobsFile+":1") {
+      t.Errorf("rule %q: err = %v, want an error pointing at %s:1", rule, err, templateGlobsFile)
+    }
+  }
+}
+
+func TestRenderTemplate(t *testing.T) {
+  dir := writeTemplates(t, map[string]string{
+    "go.tmpl":      `{{include "license.tmpl"}}package {{.Package}} // {{.Filename}} {{.Name}} {{.Dir}} {{.Path}}` + "\n",
+    "license.tmpl": "// Copyright {{.Year}} {{.User}} {{.Date}}\n",
+    "txt.tmpl":     "{{.Missing}}\n",
+    "loop.tmpl":    `{{include "loop.tmpl"}}`,
+    templateGlobsFile: "*.loop loop.tmpl\n",
+  })
+  project := filepath.Join(t.TempDir(), "my-tool")
+  if err := os.Mkdir(project, 0755); err != nil {
+    t.Fatal(err)
+  }
+  file := filepath.Join(project, "main.go")
+
+  // 目录中还没有 Go 文件时，包名由目录名生成
+  got, err := renderTemplate(dir, file)
+  if err != nil {
+    t.Fatal(err)
+  }
+  now := time.Now()
+  want := fmt.Sprintf("// Copyright %d %s %s\npackage mytool // main.go main my-tool %s\n",
+    now.Year(), currentUserName(), now.Format(time.DateOnly), file)
+  if string(got) != want {
+    t.Errorf("renderTemplate =\n%s\nwant\n%s", got, want)
+  }
+  if strings.Contains(currentUserName(), `\`) {
+    t.Errorf("{{.User}} keeps the domain: %s", currentUserName())
+  }
+
+  // 已有的 Go 文件决定包名
+  if err := os.WriteFile(filepath.Join(project, "tool.go"), []byte("// tool\npackage tool\n"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  if got, err := renderTemplate(dir, filepath.Join(project, "extra.go")); err != nil || !strings.Contains(string(got), "package tool ") {
+    t.Errorf("renderTemplate in a package = %q, %v", got, err)
+  }
+
+  // 没有模板目录或没有匹配的模板时以空文件打开
+  for _, tt := range []struct{ dir, file string }{{"", file}, {dir, filepath.Join(project, "notes.md")}} {
+    if got, err := renderTemplate(tt.dir, tt.file); got != nil || err != nil {
+      t.Errorf("renderTemplate(%q, %s) = %q, %v; want no content", tt.dir, tt.file, got, err)
+    }
+  }
+
+  // 未知的占位符和互相包含的模板报告错误，而不是生成残缺的内容
+  for _, name := range []string{"notes.txt", "x.loop"} {
+    if got, err := renderTemplate(dir, filepath.Join(project, name)); err == nil {
+      t.Errorf("renderTemplate(%s) = %q, want an error", name, got)
+    }
+  }
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+  "crypto/rand"
+  "encoding/hex"
+  "errors"
+  "sort"
+  "sync"
+)
+
+// tokenBytes 是会话令牌的随机字节数
+const tokenBytes = 16
+
+var (
+  // ErrUnknownToken 表示编辑器发来的令牌从未由本会话发出，可能是伪造的保存
+  ErrUnknownToken = errors.New("unknown token")
+  // ErrExpiredToken 表示令牌对应的文件已经在编辑器中关闭
+  ErrExpiredToken = errors.New("expired token")
+)
+
+// tokenRegistry 是会话注册表：每次打开文件时用 crypto/rand 生成的令牌 -> 文件的规范身份。
+// 令牌不可预测，也不会在不同的会话之间重复，猜出文件路径并不能伪造对它的保存。
+type tokenRegistry struct {
+  mu      sync.Mutex
+  open    map[string]FileID
+  expired map[string]bool
+}
+
+// sessionTokens 是本进程发出的令牌
+var sessionTokens = newTokenRegistry()
+
+func newTokenRegistry() *tokenRegistry {
+  return &tokenRegistry{open: make(map[string]FileID), expired: make(map[string]bool)}
+}
+
+// Issue 返回 id 的令牌。同一个文件在本会话中再次发送 (重新激活) 时沿用已有的令牌，
+// 编辑器据此激活已经打开的标签页。
+func (r *tokenRegistry) Issue(id FileID) (string, error) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  for token, openID := range r.open {
+    if openID.Key() == id.Key() {
+      return token, nil
+    }
+  }
+
+  b := make([]byte, tokenBytes)
+  if _, err := rand.Read(b); err != nil {
+    return "", err
+  }
+  token := hex.EncodeToString(b)
+  r.open[token] = id
+  return token, nil
+}
+
+// Lookup 返回令牌对应的文件身份，未发出或已失效的令牌返回 ErrUnknownToken 或 ErrExpiredToken。
+func (r *tokenRegistry) Lookup(token string) (FileID, error) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  if id, ok := r.open[token]; ok {
+    return id, nil
+  }
+  if r.expired[token] {
+    return FileID{}, ErrExpiredToken
+  }
+  return FileID{}, ErrUnknownToken
+}
+
+// Expire 使令牌失效，之后使用它的保存会被拒绝。
+func (r *tokenRegistry) Expire(token string) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  if _, ok := r.open[token]; ok {
+    delete(r.open, token)
+    r.expired[token] = true
+  }
+}
+
+// Refresh 在保存以新文件替换原文件之后，更新同一路径的令牌所对应的文件身份。
+func (r *tokenRegistry) Refresh(id FileID) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  for token, openID := range r.open {
+    if openID.RealPath == id.RealPath {
+      r.open[token] = id
+    }
+  }
+}
+
+// OpenTokens 按令牌排序返回仍然有效的令牌及其文件路径。
+func (r *tokenRegistry) OpenTokens() (tokens []string, files []string) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  for token := range r.open {
+    tokens = append(tokens, token)
+  }
+  sort.Strings(tokens)
+  for _, token := range tokens {
+    files = append(files, r.open[token].RealPath)
+  }
+  return tokens, files
+}
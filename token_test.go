@@ -0,0 +1,105 @@
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "errors"
+  "io"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+func TestTokenRegistry(t *testing.T) {
+  r := newTokenRegistry()
+  a := FileID{RealPath: "/home/user/a.txt", Device: 1, Inode: 10}
+  b := FileID{RealPath: "/home/user/b.txt", Device: 1, Inode: 20}
+
+  tokenA, err := r.Issue(a)
+  if err != nil {
+    t.Fatal(err)
+  }
+  tokenB, err := r.Issue(b)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(tokenA) != 2*tokenBytes || tokenA == tokenB {
+    t.Fatalf("tokens %q and %q, want distinct %d-byte hex tokens", tokenA, tokenB, tokenBytes)
+  }
+  // 重新激活同一个文件时沿用已有的令牌
+  if again, _ := r.Issue(a); again != tokenA {
+    t.Errorf("reissued token %q, want %q", again, tokenA)
+  }
+
+  // 每个令牌只对应签发时的文件，不能用来保存另一个文件
+  if id, err := r.Lookup(tokenA); err != nil || id != a {
+    t.Errorf("Lookup(tokenA) = %+v, %v; want %+v", id, err, a)
+  }
+  if id, err := r.Lookup(tokenB); err != nil || id != b {
+    t.Errorf("Lookup(tokenB) = %+v, %v; want %+v", id, err, b)
+  }
+  for _, token := range []string{"", "/home/user/a.txt", tokenA[:len(tokenA)-1]} {
+    if _, err := r.Lookup(token); !errors.Is(err, ErrUnknownToken) {
+      t.Errorf("Lookup(%q) error = %v, want %v", token, err, ErrUnknownToken)
+    }
+  }
+
+  // 文件关闭之后令牌失效，另一个文件的令牌不受影响
+  r.Expire(tokenA)
+  if _, err := r.Lookup(tokenA); !errors.Is(err, ErrExpiredToken) {
+    t.Errorf("Lookup of an expired token: %v, want %v", err, ErrExpiredToken)
+  }
+  if _, err := r.Lookup(tokenB); err != nil {
+    t.Errorf("Lookup(tokenB) after expiring tokenA: %v", err)
+  }
+  // 未发出的令牌不会因 Expire 变成“已失效”
+  r.Expire("never-issued")
+  if _, err := r.Lookup("never-issued"); !errors.Is(err, ErrUnknownToken) {
+    t.Errorf("Lookup of an unissued token after Expire: %v, want %v", err, ErrUnknownToken)
+  }
+
+  // 同一个文件再次打开时得到新的令牌，失效的令牌仍被拒绝
+  renewed, err := r.Issue(a)
+  if err != nil || renewed == tokenA {
+    t.Errorf("Issue after Expire = %q, %v; want a new token", renewed, err)
+  }
+  if _, err := r.Lookup(tokenA); !errors.Is(err, ErrExpiredToken) {
+    t.Errorf("expired token accepted after the file was reopened: %v", err)
+  }
+
+  // 保存替换文件之后令牌跟随新的 inode
+  replaced := FileID{RealPath: b.RealPath, Device: 1, Inode: 30}
+  r.Refresh(replaced)
+  if id, _ := r.Lookup(tokenB); id != replaced {
+    t.Errorf("Lookup after Refresh = %+v, want %+v", id, replaced)
+  }
+  tokens, files := r.OpenTokens()
+  if len(tokens) != 2 || len(files) != 2 {
+    t.Errorf("OpenTokens = %v, %v; want the tokens of a.txt and b.txt", tokens, files)
+  }
+}
+
+func TestHandleSaveRejectsExpiredToken(t *testing.T) {
+  quietLogs(t)
+  profile, err := lookupProfile("generic")
+  if err != nil {
+    t.Fatal(err)
+  }
+  file := filepath.Join(t.TempDir(), "notes.txt")
+  if err := os.WriteFile(file, []byte("original\n"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  token := issueTestToken(t, file)
+  sessionTokens.Expire(token)
+
+  // 文件关闭之后编辑器再保存：内容被读掉，原文件保持不变
+  cmd := saveCommand(token, []byte("late save\n"))
+  _, err = handleCommands(bufio.NewReader(bytes.NewReader(cmd)), io.Discard, profile, Capabilities{}, 1<<20)
+  var saveErr *SaveError
+  if !errors.As(err, &saveErr) || !errors.Is(err, ErrExpiredToken) {
+    t.Fatalf("save with an expired token: %v, want a SaveError wrapping %v", err, ErrExpiredToken)
+  }
+  if got, _ := os.ReadFile(file); string(got) != "original\n" {
+    t.Errorf("file = %q, want it unchanged", got)
+  }
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+  "fmt"
+  "log/slog"
+  "net"
+  "strconv"
+)
+
+// DialOptions 描述如何建立到远程编辑器的连接。
+type DialOptions struct {
+  Host string
+  Port int
+
+  // Via 非空时，通过外部命令的 stdin/stdout 传输 rmate 数据流 (类似 ssh 的 ProxyCommand)
+  Via string
+
+  // Proxy 是 --proxy 参数的值 (socks5://、socks5h://、http:// 或 https://)，
+  // 为空时使用 ALL_PROXY/HTTPS_PROXY 环境变量
+  Proxy string
+
+  // SSH.Host 非空时，由内置 SSH 客户端经 direct-tcpip 通道连接编辑器
+  SSH SSHOptions
+}
+
+// Address 返回 host:port 形式的编辑器地址。
+func (o DialOptions) Address() string {
+  return net.JoinHostPort(o.Host, strconv.Itoa(o.Port))
+}
+
+// String 描述编辑器地址及所经过的传输方式，记录在锁文件中。
+func (o DialOptions) String() string {
+  switch {
+  case o.Via != "":
+    return o.Address() + " via " + o.Via
+  case o.SSH.Host != "":
+    return o.Address() + " via ssh " + o.SSH.Host
+  }
+  return o.Address()
+}
+
+// dialEditor 根据 DialOptions 选择传输方式并连接到远程编辑器。
+func dialEditor(opts DialOptions) (net.Conn, error) {
+  if opts.Via != "" {
+    slog.Debug("connecting via command", "command", opts.Via)
+    return dialCommand(opts.Via, opts.Host, opts.Port)
+  }
+
+  if opts.SSH.Host != "" {
+    dialer, err := newSSHDialer(opts.SSH)
+    if err != nil {
+      return nil, err
+    }
+    // 第一跳 SSH 连接同样遵循代理设置
+    dialer.Dial = func(network, addr string) (net.Conn, error) {
+      host, portStr, _ := net.SplitHostPort(addr)
+      port, _ := strconv.Atoi(portStr)
+      return dialTCP(opts.Proxy, host, port)
+    }
+    slog.Debug("connecting via SSH", "address", opts.Address(), "ssh", opts.SSH.Host)
+    return dialer.DialEditor(opts.Host, opts.Port)
+  }
+
+  conn, err := dialTCP(opts.Proxy, opts.Host, opts.Port)
+  if err != nil {
+    return nil, fmt.Errorf("failed to connect to editor %s: %w", opts.Address(), err)
+  }
+  return conn, nil
+}
+
+// dialTCP 建立到 host:port 的 TCP 连接，必要时经过代理。
+func dialTCP(flagProxy string, host string, port int) (net.Conn, error) {
+  addr := net.JoinHostPort(host, strconv.Itoa(port))
+
+  proxy, err := resolveProxy(flagProxy, host, port)
+  if err != nil {
+    return nil, err
+  }
+  if proxy != nil {
+    slog.Debug("connecting through proxy", "address", addr, "proxy", proxy.Redacted())
+    return dialProxy(proxy, host, port)
+  }
+
+  slog.Debug("connecting directly", "address", addr)
+  return net.Dial("tcp", addr)
+}
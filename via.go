@@ -0,0 +1,300 @@
+package main
+
+import (
+  "bytes"
+  "errors"
+  "fmt"
+  "io"
+  "log/slog"
+  "net"
+  "os"
+  "os/exec"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+const (
+  // viaExitGrace 是关闭 stdin 后等待子进程自行退出的时间，超时后强制终止
+  viaExitGrace = 3 * time.Second
+  // viaStderrLimit 是保留的子进程 stderr 尾部字节数，用于错误报告
+  viaStderrLimit = 4096
+)
+
+// commandAddr 实现 net.Addr，用于标识一个命令传输端点。
+type commandAddr string
+
+func (a commandAddr) Network() string { return "via" }
+func (a commandAddr) String() string  { return string(a) }
+
+// stderrCapture 记录子进程的 stderr：逐行写入日志，并保留末尾部分用于错误信息。
+type stderrCapture struct {
+  mu      sync.Mutex
+  tail    []byte
+  pending []byte
+}
+
+func (s *stderrCapture) Write(p []byte) (int, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  s.tail = append(s.tail, p...)
+  if len(s.tail) > viaStderrLimit {
+    s.tail = s.tail[len(s.tail)-viaStderrLimit:]
+  }
+
+  s.pending = append(s.pending, p...)
+  for {
+    i := bytes.IndexByte(s.pending, '\n')
+    if i < 0 {
+      break
+    }
+    slog.Debug("via command output", "line", strings.TrimRight(string(s.pending[:i]), "\r"))
+    s.pending = s.pending[i+1:]
+  }
+  return len(p), nil
+}
+
+// String 返回捕获到的 stderr 尾部内容。
+func (s *stderrCapture) String() string {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  return strings.TrimSpace(string(s.tail))
+}
+
+// commandConn 通过子进程的 stdin/stdout 实现 net.Conn。
+type commandConn struct {
+  cmd    *exec.Cmd
+  stdin  *os.File // 写入端，连接到子进程的 stdin
+  stdout *os.File // 读取端，连接到子进程的 stdout
+  stderr *stderrCapture
+  addr   commandAddr
+
+  done    chan struct{} // 子进程退出后关闭
+  waitErr error
+
+  closeOnce sync.Once
+}
+
+// dialCommand 启动 via 命令，并返回以其 stdio 为载体的连接。
+// 命令中的 %h、%p 会被替换为编辑器的主机和端口，%% 表示字面量 %。
+func dialCommand(command string, host string, port int) (net.Conn, error) {
+  argv, err := splitCommandLine(command)
+  if err != nil {
+    return nil, fmt.Errorf("invalid via command %q: %w", command, err)
+  }
+  if len(argv) == 0 {
+    return nil, fmt.Errorf("invalid via command %q: empty command", command)
+  }
+  for i := range argv {
+    argv[i] = expandViaTokens(argv[i], host, port)
+  }
+
+  // 使用 os.Pipe 而不是 StdinPipe/StdoutPipe，以便支持读写超时
+  stdinR, stdinW, err := os.Pipe()
+  if err != nil {
+    return nil, fmt.Errorf("failed to create stdin pipe: %w", err)
+  }
+  stdoutR, stdoutW, err := os.Pipe()
+  if err != nil {
+    stdinR.Close()
+    stdinW.Close()
+    return nil, fmt.Errorf("failed to create stdout pipe: %w", err)
+  }
+
+  c := &commandConn{
+    cmd:    exec.Command(argv[0], argv[1:]...),
+    stdin:  stdinW,
+    stdout: stdoutR,
+    stderr: &stderrCapture{},
+    addr:   commandAddr(strings.Join(argv, " ")),
+    done:   make(chan struct{}),
+  }
+  c.cmd.Stdin = stdinR
+  c.cmd.Stdout = stdoutW
+  c.cmd.Stderr = c.stderr
+
+  if err := c.cmd.Start(); err != nil {
+    stdinR.Close()
+    stdinW.Close()
+    stdoutR.Close()
+    stdoutW.Close()
+    return nil, fmt.Errorf("failed to start via command %q: %w", argv[0], err)
+  }
+  slog.Debug("via command started", "pid", c.cmd.Process.Pid, "address", c.addr)
+
+  // 子进程已经持有这两端，父进程必须关闭自己的副本，否则读不到 EOF
+  stdinR.Close()
+  stdoutW.Close()
+
+  go func() {
+    c.waitErr = c.cmd.Wait()
+    close(c.done)
+  }()
+
+  return c, nil
+}
+
+// exited 报告子进程是否已经退出。
+func (c *commandConn) exited() bool {
+  select {
+  case <-c.done:
+    return true
+  default:
+    return false
+  }
+}
+
+// exitError 在子进程异常退出时返回带 stderr 内容的错误。
+func (c *commandConn) exitError() error {
+  if c.waitErr == nil {
+    return nil
+  }
+  if msg := c.stderr.String(); msg != "" {
+    return fmt.Errorf("via command exited: %w: %s", c.waitErr, msg)
+  }
+  return fmt.Errorf("via command exited: %w", c.waitErr)
+}
+
+func (c *commandConn) Read(p []byte) (int, error) {
+  n, err := c.stdout.Read(p)
+  if errors.Is(err, io.EOF) {
+    // stdout 结束通常意味着子进程即将退出，给它一点时间以便报告真实原因
+    select {
+    case <-c.done:
+      if exitErr := c.exitError(); exitErr != nil {
+        return n, exitErr
+      }
+    case <-time.After(viaExitGrace):
+    }
+  }
+  return n, err
+}
+
+func (c *commandConn) Write(p []byte) (int, error) {
+  n, err := c.stdin.Write(p)
+  if err != nil && c.exited() {
+    if exitErr := c.exitError(); exitErr != nil {
+      return n, exitErr
+    }
+  }
+  return n, err
+}
+
+// Close 关闭子进程的 stdin 并等待其退出，超时则强制终止。
+func (c *commandConn) Close() error {
+  c.closeOnce.Do(func() {
+    if err := c.stdin.Close(); err != nil {
+      slog.Warn("failed to close via command stdin", "error", err)
+    }
+
+    select {
+    case <-c.done:
+    case <-time.After(viaExitGrace):
+      slog.Warn("via command did not exit, killing it", "pid", c.cmd.Process.Pid, "after", viaExitGrace)
+      if err := c.cmd.Process.Kill(); err != nil {
+        slog.Warn("failed to kill via command", "error", err)
+      }
+      <-c.done
+    }
+
+    if err := c.stdout.Close(); err != nil {
+      slog.Warn("failed to close via command stdout", "error", err)
+    }
+    slog.Debug("via command finished", "state", c.cmd.ProcessState)
+  })
+  return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr  { return commandAddr("local") }
+func (c *commandConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *commandConn) SetDeadline(t time.Time) error {
+  if err := c.stdout.SetReadDeadline(t); err != nil {
+    return err
+  }
+  return c.stdin.SetWriteDeadline(t)
+}
+
+func (c *commandConn) SetReadDeadline(t time.Time) error  { return c.stdout.SetReadDeadline(t) }
+func (c *commandConn) SetWriteDeadline(t time.Time) error { return c.stdin.SetWriteDeadline(t) }
+
+// expandViaTokens 替换 via 参数中的 %h (主机)、%p (端口) 和 %% (字面量 %)。
+func expandViaTokens(arg string, host string, port int) string {
+  var sb strings.Builder
+  for i := 0; i < len(arg); i++ {
+    if arg[i] != '%' || i+1 == len(arg) {
+      sb.WriteByte(arg[i])
+      continue
+    }
+    switch arg[i+1] {
+    case 'h':
+      sb.WriteString(host)
+    case 'p':
+      sb.WriteString(strconv.Itoa(port))
+    case '%':
+      sb.WriteByte('%')
+    default:
+      sb.WriteByte(arg[i])
+      continue
+    }
+    i++
+  }
+  return sb.String()
+}
+
+// splitCommandLine 按照类 POSIX shell 的规则拆分命令行：
+// 支持单引号、双引号和反斜杠转义，但不做变量展开或通配。
+func splitCommandLine(s string) ([]string, error) {
+  var args []string
+  var cur strings.Builder
+  inArg := false
+  var quote byte
+
+  for i := 0; i < len(s); i++ {
+    ch := s[i]
+    switch {
+    case quote == '\'':
+      if ch == '\'' {
+        quote = 0
+      } else {
+        cur.WriteByte(ch)
+      }
+    case quote == '"':
+      if ch == '"' {
+        quote = 0
+      } else if ch == '\\' && i+1 < len(s) && strings.IndexByte(`"\$`+"`", s[i+1]) >= 0 {
+        i++
+        cur.WriteByte(s[i])
+      } else {
+        cur.WriteByte(ch)
+      }
+    case ch == '\'' || ch == '"':
+      quote = ch
+      inArg = true
+    case ch == '\\' && i+1 < len(s) && strings.IndexByte(" \t'\"\\", s[i+1]) >= 0:
+      // 只转义空白、引号和反斜杠本身，保留 Windows 路径中的反斜杠
+      i++
+      cur.WriteByte(s[i])
+      inArg = true
+    case ch == ' ' || ch == '\t' || ch == '\n':
+      if inArg {
+        args = append(args, cur.String())
+        cur.Reset()
+        inArg = false
+      }
+    default:
+      cur.WriteByte(ch)
+      inArg = true
+    }
+  }
+
+  if quote != 0 {
+    return nil, fmt.Errorf("unterminated %c quote", quote)
+  }
+  if inArg {
+    args = append(args, cur.String())
+  }
+  return args, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "io"
+  "net"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+)
+
+// testViaArg 作为第一个参数时，测试二进制充当 --via 命令，第二个参数为 runTestViaCommand 的模式
+const testViaArg = "-gomate-test-via"
+
+// viaTestFailure 是 fail 模式下 via 命令输出到 stderr 的内容
+const viaTestFailure = "channel 0: open failed: connect failed: Connection refused"
+
+// runTestViaCommand 实现测试用的 via 命令，返回退出码：
+// relay 像 nc %h %p 一样在 stdin/stdout 与编辑器之间转发数据；echo 把 stdin 原样写回 stdout；
+// fail 在 stderr 上报告连接失败后以 255 退出；hang 既不读 stdin 也不退出。
+func runTestViaCommand(mode string, args []string) int {
+  switch mode {
+  case "relay":
+    c, err := net.Dial("tcp", net.JoinHostPort(args[0], args[1]))
+    if err != nil {
+      fmt.Fprintln(os.Stderr, err)
+      return 1
+    }
+    go func() {
+      io.Copy(c, os.Stdin)
+      c.(*net.TCPConn).CloseWrite()
+    }()
+    io.Copy(os.Stdout, c)
+    return 0
+  case "echo":
+    io.Copy(os.Stdout, os.Stdin)
+    return 0
+  case "fail":
+    fmt.Fprintln(os.Stderr, viaTestFailure)
+    return 255
+  case "hang":
+    time.Sleep(time.Hour)
+    return 0
+  }
+  fmt.Fprintf(os.Stderr, "unknown via test mode %q\n", mode)
+  return 2
+}
+
+// testViaCommand 返回以测试二进制作为 mode 模式的 via 命令的命令行。
+func testViaCommand(mode string, args ...string) string {
+  return strings.Join(append([]string{"'" + os.Args[0] + "'", testViaArg, mode}, args...), " ")
+}
+
+func TestDialCommandRoundTrip(t *testing.T) {
+  conn, err := dialCommand(testViaCommand("echo"), "editor", 52698)
+  if err != nil {
+    t.Fatal(err)
+  }
+  c := conn.(*commandConn)
+  if _, err := io.WriteString(conn, "220 ping\n"); err != nil {
+    t.Fatal(err)
+  }
+  conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+  got := make([]byte, len("220 ping\n"))
+  if _, err := io.ReadFull(conn, got); err != nil || string(got) != "220 ping\n" {
+    t.Fatalf("read %q, %v", got, err)
+  }
+
+  // 关闭 stdin 后命令自行退出，Close 等待并回收它
+  conn.Close()
+  if c.cmd.ProcessState == nil || !c.cmd.ProcessState.Success() {
+    t.Errorf("via command state after Close = %v, want reaped with exit status 0", c.cmd.ProcessState)
+  }
+}
+
+func TestDialCommandReportsFailure(t *testing.T) {
+  conn, err := dialCommand(testViaCommand("fail"), "editor", 52698)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer conn.Close()
+  // 命令失败时，读取报告退出状态和 stderr，而不只是 EOF
+  _, err = io.ReadAll(conn)
+  if err == nil || !strings.Contains(err.Error(), "exit status 255") || !strings.Contains(err.Error(), viaTestFailure) {
+    t.Errorf("read error = %v, want the exit status and stderr of the via command", err)
+  }
+}
+
+func TestDialCommandKillsHungCommand(t *testing.T) {
+  if testing.Short() {
+    t.Skip("waits for the via exit grace period")
+  }
+  conn, err := dialCommand(testViaCommand("hang"), "editor", 52698)
+  if err != nil {
+    t.Fatal(err)
+  }
+  c := conn.(*commandConn)
+  start := time.Now()
+  conn.Close()
+  if c.cmd.ProcessState == nil {
+    t.Fatal("via command not reaped after Close")
+  }
+  if elapsed := time.Since(start); elapsed < viaExitGrace || processAlive(c.cmd.Process.Pid) {
+    t.Errorf("Close returned after %v, process alive %v; want it killed after %v", elapsed, processAlive(c.cmd.Process.Pid), viaExitGrace)
+  }
+}
+
+func TestViaSession(t *testing.T) {
+  env := gomateEnv(t)
+  file := filepath.Join(t.TempDir(), "notes.txt")
+  if err := os.WriteFile(file, []byte("original\n"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  editor := &capsEditor{reply: []byte("edited over via\n")}
+  addr, done := startCapsEditor(t, editor)
+  host, port, _ := net.SplitHostPort(addr)
+
+  // %h 和 %p 替换为 -h 和 -p 指定的编辑器地址，由 via 命令负责连接
+  code, stderr := runGomate(t, env, "-w", "--via", testViaCommand("relay", "%h", "%p"), "-h", host, "-p", port, file)
+  <-done
+  if editor.err != nil {
+    t.Fatalf("editor: %v\ngomate stderr:\n%s", editor.err, stderr)
+  }
+  if code != exitSaved {
+    t.Fatalf("exit %d, want %d; stderr:\n%s", code, exitSaved, stderr)
+  }
+  if got, _ := os.ReadFile(file); !bytes.Equal(got, editor.reply) {
+    t.Errorf("file = %q, want %q", got, editor.reply)
+  }
+}
+
+func TestViaCommandFailureIsReported(t *testing.T) {
+  env := gomateEnv(t)
+  file := filepath.Join(t.TempDir(), "notes.txt")
+  code, stderr := runGomate(t, env, "-w", "--via", testViaCommand("fail", "%h", "%p"), file)
+  if code != exitError {
+    t.Errorf("exit %d, want %d", code, exitError)
+  }
+  if !strings.Contains(stderr, viaTestFailure) || !strings.Contains(stderr, "exit status 255") {
+    t.Errorf("stderr does not report the via command failure:\n%s", stderr)
+  }
+}